@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ActorAccountKey is the metadata key of the account really making the call
+	ActorAccountKey = "ActorAccountID"
+
+	// ActorUserKey is the metadata key of the user really making the call
+	ActorUserKey = "ActorUserID"
+
+	// ActorServiceKey is the metadata key of the service making the call on behalf of the user
+	ActorServiceKey = "ActorService"
+
+	// DelegationKey is the metadata key of the comma separated actors preceding the actor
+	DelegationKey = "Delegation"
+
+	// ImpersonateAccountKey is the metadata key of the account a caller asks to act as
+	ImpersonateAccountKey = "ImpersonateAccountID"
+
+	// ImpersonateUserKey is the metadata key of the user a caller asks to act as
+	ImpersonateUserKey = "ImpersonateUserID"
+)
+
+// WithImpersonatorRoles allows the callers holding one of roles to impersonate another
+// user. The roles must be verified by an authenticator such as JWTUnaryServerInterceptor
+// chained before. Impersonation is disabled by default.
+func WithImpersonatorRoles(roles ...string) ServerOption {
+	return func(o *serverOptions) {
+		o.impersonatorRoles = roles
+	}
+}
+
+// actorKeys are the metadata keys an authenticated caller may not set itself,
+// unless it acts on behalf of the subject of the request, see withCaller
+var actorKeys = []*string{&ActorAccountKey, &ActorUserKey, &ActorServiceKey, &DelegationKey}
+
+// Actor is whoever really makes a call on behalf of the identity (the subject):
+// a support user impersonating a customer, or a service carrying the end user
+type Actor struct {
+	AccountID uuid.UUID
+	UserID    uuid.UUID
+	Service   string
+}
+
+// String encodes the actor as "service:<name>" or "user:<user id>@<account id>"
+func (a Actor) String() string {
+	if a.Service != "" {
+		return "service:" + a.Service
+	}
+	return fmt.Sprintf("user:%s@%s", a.UserID, a.AccountID)
+}
+
+// parseActor decodes the form of Actor.String
+func parseActor(s string) (Actor, bool) {
+	if name := strings.TrimPrefix(s, "service:"); name != s {
+		return Actor{Service: name}, name != ""
+	}
+	if ids := strings.TrimPrefix(s, "user:"); ids != s {
+		parts := strings.SplitN(ids, "@", 2)
+		if len(parts) != 2 {
+			return Actor{}, false
+		}
+		userID, err := uuid.FromString(parts[0])
+		if err != nil {
+			return Actor{}, false
+		}
+		accountID, err := uuid.FromString(parts[1])
+		if err != nil {
+			return Actor{}, false
+		}
+		return Actor{AccountID: accountID, UserID: userID}, true
+	}
+	return Actor{}, false
+}
+
+// Chain returns the actors of the call from the first to the immediate caller,
+// nil when the subject called itself
+func (id *Identity) Chain() []Actor {
+	if id.Actor == nil {
+		return nil
+	}
+	return append(append([]Actor{}, id.Delegation...), *id.Actor)
+}
+
+// delegate returns a copy of id in which actor acts for the subject of id
+func (id *Identity) delegate(actor Actor) *Identity {
+	next := *id
+	next.Delegation = id.Chain()
+	next.Actor = &actor
+	return &next
+}
+
+// withCaller returns ctx in which the verified caller acts on behalf of the subject of
+// the request: the actor and delegation metadata of the request are kept, and caller
+// becomes the actor unless it already is
+func withCaller(ctx context.Context, caller Actor) (context.Context, error) {
+	incoming := &Identity{}
+	if err := parseActorChain(ctx, incoming, false); err != nil {
+		return nil, err
+	}
+	if incoming.Actor == nil || *incoming.Actor != caller {
+		incoming = incoming.delegate(caller)
+	}
+	md := incoming.Metadata()
+	values := make(map[string]string, len(actorKeys))
+	for _, key := range actorKeys {
+		values[*key] = ""
+		if v := md.Get(*key); len(v) > 0 {
+			values[*key] = v[0]
+		}
+	}
+	return withVerified(ctx, values), nil
+}
+
+// parseActorChain reads the actor and the delegation of the request into id,
+// it returns the first invalid value like parseIdentity
+func parseActorChain(ctx context.Context, id *Identity, strict bool) error {
+	var actor Actor
+	var delegation string
+	errs := make([]error, 4)
+	actor.Service, errs[0] = lookupValue(ctx, ActorServiceKey, strict)
+	actor.AccountID, errs[1] = uuidValue(ctx, ActorAccountKey, strict)
+	actor.UserID, errs[2] = uuidValue(ctx, ActorUserKey, strict)
+	delegation, errs[3] = lookupValue(ctx, DelegationKey, strict)
+	if err := firstInvalid(errs); err != nil {
+		return err
+	}
+	if actor == (Actor{}) {
+		return nil
+	}
+	id.Actor = &actor
+	for _, s := range strings.Split(delegation, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		a, ok := parseActor(s)
+		if !ok {
+			return &MetadataError{Key: DelegationKey, Err: ErrMalformed}
+		}
+		id.Delegation = append(id.Delegation, a)
+	}
+	return nil
+}
+
+// impersonate applies the impersonation requested by the caller to id, it fails
+// with codes.PermissionDenied unless the verified caller holds one of the impersonator roles
+func impersonate(ctx context.Context, id *Identity, o *serverOptions) (*Identity, error) {
+	accountVal, accountErr := lookupValue(ctx, ImpersonateAccountKey, o.strict)
+	userVal, userErr := lookupValue(ctx, ImpersonateUserKey, o.strict)
+	if err := firstInvalid([]error{accountErr, userErr}); err != nil {
+		return id, err
+	}
+	if accountVal == "" && userVal == "" {
+		return id, nil
+	}
+
+	allowed := false
+	for _, role := range o.impersonatorRoles {
+		if id.HasRole(role) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed || !id.Verified || !id.HasUser() {
+		return id, status.Error(codes.PermissionDenied, "impersonation is not allowed")
+	}
+
+	accountID, err := uuid.FromString(accountVal)
+	if err != nil {
+		return id, status.Errorf(codes.InvalidArgument, "invalid %s", ImpersonateAccountKey)
+	}
+	userID, err := uuid.FromString(userVal)
+	if err != nil {
+		return id, status.Errorf(codes.InvalidArgument, "invalid %s", ImpersonateUserKey)
+	}
+
+	next := id.delegate(Actor{AccountID: id.AccountID, UserID: id.UserID})
+	next.AccountID, next.UserID = accountID, userID
+	return next, nil
+}
+
+// WithServiceActor returns a new context for calls that the service makes on behalf
+// of the identity in ctx, the service becomes the actor and the previous actors
+// are kept in the delegation chain
+func WithServiceActor(ctx context.Context, service string) context.Context {
+	id, ok := FromContext(ctx)
+	if !ok {
+		id = &Identity{}
+	}
+	return WithIdentity(ctx, id.delegate(Actor{Service: service}))
+}
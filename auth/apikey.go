@@ -0,0 +1,412 @@
+package auth
+
+import (
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"github.com/grpc-ecosystem/go-grpc-middleware/util/metautils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrUnknownAppCode is returned by a KeyStore without key for the app code
+	ErrUnknownAppCode = errors.New("unknown app code")
+
+	// SignatureKey is the metadata key of the request signature
+	SignatureKey = "Signature"
+
+	// TimestampKey is the metadata key of the request unix timestamp in seconds
+	TimestampKey = "Timestamp"
+
+	// NonceKey is the metadata key of the request nonce
+	NonceKey = "Nonce"
+)
+
+// AppKey is the server side entry of an app code. The request signature only proves
+// the app code, the tenants, roles and scopes of the app are taken from its entry.
+type AppKey struct {
+	Secret string `json:"secret"`
+
+	// Accounts are the tenants the app may act for, "*" for any of them. A signed
+	// AccountID outside of them is rejected and the only account is used when the
+	// request has none. Without accounts the app acts for no tenant, user or project.
+	Accounts []string `json:"accounts,omitempty"`
+
+	// Roles and Scopes are granted to the app, the Roles and Scopes metadata
+	// sent by the app are ignored
+	Roles  []string `json:"roles,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// UnmarshalJSON also accepts a bare secret string, the key of an app without grants
+func (k *AppKey) UnmarshalJSON(data []byte) error {
+	var secret string
+	if err := json.Unmarshal(data, &secret); err == nil {
+		*k = AppKey{Secret: secret}
+		return nil
+	}
+	type appKey AppKey
+	return json.Unmarshal(data, (*appKey)(k))
+}
+
+// grant checks the signed tenant of a request against k and sets the verified
+// account, roles and scopes in values
+func (k *AppKey) grant(appCode string, values map[string]string) error {
+	account := values[multiAccountKey]
+	switch {
+	case account == "" && len(k.Accounts) == 1 && k.Accounts[0] != "*":
+		account = k.Accounts[0]
+	case account != "" && !contains(k.Accounts, account) && !contains(k.Accounts, "*"):
+		return status.Errorf(codes.PermissionDenied, "app %s may not act for account %s", appCode, account)
+	}
+	if account == "" && (values[UserKey] != "" || values[ProjectKey] != "") {
+		return status.Errorf(codes.PermissionDenied, "app %s may not act for a user or project without account", appCode)
+	}
+	values[multiAccountKey] = account
+	values[RolesKey] = strings.Join(k.Roles, ",")
+	values[ScopesKey] = strings.Join(k.Scopes, ",")
+	return nil
+}
+
+// KeyStore provides the entries of the app codes
+type KeyStore interface {
+	Key(appCode string) (*AppKey, error)
+}
+
+// MemoryKeyStore is a KeyStore kept in memory
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]AppKey
+}
+
+// NewMemoryKeyStore returns a store with the secrets indexed by app code, the apps
+// are granted nothing, see SetKey
+func NewMemoryKeyStore(secrets map[string]string) *MemoryKeyStore {
+	s := &MemoryKeyStore{keys: map[string]AppKey{}}
+	for appCode, secret := range secrets {
+		s.Set(appCode, secret)
+	}
+	return s
+}
+
+// Set adds or replaces appCode with a key of secret granting nothing
+func (s *MemoryKeyStore) Set(appCode, secret string) {
+	s.SetKey(appCode, AppKey{Secret: secret})
+}
+
+// SetKey adds or replaces the key of appCode
+func (s *MemoryKeyStore) SetKey(appCode string, key AppKey) {
+	s.mu.Lock()
+	s.keys[appCode] = key
+	s.mu.Unlock()
+}
+
+// Delete removes appCode
+func (s *MemoryKeyStore) Delete(appCode string) {
+	s.mu.Lock()
+	delete(s.keys, appCode)
+	s.mu.Unlock()
+}
+
+// Key implements KeyStore
+func (s *MemoryKeyStore) Key(appCode string) (*AppKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[appCode]
+	if !ok {
+		return nil, ErrUnknownAppCode
+	}
+	return &key, nil
+}
+
+// FileKeyStore is a KeyStore loaded from a JSON file mapping the app codes to their
+// AppKey, or to their secret alone:
+//
+//	{
+//	  "gateway": {"secret": "...", "accounts": ["*"], "roles": ["gateway"]},
+//	  "device": "..."
+//	}
+type FileKeyStore struct {
+	*MemoryKeyStore
+	path string
+}
+
+// NewFileKeyStore loads the keys stored at path
+func NewFileKeyStore(path string) (*FileKeyStore, error) {
+	s := &FileKeyStore{MemoryKeyStore: NewMemoryKeyStore(nil), path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the file again, keeping the old keys on error
+func (s *FileKeyStore) Reload() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("auth: read key store file error: %v", err)
+	}
+	var keys map[string]AppKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("auth: parse key store file error: %v", err)
+	}
+	if keys == nil {
+		keys = map[string]AppKey{}
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// APIKeyConfig configures the API key verification interceptors.
+// A nonce evicted from a full cache can be replayed within MaxSkew, so NonceCache
+// should exceed the number of requests expected in that window.
+type APIKeyConfig struct {
+	Keys       KeyStore      // keys of the app codes, required
+	MaxSkew    time.Duration // accepted distance between the request timestamp and now, default 5 minutes
+	NonceCache int           // number of nonces remembered for replay protection, default 10000
+}
+
+// signedKeys are the identity metadata keys covered by the signature, their values
+// are verified within the accounts of the AppKey
+var signedKeys = []*string{
+	&multiAccountKey, &UserKey, &ProjectKey,
+	&ActorAccountKey, &ActorUserKey, &ActorServiceKey, &DelegationKey,
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of a request. The signed string
+// is the method, timestamp and nonce followed by the AccountID, UserID, ProjectID,
+// ActorAccountID, ActorUserID, ActorService and Delegation values of md, empty when
+// absent, joined by newlines.
+func Sign(secret []byte, method, timestamp, nonce string, md metadata.MD) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + timestamp + "\n" + nonce))
+	for _, key := range signedKeys {
+		val := ""
+		if vals := md.Get(*key); len(vals) > 0 {
+			val = vals[0]
+		}
+		mac.Write([]byte("\n" + val))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// apiKeyVerifier verifies signed requests against an APIKeyConfig
+type apiKeyVerifier struct {
+	conf   APIKeyConfig
+	nonces *nonceCache
+	now    func() time.Time
+}
+
+func newAPIKeyVerifier(conf APIKeyConfig) (*apiKeyVerifier, error) {
+	if conf.Keys == nil {
+		return nil, errors.New("auth: APIKeyConfig.Keys is required")
+	}
+	if conf.MaxSkew <= 0 {
+		conf.MaxSkew = 5 * time.Minute
+	}
+	if conf.NonceCache <= 0 {
+		conf.NonceCache = 10000
+	}
+	return &apiKeyVerifier{
+		conf:   conf,
+		nonces: newNonceCache(conf.NonceCache),
+		now:    time.Now,
+	}, nil
+}
+
+// verify checks the signature of the request and returns ctx carrying the verified
+// app code and identity
+func (v *apiKeyVerifier) verify(ctx context.Context, method string) (context.Context, error) {
+	md := metautils.ExtractIncoming(ctx)
+	appCode, signature := md.Get(AppCodeKey), md.Get(SignatureKey)
+	timestamp, nonce := md.Get(TimestampKey), md.Get(NonceKey)
+	if appCode == "" || signature == "" || timestamp == "" || nonce == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing api key signature")
+	}
+	// only the first value is signed
+	values := map[string]string{AppCodeKey: appCode}
+	for _, key := range signedKeys {
+		if len(metadata.MD(md).Get(*key)) > 1 {
+			return nil, &MetadataError{Key: *key, Err: ErrAmbiguous}
+		}
+		values[*key] = md.Get(*key)
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid signature timestamp")
+	}
+	now := v.now()
+	if skew := now.Sub(time.Unix(ts, 0)); skew > v.conf.MaxSkew || skew < -v.conf.MaxSkew {
+		return nil, status.Error(codes.Unauthenticated, "signature timestamp out of range")
+	}
+
+	key, err := v.conf.Keys.Key(appCode)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid app code: %v", err)
+	}
+	expected := Sign([]byte(key.Secret), method, timestamp, nonce, metadata.MD(md))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, status.Error(codes.Unauthenticated, "invalid signature")
+	}
+
+	// a nonce only needs to be remembered while its timestamp is acceptable
+	if !v.nonces.add(appCode+"|"+nonce, time.Unix(ts, 0).Add(v.conf.MaxSkew), now) {
+		return nil, status.Error(codes.Unauthenticated, "replayed request")
+	}
+
+	if err := key.grant(appCode, values); err != nil {
+		return nil, err
+	}
+	ctx = withVerified(ctx, values)
+	if values[UserKey] == "" && values[ActorServiceKey] == "" && values[ActorUserKey] == "" {
+		// the app calls for itself
+		return withoutActor(ctx), nil
+	}
+	// the app acts on behalf of the signed user and actors
+	return withCaller(ctx, Actor{Service: appCode})
+}
+
+// nonceCache remembers the recently seen nonces, bounded to size entries
+type nonceCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // of *nonceEntry, oldest first
+	seen  map[string]*list.Element
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+func newNonceCache(size int) *nonceCache {
+	return &nonceCache{size: size, order: list.New(), seen: map[string]*list.Element{}}
+}
+
+// add records nonce until expires, it returns false if nonce was already seen
+func (c *nonceCache) add(nonce string, expires, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// drop the expired entries
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		entry := e.Value.(*nonceEntry)
+		if entry.expires.After(now) {
+			break
+		}
+		c.order.Remove(e)
+		delete(c.seen, entry.nonce)
+	}
+
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	// evict the oldest entries when full
+	for c.order.Len() >= c.size {
+		e := c.order.Front()
+		c.order.Remove(e)
+		delete(c.seen, e.Value.(*nonceEntry).nonce)
+	}
+	c.seen[nonce] = c.order.PushBack(&nonceEntry{nonce: nonce, expires: expires})
+	return true
+}
+
+// APIKeyUnaryServerInterceptor returns a new unary server interceptor that verifies the app code
+// signature of each request, rejecting it with codes.Unauthenticated on failure.
+// GetAppCode then returns the verified app code, the identity getters the signed AccountID,
+// UserID and ProjectID values within the accounts of its AppKey, and the Roles and
+// Scopes of the identity are those granted by the AppKey. The app becomes the actor of
+// the requests made on behalf of a user, after the signed actor and delegation chain.
+// It fails if conf is invalid.
+func APIKeyUnaryServerInterceptor(conf APIKeyConfig) (grpc.UnaryServerInterceptor, error) {
+	v, err := newAPIKeyVerifier(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := v.verify(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}, nil
+}
+
+// APIKeyStreamServerInterceptor returns a new stream server interceptor that verifies the app code
+// signature of each stream, see APIKeyUnaryServerInterceptor.
+func APIKeyStreamServerInterceptor(conf APIKeyConfig) (grpc.StreamServerInterceptor, error) {
+	v, err := newAPIKeyVerifier(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := v.verify(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		wrapped := grpc_middleware.WrapServerStream(ss)
+		wrapped.WrappedContext = ctx
+		return handler(srv, wrapped)
+	}, nil
+}
+
+// signOutgoing adds the app code signature of method and of the identity in the
+// outgoing metadata to the outgoing metadata
+func signOutgoing(ctx context.Context, appCode string, secret []byte, method string) (context.Context, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(b)
+	out, _ := metadata.FromOutgoingContext(ctx)
+	return appendOutgoing(ctx, metadata.Pairs(
+		AppCodeKey, appCode,
+		TimestampKey, timestamp,
+		NonceKey, nonce,
+		SignatureKey, Sign(secret, method, timestamp, nonce, out),
+	)), nil
+}
+
+// APIKeyUnaryClientInterceptor returns a new unary client interceptor that signs outgoing calls
+// with the app code and its secret. Chain it after UnaryClientInterceptor so that the
+// identity metadata is signed.
+func APIKeyUnaryClientInterceptor(appCode, secret string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, err := signOutgoing(ctx, appCode, []byte(secret), method)
+		if err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// APIKeyStreamClientInterceptor returns a new stream client interceptor that signs outgoing streams
+// with the app code and its secret.
+func APIKeyStreamClientInterceptor(appCode, secret string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, err := signOutgoing(ctx, appCode, []byte(secret), method)
+		if err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
@@ -0,0 +1,371 @@
+package auth_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rigoiot/pkg/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testAppCode = "gateway"
+	testMethod  = "/test.Service/Method"
+)
+
+var testAppSecret = []byte("gateway-secret")
+
+// signedMD returns the metadata of a request signed with secret at ts, carrying
+// the identity pairs
+func signedMD(secret []byte, ts time.Time, nonce string, identity ...string) metadata.MD {
+	md := metadata.Pairs(identity...)
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	md.Append("AppCode", testAppCode)
+	md.Append("Timestamp", timestamp)
+	md.Append("Nonce", nonce)
+	md.Append("Signature", auth.Sign(secret, testMethod, timestamp, nonce, md))
+	return md
+}
+
+// apiKeyCaller returns a function running the API key unary interceptor of conf on
+// a request with md, it returns the context seen by the handler
+func apiKeyCaller(t *testing.T, conf auth.APIKeyConfig) func(md metadata.MD) (context.Context, error) {
+	t.Helper()
+	interceptor, err := auth.APIKeyUnaryServerInterceptor(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(md metadata.MD) (context.Context, error) {
+		var got context.Context
+		_, err := interceptor(metadata.NewIncomingContext(context.Background(), md), nil,
+			&grpc.UnaryServerInfo{FullMethod: testMethod},
+			func(ctx context.Context, _ interface{}) (interface{}, error) {
+				got = ctx
+				return nil, nil
+			})
+		return got, err
+	}
+}
+
+// testKeys returns a store with the test app acting for the test account as operator
+func testKeys() *auth.MemoryKeyStore {
+	store := auth.NewMemoryKeyStore(nil)
+	store.SetKey(testAppCode, auth.AppKey{
+		Secret:   string(testAppSecret),
+		Accounts: []string{testAccountID},
+		Roles:    []string{"operator"},
+	})
+	return store
+}
+
+func TestAPIKeyValidSignature(t *testing.T) {
+	call := apiKeyCaller(t, auth.APIKeyConfig{Keys: testKeys()})
+	ctx, err := call(signedMD(testAppSecret, time.Now(), "n1",
+		"AccountID", testAccountID, "UserID", testUserID, "Roles", "admin", "Scopes", "device:write"))
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	id := auth.ParseIdentity(ctx)
+	if !id.Verified || id.AppCode != testAppCode || id.AccountID.String() != testAccountID ||
+		id.UserID.String() != testUserID {
+		t.Errorf("identity = %+v", id)
+	}
+	// the roles and scopes are those of the key, not the sent ones
+	if !id.HasRole("operator") || id.HasRole("admin") || id.HasScope("device:write") {
+		t.Errorf("roles = %v, scopes = %v, want the granted [operator] only", id.Roles, id.Scopes)
+	}
+	if id.HasProject() {
+		t.Errorf("project = %s, want none", id.ProjectID)
+	}
+}
+
+func TestAPIKeyActorChain(t *testing.T) {
+	call := apiKeyCaller(t, auth.APIKeyConfig{Keys: testKeys()})
+
+	// the app acts on behalf of the user after the signed actors
+	ctx, err := call(signedMD(testAppSecret, time.Now(), "n1", "UserID", testUserID, "ActorService", "portal"))
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	id := auth.ParseIdentity(ctx)
+	if chain := id.Chain(); len(chain) != 2 || chain[0].Service != "portal" || chain[1].Service != testAppCode {
+		t.Errorf("chain = %v, want [service:portal service:%s]", chain, testAppCode)
+	}
+	if id.UserID.String() != testUserID {
+		t.Errorf("subject = %s, want %s", id.UserID, testUserID)
+	}
+
+	ctx, err = call(signedMD(testAppSecret, time.Now(), "n2"))
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if id := auth.ParseIdentity(ctx); id.Actor != nil {
+		t.Errorf("actor = %v, want none for the app calling for itself", id.Actor)
+	}
+}
+
+func TestAPIKeyAccounts(t *testing.T) {
+	store := testKeys()
+	call := apiKeyCaller(t, auth.APIKeyConfig{Keys: store})
+
+	// the only account of the key is used when the request has none
+	ctx, err := call(signedMD(testAppSecret, time.Now(), "n1", "UserID", testUserID))
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if id := auth.ParseIdentity(ctx); id.AccountID.String() != testAccountID {
+		t.Errorf("account = %s, want %s", id.AccountID, testAccountID)
+	}
+
+	_, err = call(signedMD(testAppSecret, time.Now(), "n2", "AccountID", testProjectID))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("account outside the key: error = %v, want PermissionDenied", err)
+	}
+
+	store.SetKey(testAppCode, auth.AppKey{Secret: string(testAppSecret), Accounts: []string{"*"}})
+	if _, err := call(signedMD(testAppSecret, time.Now(), "n3", "AccountID", testProjectID)); err != nil {
+		t.Errorf("any account: %v", err)
+	}
+	_, err = call(signedMD(testAppSecret, time.Now(), "n4", "UserID", testUserID))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("user without account: error = %v, want PermissionDenied", err)
+	}
+
+	// a key without accounts acts for the app alone
+	store.Set(testAppCode, string(testAppSecret))
+	ctx, err = call(signedMD(testAppSecret, time.Now(), "n5"))
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if id := auth.ParseIdentity(ctx); !id.Verified || id.HasAccount() || len(id.Roles) != 0 {
+		t.Errorf("identity = %+v, want the app without account or roles", id)
+	}
+	_, err = call(signedMD(testAppSecret, time.Now(), "n6", "AccountID", testAccountID))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("account without grant: error = %v, want PermissionDenied", err)
+	}
+}
+
+func TestAPIKeySelfAssertedRoles(t *testing.T) {
+	store := testKeys()
+	interceptor, err := auth.APIKeyUnaryServerInterceptor(auth.APIKeyConfig{Keys: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, conn := startServer(t,
+		[]grpc.ServerOption{grpc.ChainUnaryInterceptor(
+			interceptor,
+			auth.UnaryServerInterceptor(auth.WithImpersonatorRoles("support")),
+			auth.AuthorizationInterceptor(auth.NewPolicy(true).AllowRoles("/grpc.health.v1.Health/*", "admin")),
+		)},
+		grpc.WithUnaryInterceptor(auth.APIKeyUnaryClientInterceptor(testAppCode, string(testAppSecret))),
+	)
+	client := healthpb.NewHealthClient(conn)
+	check := func(md ...string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(),
+			append([]string{"AccountID", testAccountID, "UserID", testUserID}, md...)...)
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		return err
+	}
+	const otherUserID = "3c2b1a0e-8d7c-46b5-a493-82f5e4d3c2b1"
+
+	if err := check("Roles", "admin"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("self-asserted admin role: error = %v, want PermissionDenied", err)
+	}
+
+	store.SetKey(testAppCode, auth.AppKey{
+		Secret:   string(testAppSecret),
+		Accounts: []string{testAccountID},
+		Roles:    []string{"admin"},
+	})
+	if err := check(); err != nil {
+		t.Fatalf("granted admin role: %v", err)
+	}
+	<-rec.ctx
+	err = check("Roles", "support", "ImpersonateAccountID", testAccountID, "ImpersonateUserID", otherUserID)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("impersonation with a self-asserted support role: error = %v, want PermissionDenied", err)
+	}
+
+	store.SetKey(testAppCode, auth.AppKey{
+		Secret:   string(testAppSecret),
+		Accounts: []string{testAccountID},
+		Roles:    []string{"admin", "support"},
+	})
+	if err := check("ImpersonateAccountID", testAccountID, "ImpersonateUserID", otherUserID); err != nil {
+		t.Fatalf("impersonation with a granted support role: %v", err)
+	}
+	if id, _ := auth.FromContext(<-rec.ctx); id.UserID.String() != otherUserID {
+		t.Errorf("user = %s, want the impersonated %s", id.UserID, otherUserID)
+	}
+}
+
+func TestAPIKeyBadSignature(t *testing.T) {
+	call := apiKeyCaller(t, auth.APIKeyConfig{Keys: testKeys()})
+
+	_, err := call(signedMD([]byte("wrong-secret"), time.Now(), "n1"))
+	assertUnauthenticated(t, err, "wrong secret")
+
+	// identity headers are signed and cannot be changed or added
+	md := signedMD(testAppSecret, time.Now(), "n2", "AccountID", testAccountID)
+	md.Set("AccountID", testProjectID)
+	_, err = call(md)
+	assertUnauthenticated(t, err, "changed AccountID")
+
+	md = signedMD(testAppSecret, time.Now(), "n3")
+	md.Set("UserID", testUserID)
+	_, err = call(md)
+	assertUnauthenticated(t, err, "added UserID")
+
+	md = signedMD(testAppSecret, time.Now(), "n6", "UserID", testUserID)
+	md.Set("ActorService", "portal")
+	_, err = call(md)
+	assertUnauthenticated(t, err, "added ActorService")
+
+	md = signedMD(testAppSecret, time.Now(), "n4")
+	md.Set("AppCode", "other")
+	_, err = call(md)
+	assertUnauthenticated(t, err, "unknown app code")
+
+	md = signedMD(testAppSecret, time.Now(), "n5")
+	delete(md, "signature")
+	_, err = call(md)
+	assertUnauthenticated(t, err, "missing signature")
+}
+
+func TestAPIKeyAmbiguousIdentity(t *testing.T) {
+	call := apiKeyCaller(t, auth.APIKeyConfig{Keys: testKeys()})
+	md := signedMD(testAppSecret, time.Now(), "n1", "UserID", testUserID)
+	md.Append("UserID", testProjectID)
+	if _, err := call(md); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("second UserID value: error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestAPIKeyTimestampSkew(t *testing.T) {
+	call := apiKeyCaller(t, auth.APIKeyConfig{Keys: testKeys(), MaxSkew: time.Minute})
+	now := time.Now()
+	if _, err := call(signedMD(testAppSecret, now.Add(-30*time.Second), "n1")); err != nil {
+		t.Errorf("30s old: %v", err)
+	}
+	_, err := call(signedMD(testAppSecret, now.Add(-2*time.Minute), "n2"))
+	assertUnauthenticated(t, err, "2m old")
+	_, err = call(signedMD(testAppSecret, now.Add(2*time.Minute), "n3"))
+	assertUnauthenticated(t, err, "2m ahead")
+
+	md := signedMD(testAppSecret, now, "n4")
+	md.Set("Timestamp", "yesterday")
+	_, err = call(md)
+	assertUnauthenticated(t, err, "malformed timestamp")
+}
+
+func TestAPIKeyNonceReplay(t *testing.T) {
+	call := apiKeyCaller(t, auth.APIKeyConfig{Keys: testKeys()})
+	md := signedMD(testAppSecret, time.Now(), "n1")
+	if _, err := call(md); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	_, err := call(md)
+	assertUnauthenticated(t, err, "replay")
+}
+
+func TestAPIKeyNonceCacheEviction(t *testing.T) {
+	call := apiKeyCaller(t, auth.APIKeyConfig{Keys: testKeys(), NonceCache: 2})
+	now := time.Now()
+	first := signedMD(testAppSecret, now, "n1")
+	for _, md := range []metadata.MD{first, signedMD(testAppSecret, now, "n2")} {
+		if _, err := call(md); err != nil {
+			t.Fatalf("request: %v", err)
+		}
+	}
+	_, err := call(first)
+	assertUnauthenticated(t, err, "replay in a full cache")
+
+	// a third nonce evicts the oldest one, which can then be replayed
+	if _, err := call(signedMD(testAppSecret, now, "n3")); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if _, err := call(first); err != nil {
+		t.Errorf("replay of an evicted nonce: %v, want accepted as documented", err)
+	}
+}
+
+func TestFileKeyStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"gateway": "s1"}`)
+	store, err := auth.NewFileKeyStore(path)
+	if err != nil {
+		t.Fatalf("NewFileKeyStore: %v", err)
+	}
+
+	write(`{"gateway": "s2", "device": {"secret": "s3", "accounts": ["*"], "roles": ["device"]}}`)
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if key, _ := store.Key("device"); key == nil || key.Secret != "s3" || len(key.Accounts) != 1 || len(key.Roles) != 1 {
+		t.Errorf("device key = %+v", key)
+	}
+
+	write(`{"gateway": `)
+	if err := store.Reload(); err == nil {
+		t.Error("Reload of a broken file: want an error")
+	}
+	os.Remove(path)
+	if err := store.Reload(); err == nil {
+		t.Error("Reload of a missing file: want an error")
+	}
+	if key, _ := store.Key("gateway"); key == nil || key.Secret != "s2" {
+		t.Errorf("gateway key after failed reloads = %+v, want secret s2", key)
+	}
+	if _, err := store.Key("unknown"); err != auth.ErrUnknownAppCode {
+		t.Errorf("unknown app code: %v, want ErrUnknownAppCode", err)
+	}
+}
+
+func TestAPIKeyConfigRequiresKeys(t *testing.T) {
+	if _, err := auth.APIKeyUnaryServerInterceptor(auth.APIKeyConfig{}); err == nil {
+		t.Error("APIKeyUnaryServerInterceptor without keys: want an error")
+	}
+	if _, err := auth.APIKeyStreamServerInterceptor(auth.APIKeyConfig{}); err == nil {
+		t.Error("APIKeyStreamServerInterceptor without keys: want an error")
+	}
+}
+
+func TestAPIKeyClientInterceptorRoundTrip(t *testing.T) {
+	interceptor, err := auth.APIKeyUnaryServerInterceptor(auth.APIKeyConfig{Keys: testKeys()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, conn := startServer(t,
+		[]grpc.ServerOption{grpc.ChainUnaryInterceptor(
+			interceptor,
+			auth.UnaryServerInterceptor(),
+		)},
+		grpc.WithChainUnaryInterceptor(
+			auth.UnaryClientInterceptor(),
+			auth.APIKeyUnaryClientInterceptor(testAppCode, string(testAppSecret)),
+		),
+	)
+	ctx := auth.WithIdentity(context.Background(), testIdentity())
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	id, _ := auth.FromContext(<-rec.ctx)
+	if !id.Verified || id.AccountID.String() != testAccountID || id.UserID.String() != testUserID {
+		t.Errorf("identity = %+v", id)
+	}
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrMissing is matched by errors.Is when a metadata value is absent
+	ErrMissing = errors.New("missing")
+
+	// ErrMalformed is matched by errors.Is when a metadata value cannot be parsed
+	ErrMalformed = errors.New("malformed")
+
+	// ErrAmbiguous is matched by errors.Is when a metadata key has several values
+	// in strict mode, see WithStrictMetadata
+	ErrAmbiguous = errors.New("ambiguous")
+)
+
+// WithStrictMetadata rejects the requests sending several values for an identity
+// key with ErrAmbiguous, by default the first value is used
+func WithStrictMetadata() ServerOption {
+	return func(o *serverOptions) {
+		o.strict = true
+	}
+}
+
+// MetadataError is returned by the Get* functions, it wraps one of ErrMissing,
+// ErrMalformed or ErrAmbiguous and converts to a gRPC status: codes.Unauthenticated
+// when missing, codes.InvalidArgument otherwise
+type MetadataError struct {
+	Key string
+	Err error
+}
+
+func (e *MetadataError) Error() string {
+	return fmt.Sprintf("auth: %s %s metadata", e.Err, e.Key)
+}
+
+// Unwrap returns the sentinel error
+func (e *MetadataError) Unwrap() error { return e.Err }
+
+// GRPCStatus returns the status sent to the client
+func (e *MetadataError) GRPCStatus() *status.Status {
+	code := codes.InvalidArgument
+	if e.Err == ErrMissing {
+		code = codes.Unauthenticated
+	}
+	return status.New(code, e.Error())
+}
+
+// lookupValue returns the single value of key for the current request,
+// verified values win over incoming metadata as in incomingValue.
+// Several values are ErrAmbiguous in strict mode.
+func lookupValue(ctx context.Context, key string, strict bool) (string, error) {
+	if verified, ok := ctx.Value(verifiedKey{}).(map[string]string); ok {
+		if val, ok := verified[key]; ok {
+			if val == "" {
+				return "", &MetadataError{Key: key, Err: ErrMissing}
+			}
+			return val, nil
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	vals := md.Get(key)
+	if len(vals) == 0 || vals[0] == "" {
+		return "", &MetadataError{Key: key, Err: ErrMissing}
+	}
+	if len(vals) > 1 && strict {
+		return "", &MetadataError{Key: key, Err: ErrAmbiguous}
+	}
+	return vals[0], nil
+}
+
+// uuidValue returns the value of key parsed as a UUID
+func uuidValue(ctx context.Context, key string, strict bool) (uuid.UUID, error) {
+	val, err := lookupValue(ctx, key, strict)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	id, err := uuid.FromString(val)
+	if err != nil {
+		return uuid.Nil, &MetadataError{Key: key, Err: ErrMalformed}
+	}
+	return id, nil
+}
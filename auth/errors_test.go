@@ -0,0 +1,156 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rigoiot/pkg/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func incoming(md ...string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(md...))
+}
+
+// callIdentity runs the unary server interceptor built with opts on a request
+// carrying the metadata pairs md, it returns the context seen by the handler
+func callIdentity(opts []auth.ServerOption, md ...string) (context.Context, error) {
+	var got context.Context
+	_, err := auth.UnaryServerInterceptor(opts...)(incoming(md...), nil, &grpc.UnaryServerInfo{},
+		func(ctx context.Context, _ interface{}) (interface{}, error) {
+			got = ctx
+			return nil, nil
+		})
+	return got, err
+}
+
+func TestMetadataErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		sentinel error
+		code     codes.Code
+	}{
+		{"missing", context.Background(), auth.ErrMissing, codes.Unauthenticated},
+		{"empty", incoming("AccountID", ""), auth.ErrMissing, codes.Unauthenticated},
+		{"malformed", incoming("AccountID", "not-a-uuid"), auth.ErrMalformed, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		_, err := auth.GetAccountID(tt.ctx, nil)
+		if !errors.Is(err, tt.sentinel) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.sentinel)
+		}
+		var mdErr *auth.MetadataError
+		if !errors.As(err, &mdErr) || mdErr.Key != "AccountID" {
+			t.Errorf("%s: error = %#v, want a MetadataError of AccountID", tt.name, err)
+		}
+		if got := status.Code(err); got != tt.code {
+			t.Errorf("%s: status code = %s, want %s", tt.name, got, tt.code)
+		}
+	}
+
+	err := &auth.MetadataError{Key: "UserID", Err: auth.ErrAmbiguous}
+	if !errors.Is(err, auth.ErrAmbiguous) || errors.Is(err, auth.ErrMalformed) {
+		t.Errorf("errors.Is through %v", err)
+	}
+	if st := err.GRPCStatus(); st.Code() != codes.InvalidArgument || st.Message() != "auth: ambiguous UserID metadata" {
+		t.Errorf("GRPCStatus = %s %q", st.Code(), st.Message())
+	}
+}
+
+func TestGettersUseFirstValue(t *testing.T) {
+	ctx := incoming("UserID", testUserID, "UserID", testAccountID)
+	if id, err := auth.GetUserID(ctx, nil); err != nil || id.String() != testUserID {
+		t.Errorf("GetUserID = %s, %v, want the first value", id, err)
+	}
+}
+
+func TestVerifiedEmptyValueIsMissing(t *testing.T) {
+	// a token without project claim hides the ProjectID header
+	token := signToken(t, jwt.SigningMethodHS256, testSecret, "", jwt.MapClaims{"sub": testUserID})
+	ctx, err := callJWT(t, hsConfig(), token, "ProjectID", testProjectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.GetProjectID(ctx, nil); !errors.Is(err, auth.ErrMissing) {
+		t.Errorf("GetProjectID = %v, want ErrMissing", err)
+	}
+}
+
+func TestInterceptorRejectsInvalidMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		md       []string
+		sentinel error
+	}{
+		{"malformed account", []string{"AccountID", "42"}, auth.ErrMalformed},
+		{"malformed project", []string{"ProjectID", "x"}, auth.ErrMalformed},
+		{"malformed actor", []string{"ActorUserID", "x", "ActorAccountID", testAccountID}, auth.ErrMalformed},
+		{"malformed delegation", []string{"ActorService", "device", "Delegation", "service:gateway,robot"}, auth.ErrMalformed},
+	}
+	for _, tt := range tests {
+		_, err := callIdentity(nil, tt.md...)
+		if !errors.Is(err, tt.sentinel) || status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.sentinel)
+		}
+	}
+
+	// absent values are left to Identity.Require
+	ctx, err := callIdentity(nil)
+	if err != nil {
+		t.Fatalf("no metadata: %v", err)
+	}
+	if id, _ := auth.FromContext(ctx); id.Require(auth.FieldUserID) == nil {
+		t.Error("Require(UserID) succeeded without metadata")
+	}
+}
+
+func TestStrictMetadata(t *testing.T) {
+	strict := []auth.ServerOption{auth.WithStrictMetadata()}
+	for _, md := range [][]string{
+		{"UserID", testUserID, "UserID", testAccountID},
+		{"AppCode", "gateway", "AppCode", "device"},
+		{"ActorService", "gateway", "ActorService", "device"},
+	} {
+		ctx, err := callIdentity(nil, md...)
+		if err != nil {
+			t.Errorf("%s twice without strict mode: %v", md[0], err)
+		} else if id, _ := auth.FromContext(ctx); id.AppCode == "device" || id.UserID.String() == testAccountID {
+			t.Errorf("%s twice without strict mode: identity %+v, want the first values", md[0], id)
+		}
+		_, err = callIdentity(strict, md...)
+		if !errors.Is(err, auth.ErrAmbiguous) || status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s twice in strict mode: error = %v, want ErrAmbiguous", md[0], err)
+		}
+	}
+
+	_, err := callIdentity(strict, "ImpersonateUserID", testUserID, "ImpersonateUserID", testAccountID)
+	if !errors.Is(err, auth.ErrAmbiguous) {
+		t.Errorf("ImpersonateUserID twice in strict mode: error = %v, want ErrAmbiguous", err)
+	}
+}
+
+func TestInterceptorRejectionOverTheWire(t *testing.T) {
+	_, conn := startServer(t, []grpc.ServerOption{
+		grpc.UnaryInterceptor(auth.UnaryServerInterceptor(auth.WithStrictMetadata())),
+	})
+	client := healthpb.NewHealthClient(conn)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "AccountID", "not-a-uuid")
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("malformed AccountID: %v, want InvalidArgument", err)
+	}
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "UserID", testUserID, "UserID", testAccountID)
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ambiguous UserID: %v, want InvalidArgument", err)
+	}
+	if _, err := client.Check(identityContext(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Errorf("valid identity: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// RolesKey is the metadata key carrying the comma separated roles of the caller,
+	// only read from the values verified by an authenticator
+	RolesKey = "Roles"
+
+	// ScopesKey is the metadata key carrying the comma separated scopes of the caller,
+	// only read from the values verified by an authenticator
+	ScopesKey = "Scopes"
+)
+
+// Field names a part of the identity for Identity.Require
+type Field string
+
+// Identity fields
+const (
+	FieldAccountID Field = "AccountID"
+	FieldUserID    Field = "UserID"
+	FieldProjectID Field = "ProjectID"
+	FieldAppCode   Field = "AppCode"
+	FieldLocale    Field = "Locale"
+	FieldRoles     Field = "Roles"
+	FieldScopes    Field = "Scopes"
+)
+
+// Identity is the caller identity of a request, zero fields are absent
+type Identity struct {
+	AccountID uuid.UUID
+	UserID    uuid.UUID
+	ProjectID uuid.UUID
+	AppCode   string
+	Locale    string
+	Roles     []string // verified roles only
+	Scopes    []string // verified scopes only
+
+	// Verified is set when an authenticator such as JWTUnaryServerInterceptor
+	// proved the identity, the other fields are taken from raw metadata otherwise
+	Verified bool
+
+	// Actor really makes the call when it is not the subject above,
+	// after the actors of Delegation, see Chain
+	Actor      *Actor
+	Delegation []Actor
+}
+
+// identityKey is the context key of the Identity
+type identityKey struct{}
+
+// NewContext returns a new context carrying id
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the Identity stored in ctx by the server interceptors
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok && id != nil
+}
+
+// ParseIdentity reads the identity of the incoming request in ctx,
+// it is called once per request by the server interceptors.
+// Malformed or ambiguous values and an impersonation request that is not allowed
+// are ignored, the interceptors reject them.
+func ParseIdentity(ctx context.Context) *Identity {
+	id, _ := parseIdentity(ctx, &serverOptions{})
+	return id
+}
+
+// parseIdentity reads the identity of the incoming request in ctx and applies
+// the requested impersonation, returning the caller's own identity and an error
+// if a value is invalid or the impersonation is not allowed
+func parseIdentity(ctx context.Context, o *serverOptions) (*Identity, error) {
+	id := &Identity{}
+	errs := make([]error, 6)
+	id.AccountID, errs[0] = uuidValue(ctx, multiAccountKey, o.strict)
+	id.UserID, errs[1] = uuidValue(ctx, UserKey, o.strict)
+	id.ProjectID, errs[2] = uuidValue(ctx, ProjectKey, o.strict)
+	id.AppCode, errs[3] = lookupValue(ctx, AppCodeKey, o.strict)
+	id.Locale, errs[4] = lookupValue(ctx, LocaleKey, o.strict)
+	id.Verified = authenticated(ctx)
+	// roles and scopes grant permissions, they are never taken from raw metadata
+	if roles, ok := verifiedValue(ctx, RolesKey); ok {
+		id.Roles = splitList(roles)
+	}
+	if scopes, ok := verifiedValue(ctx, ScopesKey); ok {
+		id.Scopes = splitList(scopes)
+	}
+	errs[5] = parseActorChain(ctx, id, o.strict)
+	if err := firstInvalid(errs); err != nil {
+		return id, err
+	}
+	return impersonate(ctx, id, o)
+}
+
+// firstInvalid returns the first error other than ErrMissing, absent values
+// are reported later by Require
+func firstInvalid(errs []error) error {
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, ErrMissing) {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasAccount reports whether the account is known
+func (id *Identity) HasAccount() bool { return id.AccountID != uuid.Nil }
+
+// HasUser reports whether the user is known
+func (id *Identity) HasUser() bool { return id.UserID != uuid.Nil }
+
+// HasProject reports whether the project is known
+func (id *Identity) HasProject() bool { return id.ProjectID != uuid.Nil }
+
+// HasRole reports whether the caller holds role
+func (id *Identity) HasRole(role string) bool { return contains(id.Roles, role) }
+
+// HasScope reports whether the caller was granted scope
+func (id *Identity) HasScope(scope string) bool { return contains(id.Scopes, scope) }
+
+// Has reports whether field is present, it is false for a nil identity
+func (id *Identity) Has(field Field) bool {
+	if id == nil {
+		return false
+	}
+	switch field {
+	case FieldAccountID:
+		return id.HasAccount()
+	case FieldUserID:
+		return id.HasUser()
+	case FieldProjectID:
+		return id.HasProject()
+	case FieldAppCode:
+		return id.AppCode != ""
+	case FieldLocale:
+		return id.Locale != ""
+	case FieldRoles:
+		return len(id.Roles) > 0
+	case FieldScopes:
+		return len(id.Scopes) > 0
+	}
+	return false
+}
+
+// Require returns a codes.Unauthenticated status listing the missing fields, nil if all are present.
+// A nil identity misses all of them.
+func (id *Identity) Require(fields ...Field) error {
+	var missing []string
+	for _, f := range fields {
+		if !id.Has(f) {
+			missing = append(missing, string(f))
+		}
+	}
+	if len(missing) > 0 {
+		return status.Errorf(codes.Unauthenticated, "missing identity: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Metadata returns the identity encoded with the auth metadata keys
+func (id *Identity) Metadata() metadata.MD {
+	md := metadata.MD{}
+	if id.HasAccount() {
+		md.Append(multiAccountKey, id.AccountID.String())
+	}
+	if id.HasUser() {
+		md.Append(UserKey, id.UserID.String())
+	}
+	if id.AppCode != "" {
+		md.Append(AppCodeKey, id.AppCode)
+	}
+	if id.Locale != "" {
+		md.Append(LocaleKey, id.Locale)
+	}
+	if id.HasProject() {
+		md.Append(ProjectKey, id.ProjectID.String())
+	}
+	if len(id.Roles) > 0 {
+		md.Append(RolesKey, strings.Join(id.Roles, ","))
+	}
+	if len(id.Scopes) > 0 {
+		md.Append(ScopesKey, strings.Join(id.Scopes, ","))
+	}
+	if id.Actor != nil {
+		if id.Actor.Service != "" {
+			md.Append(ActorServiceKey, id.Actor.Service)
+		} else {
+			md.Append(ActorAccountKey, id.Actor.AccountID.String())
+			md.Append(ActorUserKey, id.Actor.UserID.String())
+		}
+	}
+	if len(id.Delegation) > 0 {
+		delegation := make([]string, 0, len(id.Delegation))
+		for _, a := range id.Delegation {
+			delegation = append(delegation, a.String())
+		}
+		md.Append(DelegationKey, strings.Join(delegation, ","))
+	}
+	return md
+}
+
+// splitList splits a comma or space separated list, dropping empty items
+func splitList(val string) []string {
+	return strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
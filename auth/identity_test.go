@@ -0,0 +1,101 @@
+package auth_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rigoiot/pkg/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestFromContext(t *testing.T) {
+	if id, ok := auth.FromContext(context.Background()); ok || id != nil {
+		t.Errorf("FromContext of an empty context = %v, %v", id, ok)
+	}
+	if _, ok := auth.FromContext(auth.NewContext(context.Background(), nil)); ok {
+		t.Error("FromContext found a nil identity")
+	}
+	want := testIdentity()
+	if id, ok := auth.FromContext(auth.NewContext(context.Background(), want)); !ok || id != want {
+		t.Errorf("FromContext = %v, %v, want %v", id, ok, want)
+	}
+}
+
+func TestIdentityHas(t *testing.T) {
+	id := testIdentity()
+	for _, field := range []auth.Field{auth.FieldAccountID, auth.FieldUserID, auth.FieldProjectID, auth.FieldAppCode, auth.FieldLocale} {
+		if !id.Has(field) {
+			t.Errorf("Has(%s) = false", field)
+		}
+	}
+	for _, field := range []auth.Field{auth.FieldRoles, auth.FieldScopes, auth.Field("Unknown")} {
+		if id.Has(field) {
+			t.Errorf("Has(%s) = true", field)
+		}
+	}
+	id.Roles, id.Scopes = []string{"admin"}, []string{"devices:read"}
+	if !id.Has(auth.FieldRoles) || !id.Has(auth.FieldScopes) {
+		t.Error("Has(Roles) or Has(Scopes) = false")
+	}
+}
+
+func TestIdentityRequire(t *testing.T) {
+	id := testIdentity()
+	if err := id.Require(auth.FieldAccountID, auth.FieldUserID, auth.FieldProjectID); err != nil {
+		t.Errorf("Require = %v, want nil", err)
+	}
+
+	id.ProjectID, id.AppCode = [16]byte{}, ""
+	err := id.Require(auth.FieldAccountID, auth.FieldProjectID, auth.FieldAppCode)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Require = %v, want Unauthenticated", err)
+	}
+	if msg := status.Convert(err).Message(); !strings.Contains(msg, "ProjectID, AppCode") || strings.Contains(msg, "AccountID") {
+		t.Errorf("Require message = %q, want the missing ProjectID and AppCode", msg)
+	}
+}
+
+func TestNilIdentity(t *testing.T) {
+	// no interceptor installed
+	id, _ := auth.FromContext(context.Background())
+	if id.Has(auth.FieldAccountID) {
+		t.Error("nil identity has AccountID")
+	}
+	if err := id.Require(auth.FieldAccountID); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Require on nil identity = %v, want Unauthenticated", err)
+	}
+	if err := id.Require(); err != nil {
+		t.Errorf("Require() on nil identity = %v, want nil", err)
+	}
+}
+
+func TestParseIdentityIgnoresUnverifiedRoles(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"AccountID", testAccountID,
+		"UserID", testUserID,
+		"Roles", "admin",
+		"Scopes", "devices:write",
+	))
+	id := auth.ParseIdentity(ctx)
+	if id.AccountID.String() != testAccountID || id.UserID.String() != testUserID {
+		t.Errorf("identity = %+v", id)
+	}
+	if len(id.Roles) != 0 || len(id.Scopes) != 0 || id.Verified {
+		t.Errorf("roles = %v, scopes = %v, verified = %v from raw metadata", id.Roles, id.Scopes, id.Verified)
+	}
+	if md := id.Metadata(); len(md.Get("roles")) != 0 || len(md.Get("scopes")) != 0 {
+		t.Errorf("Metadata forwards unverified roles: %v", md)
+	}
+}
+
+func TestIdentityMetadataRoundTrip(t *testing.T) {
+	want := testIdentity()
+	id := auth.ParseIdentity(metadata.NewIncomingContext(context.Background(), want.Metadata()))
+	if id.AccountID != want.AccountID || id.UserID != want.UserID || id.ProjectID != want.ProjectID ||
+		id.AppCode != want.AppCode || id.Locale != want.Locale {
+		t.Errorf("round trip = %+v, want %+v", id, want)
+	}
+}
@@ -2,38 +2,112 @@ package auth
 
 import (
 	"context"
+	"strings"
 
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	"google.golang.org/grpc/metadata"
 
 	"google.golang.org/grpc"
 )
 
+// ServerOption configures UnaryServerInterceptor and StreamServerInterceptor
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	impersonatorRoles []string
+	strict            bool
+}
+
+func newServerOptions(opts []ServerOption) *serverOptions {
+	o := &serverOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
 // UnaryServerInterceptor returns a new unary server interceptor that inject grpc client.
-func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+// The identity is parsed once, stored in the context (see FromContext) and put in outgoing metadata.
+// Requests with malformed or ambiguous identity metadata (see MetadataError), or
+// impersonating another user without one of the roles of WithImpersonatorRoles, are rejected.
+func UnaryServerInterceptor(opts ...ServerOption) grpc.UnaryServerInterceptor {
+	o := newServerOptions(opts)
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		// put account id in metadata
-		md := metadata.MD{}
-		accountID, err := GetAccountID(ctx, nil)
-		if err == nil {
-			md.Append(multiAccountKey, accountID.String())
+		id, err := parseIdentity(ctx, o)
+		if err != nil {
+			return nil, err
 		}
-		userID, err := GetUserID(ctx, nil)
-		if err == nil {
-			md.Append(UserKey, userID.String())
+		return handler(WithIdentity(ctx, id), req)
+	}
+}
+
+// StreamServerInterceptor returns a new stream server interceptor that propagates the identity
+// like UnaryServerInterceptor, the wrapped stream's Context() carries the outgoing metadata.
+func StreamServerInterceptor(opts ...ServerOption) grpc.StreamServerInterceptor {
+	o := newServerOptions(opts)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		id, err := parseIdentity(ss.Context(), o)
+		if err != nil {
+			return err
 		}
-		appCode, err := GetAppCode(ctx, nil)
-		if err == nil {
-			md.Append(AppCodeKey, appCode)
+
+		wrapped := grpc_middleware.WrapServerStream(ss)
+		wrapped.WrappedContext = WithIdentity(ss.Context(), id)
+		return handler(srv, wrapped)
+	}
+}
+
+// UnaryClientInterceptor returns a new unary client interceptor that attaches the identity
+// of the context (see WithIdentity) to outgoing calls.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if id, ok := FromContext(ctx); ok {
+			ctx = outgoingIdentity(ctx, id)
 		}
-		locale, err := GetLocale(ctx, nil)
-		if err == nil {
-			md.Append(LocaleKey, locale)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor returns a new stream client interceptor that attaches the identity
+// of the context (see WithIdentity) to outgoing streams.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if id, ok := FromContext(ctx); ok {
+			ctx = outgoingIdentity(ctx, id)
 		}
-		projectID, err := GetProjectID(ctx, nil)
-		if err == nil {
-			md.Append(ProjectKey, projectID.String())
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+// WithIdentity returns a new context carrying id, both as the Identity of FromContext
+// and as outgoing metadata for calls made with it.
+// Identity keys of the outgoing metadata are replaced, other keys are kept.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return NewContext(outgoingIdentity(ctx, id), id)
+}
+
+// outgoingIdentity puts id in the outgoing metadata of ctx, dropping the actor keys
+// of a previous identity so that actors are never mixed
+func outgoingIdentity(ctx context.Context, id *Identity) context.Context {
+	if out, ok := metadata.FromOutgoingContext(ctx); ok {
+		out = out.Copy()
+		for _, key := range actorKeys {
+			delete(out, strings.ToLower(*key))
 		}
-		ctx = metadata.NewOutgoingContext(ctx, md)
-		return handler(ctx, req)
+		ctx = metadata.NewOutgoingContext(ctx, out)
+	}
+	return appendOutgoing(ctx, id.Metadata())
+}
+
+// appendOutgoing merges md into the outgoing metadata of ctx, values of md win
+func appendOutgoing(ctx context.Context, md metadata.MD) context.Context {
+	out, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		return metadata.NewOutgoingContext(ctx, md)
+	}
+	out = out.Copy()
+	for k, v := range md {
+		out[k] = v
 	}
+	return metadata.NewOutgoingContext(ctx, out)
 }
@@ -0,0 +1,391 @@
+package auth_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rigoiot/pkg/auth"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	testAccountID = "5f3c9b6e-2a41-4c1f-9d55-8a7f0e2b1c34"
+	testUserID    = "0e8d7c6b-5a49-4382-9170-6f5e4d3c2b1a"
+	testProjectID = "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"
+)
+
+// recordingHealthServer records the context seen by its handlers
+type recordingHealthServer struct {
+	ctx chan context.Context
+}
+
+func (s *recordingHealthServer) Check(ctx context.Context, _ *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	s.ctx <- ctx
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func (s *recordingHealthServer) Watch(_ *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	s.ctx <- stream.Context()
+	return stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+}
+
+// startServer serves a recordingHealthServer over bufconn and returns a client connection to it
+func startServer(t *testing.T, opts []grpc.ServerOption, dialOpts ...grpc.DialOption) (*recordingHealthServer, *grpc.ClientConn) {
+	t.Helper()
+	rec := &recordingHealthServer{ctx: make(chan context.Context, 1)}
+	return rec, startHealthServer(t, rec, opts, dialOpts...)
+}
+
+// startHealthServer serves impl over bufconn and returns a client connection to it
+func startHealthServer(t *testing.T, impl healthpb.HealthServer, opts []grpc.ServerOption, dialOpts ...grpc.DialOption) *grpc.ClientConn {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(srv, impl)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	dialOpts = append(dialOpts,
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+	)
+	conn, err := grpc.Dial("bufnet", dialOpts...)
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// forwardingHealthServer forwards the checks to next on behalf of their identity,
+// as service when set
+type forwardingHealthServer struct {
+	healthpb.UnimplementedHealthServer
+	next    healthpb.HealthClient
+	service string
+}
+
+func (s *forwardingHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if s.service != "" {
+		ctx = auth.WithServiceActor(ctx, s.service)
+	}
+	return s.next.Check(ctx, req)
+}
+
+// bearerInterceptor returns a client interceptor sending token
+func bearerInterceptor(token string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token), method, req, reply, cc, opts...)
+	}
+}
+
+func identityContext() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(),
+		"AccountID", testAccountID,
+		"UserID", testUserID,
+		"ProjectID", testProjectID,
+		"AppCode", "gateway",
+		"Locale", "zh-CN",
+	)
+}
+
+func assertPropagated(t *testing.T, ctx context.Context) {
+	t.Helper()
+
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		t.Fatal("no outgoing metadata in handler context")
+	}
+	want := map[string]string{
+		"accountid": testAccountID,
+		"userid":    testUserID,
+		"projectid": testProjectID,
+		"appcode":   "gateway",
+		"locale":    "zh-CN",
+	}
+	for k, v := range want {
+		if got := md.Get(k); len(got) != 1 || got[0] != v {
+			t.Errorf("outgoing %s = %v, want %q", k, got, v)
+		}
+	}
+
+	id, ok := auth.FromContext(ctx)
+	if !ok {
+		t.Fatal("no identity in handler context")
+	}
+	if id.AccountID.String() != testAccountID || id.UserID.String() != testUserID || id.ProjectID.String() != testProjectID {
+		t.Errorf("identity = %+v", id)
+	}
+}
+
+func TestUnaryServerInterceptorPropagatesIdentity(t *testing.T) {
+	rec, conn := startServer(t, []grpc.ServerOption{grpc.UnaryInterceptor(auth.UnaryServerInterceptor())})
+
+	_, err := healthpb.NewHealthClient(conn).Check(identityContext(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	assertPropagated(t, <-rec.ctx)
+}
+
+func TestStreamServerInterceptorPropagatesIdentity(t *testing.T) {
+	rec, conn := startServer(t, []grpc.ServerOption{grpc.StreamInterceptor(auth.StreamServerInterceptor())})
+
+	stream, err := healthpb.NewHealthClient(conn).Watch(identityContext(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	assertPropagated(t, <-rec.ctx)
+}
+
+func TestStreamServerInterceptorWithoutIdentity(t *testing.T) {
+	rec, conn := startServer(t, []grpc.ServerOption{grpc.StreamInterceptor(auth.StreamServerInterceptor())})
+
+	stream, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	ctx := <-rec.ctx
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if len(md) != 0 {
+		t.Errorf("outgoing metadata = %v, want empty", md)
+	}
+	id, _ := auth.FromContext(ctx)
+	if err := id.Require(auth.FieldAccountID); err == nil {
+		t.Error("Require(AccountID) succeeded without identity")
+	}
+}
+
+func testIdentity() *auth.Identity {
+	return &auth.Identity{
+		AccountID: uuid.FromStringOrNil(testAccountID),
+		UserID:    uuid.FromStringOrNil(testUserID),
+		ProjectID: uuid.FromStringOrNil(testProjectID),
+		AppCode:   "gateway",
+		Locale:    "zh-CN",
+	}
+}
+
+func TestUnaryClientInterceptorRoundTrip(t *testing.T) {
+	rec, conn := startServer(t,
+		[]grpc.ServerOption{grpc.UnaryInterceptor(auth.UnaryServerInterceptor())},
+		grpc.WithUnaryInterceptor(auth.UnaryClientInterceptor()),
+	)
+
+	// a plain NewOutgoingContext after WithIdentity drops the identity metadata,
+	// the client interceptor must restore it without losing the new keys
+	ctx := auth.WithIdentity(context.Background(), testIdentity())
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs("x-request-id", "42"))
+
+	_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	got := <-rec.ctx
+	assertPropagated(t, got)
+	if md, _ := metadata.FromIncomingContext(got); len(md.Get("x-request-id")) != 1 {
+		t.Errorf("x-request-id lost, incoming metadata = %v", md)
+	}
+}
+
+func TestStreamClientInterceptorRoundTrip(t *testing.T) {
+	rec, conn := startServer(t,
+		[]grpc.ServerOption{grpc.StreamInterceptor(auth.StreamServerInterceptor())},
+		grpc.WithStreamInterceptor(auth.StreamClientInterceptor()),
+	)
+
+	ctx := auth.WithIdentity(context.Background(), testIdentity())
+	stream, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	assertPropagated(t, <-rec.ctx)
+}
+
+func TestUnaryServerInterceptorKeepsOutgoingMetadata(t *testing.T) {
+	setTrace := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(metadata.AppendToOutgoingContext(ctx, "x-trace-id", "abc"), req)
+	}
+	rec, conn := startServer(t, []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(setTrace, auth.UnaryServerInterceptor()),
+	})
+
+	_, err := healthpb.NewHealthClient(conn).Check(identityContext(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	got := <-rec.ctx
+	assertPropagated(t, got)
+	if md, _ := metadata.FromOutgoingContext(got); len(md.Get("x-trace-id")) != 1 {
+		t.Errorf("x-trace-id lost, outgoing metadata = %v", md)
+	}
+}
+
+func TestWithIdentityReplacesIdentityKeys(t *testing.T) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "UserID", testAccountID, "x-request-id", "42")
+	ctx = auth.WithIdentity(ctx, testIdentity())
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if got := md.Get("userid"); len(got) != 1 || got[0] != testUserID {
+		t.Errorf("userid = %v, want [%s]", got, testUserID)
+	}
+	if got := md.Get("x-request-id"); len(got) != 1 {
+		t.Errorf("x-request-id = %v, want [42]", got)
+	}
+}
+
+func TestUnaryServerInterceptorImpersonation(t *testing.T) {
+	jwtInterceptor, err := auth.JWTUnaryServerInterceptor(hsConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, conn := startServer(t, []grpc.ServerOption{grpc.ChainUnaryInterceptor(
+		jwtInterceptor,
+		auth.UnaryServerInterceptor(auth.WithImpersonatorRoles("support")),
+	)})
+	client := healthpb.NewHealthClient(conn)
+	const supportUserID = "3c2b1a0e-8d7c-46b5-a493-82f5e4d3c2b1"
+
+	bearer := func(roles ...interface{}) context.Context {
+		token := signToken(t, jwt.SigningMethodHS256, testSecret, "", jwt.MapClaims{
+			"account_id": testProjectID,
+			"sub":        supportUserID,
+			"roles":      roles,
+		})
+		return metadata.AppendToOutgoingContext(context.Background(),
+			"authorization", "Bearer "+token,
+			"ImpersonateAccountID", testAccountID,
+			"ImpersonateUserID", testUserID,
+		)
+	}
+	_, err = client.Check(bearer("operator"), &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("impersonation without role: error = %v, want PermissionDenied", err)
+	}
+	// a raw Roles header is not a verified role
+	_, err = client.Check(metadata.AppendToOutgoingContext(bearer("operator"), "Roles", "support"), &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("impersonation with a raw Roles header: error = %v, want PermissionDenied", err)
+	}
+
+	_, err = client.Check(bearer("support"), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	got := <-rec.ctx
+	id, _ := auth.FromContext(got)
+	if id.UserID.String() != testUserID || id.AccountID.String() != testAccountID {
+		t.Errorf("subject = %s@%s, want %s@%s", id.UserID, id.AccountID, testUserID, testAccountID)
+	}
+	if chain := id.Chain(); len(chain) != 1 || chain[0].UserID.String() != supportUserID {
+		t.Errorf("chain = %v, want the support user", chain)
+	}
+	md, _ := metadata.FromOutgoingContext(got)
+	if got := md.Get("actoruserid"); len(got) != 1 || got[0] != supportUserID {
+		t.Errorf("outgoing actoruserid = %v, want [%s]", got, supportUserID)
+	}
+}
+
+func TestImpersonationRequiresAuthenticator(t *testing.T) {
+	_, conn := startServer(t, []grpc.ServerOption{
+		grpc.UnaryInterceptor(auth.UnaryServerInterceptor(auth.WithImpersonatorRoles("support"))),
+	})
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		"AccountID", testProjectID,
+		"UserID", "3c2b1a0e-8d7c-46b5-a493-82f5e4d3c2b1",
+		"Roles", "support",
+		"ImpersonateAccountID", testAccountID,
+		"ImpersonateUserID", testUserID,
+	)
+	_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("impersonation without authenticator: error = %v, want PermissionDenied", err)
+	}
+}
+
+func TestWithServiceActorExtendsChain(t *testing.T) {
+	rec, conn := startServer(t,
+		[]grpc.ServerOption{grpc.UnaryInterceptor(auth.UnaryServerInterceptor())},
+		grpc.WithUnaryInterceptor(auth.UnaryClientInterceptor()),
+	)
+
+	ctx := auth.WithServiceActor(auth.WithServiceActor(auth.WithIdentity(context.Background(), testIdentity()), "gateway"), "device")
+	_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	id, _ := auth.FromContext(<-rec.ctx)
+	chain := id.Chain()
+	if len(chain) != 2 || chain[0].Service != "gateway" || chain[1].Service != "device" {
+		t.Errorf("chain = %v, want [service:gateway service:device]", chain)
+	}
+	if id.UserID.String() != testUserID {
+		t.Errorf("subject = %s, want %s", id.UserID, testUserID)
+	}
+}
+
+func TestJWTServiceKeepsChainOverTwoHops(t *testing.T) {
+	jwtInterceptor, err := auth.JWTUnaryServerInterceptor(hsConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceToken := signToken(t, jwt.SigningMethodHS256, testSecret, "", jwt.MapClaims{
+		"sub":     "gateway",
+		"service": "gateway",
+		"roles":   []interface{}{"service"},
+	})
+	userToken := signToken(t, jwt.SigningMethodHS256, testSecret, "", jwt.MapClaims{
+		"account_id": testAccountID,
+		"sub":        testUserID,
+		"roles":      []interface{}{"operator"},
+	})
+
+	// the gateway forwards with or without naming itself, it is the actor either way
+	for _, service := range []string{"", "gateway"} {
+		rec, backend := startServer(t,
+			[]grpc.ServerOption{grpc.ChainUnaryInterceptor(jwtInterceptor, auth.UnaryServerInterceptor())},
+			grpc.WithChainUnaryInterceptor(auth.UnaryClientInterceptor(), bearerInterceptor(serviceToken)),
+		)
+		gateway := startHealthServer(t,
+			&forwardingHealthServer{next: healthpb.NewHealthClient(backend), service: service},
+			[]grpc.ServerOption{grpc.ChainUnaryInterceptor(jwtInterceptor, auth.UnaryServerInterceptor())},
+		)
+
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+userToken)
+		if _, err := healthpb.NewHealthClient(gateway).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		id, _ := auth.FromContext(<-rec.ctx)
+		if id.UserID.String() != testUserID || id.AccountID.String() != testAccountID {
+			t.Errorf("service %q: subject = %s@%s, want the end user", service, id.UserID, id.AccountID)
+		}
+		if chain := id.Chain(); len(chain) != 1 || chain[0].Service != "gateway" {
+			t.Errorf("service %q: chain = %v, want [service:gateway]", service, chain)
+		}
+		// the permissions are those of the verified caller
+		if !id.Verified || !id.HasRole("service") || id.HasRole("operator") {
+			t.Errorf("service %q: verified = %v, roles = %v, want the roles of the service token", service, id.Verified, id.Roles)
+		}
+	}
+}
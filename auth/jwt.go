@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ClaimMapping names the token claims carrying the identity metadata
+type ClaimMapping struct {
+	Account string // claim mapped onto AccountID
+	User    string // claim mapped onto UserID
+	Project string // claim mapped onto ProjectID
+	Roles   string // claim mapped onto Roles
+	Scopes  string // claim mapped onto Scopes
+	Service string // claim naming the calling service, see JWTConfig.DelegationRoles
+}
+
+// DefaultClaimMapping ...
+var DefaultClaimMapping = ClaimMapping{
+	Account: "account_id",
+	User:    "sub",
+	Project: "project_id",
+	Roles:   "roles",
+	Scopes:  "scope",
+	Service: "service",
+}
+
+// JWTConfig configures the token verification interceptors
+type JWTConfig struct {
+	Keys     KeySource     // source of the verification keys, required
+	Methods  []string      // accepted signing algorithms, default HS256, RS256 and ES256
+	Audience string        // expected "aud" claim, not checked when empty
+	Issuer   string        // expected "iss" claim, not checked when empty
+	Leeway   time.Duration // tolerated clock skew for "exp", "nbf" and "iat"
+	Claims   ClaimMapping  // claim names, DefaultClaimMapping when zero
+
+	// DelegationRoles are the roles of the users allowed to call on behalf of the
+	// identity in the request metadata, as the tokens with a service claim are.
+	// Such a caller becomes the actor of the request: the subject and the delegation
+	// chain of the metadata are kept and the roles and scopes are those of the token.
+	DelegationRoles []string
+}
+
+// jwtVerifier verifies bearer tokens against a JWTConfig
+type jwtVerifier struct {
+	conf   JWTConfig
+	parser *jwt.Parser
+}
+
+func newJWTVerifier(conf JWTConfig) (*jwtVerifier, error) {
+	if conf.Keys == nil {
+		return nil, errors.New("auth: JWTConfig.Keys is required")
+	}
+	if len(conf.Methods) == 0 {
+		conf.Methods = []string{"HS256", "RS256", "ES256"}
+	}
+	if conf.Claims == (ClaimMapping{}) {
+		conf.Claims = DefaultClaimMapping
+	}
+	return &jwtVerifier{
+		conf: conf,
+		// time based claims are validated in verify to honor the leeway
+		parser: jwt.NewParser(jwt.WithValidMethods(conf.Methods), jwt.WithoutClaimsValidation()),
+	}, nil
+}
+
+// verify checks the bearer token of the request and returns ctx carrying the verified identity
+func (v *jwtVerifier) verify(ctx context.Context) (context.Context, error) {
+	raw, err := grpc_auth.AuthFromMD(ctx, "bearer")
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(raw, claims, keyFunc(v.conf.Keys)); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	}
+
+	if actor, ok := v.delegate(claims); ok && (incomingValue(ctx, multiAccountKey) != "" || incomingValue(ctx, UserKey) != "") {
+		return withCaller(withVerified(ctx, map[string]string{
+			RolesKey:  claimString(claims, v.conf.Claims.Roles),
+			ScopesKey: claimString(claims, v.conf.Claims.Scopes),
+		}), actor)
+	}
+	return withVerified(withoutActor(ctx), map[string]string{
+		multiAccountKey: claimString(claims, v.conf.Claims.Account),
+		UserKey:         claimString(claims, v.conf.Claims.User),
+		ProjectKey:      claimString(claims, v.conf.Claims.Project),
+		RolesKey:        claimString(claims, v.conf.Claims.Roles),
+		ScopesKey:       claimString(claims, v.conf.Claims.Scopes),
+	}), nil
+}
+
+// delegate returns the actor of a token allowed to call on behalf of other identities:
+// the service of the token, or its user when it holds one of the delegation roles
+func (v *jwtVerifier) delegate(claims jwt.MapClaims) (Actor, bool) {
+	if service := claimString(claims, v.conf.Claims.Service); service != "" {
+		return Actor{Service: service}, true
+	}
+	roles := splitList(claimString(claims, v.conf.Claims.Roles))
+	for _, role := range v.conf.DelegationRoles {
+		if !contains(roles, role) {
+			continue
+		}
+		userID, err := uuid.FromString(claimString(claims, v.conf.Claims.User))
+		if err != nil {
+			return Actor{}, false
+		}
+		return Actor{AccountID: uuid.FromStringOrNil(claimString(claims, v.conf.Claims.Account)), UserID: userID}, true
+	}
+	return Actor{}, false
+}
+
+func (v *jwtVerifier) validate(claims jwt.MapClaims) error {
+	now := time.Now()
+	if !claims.VerifyExpiresAt(now.Add(-v.conf.Leeway).Unix(), false) {
+		return fmt.Errorf("token is expired")
+	}
+	if !claims.VerifyNotBefore(now.Add(v.conf.Leeway).Unix(), false) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if !claims.VerifyIssuedAt(now.Add(v.conf.Leeway).Unix(), false) {
+		return fmt.Errorf("token used before issued")
+	}
+	if v.conf.Audience != "" && !claims.VerifyAudience(v.conf.Audience, true) {
+		return fmt.Errorf("token audience mismatch")
+	}
+	if v.conf.Issuer != "" && !claims.VerifyIssuer(v.conf.Issuer, true) {
+		return fmt.Errorf("token issuer mismatch")
+	}
+	return nil
+}
+
+// claimString returns the claim as metadata value, "" when name is empty or the claim is absent
+func claimString(claims jwt.MapClaims, name string) string {
+	if name == "" {
+		return ""
+	}
+	switch val := claims[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []interface{}:
+		items := make([]string, 0, len(val))
+		for _, item := range val {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// JWTUnaryServerInterceptor returns a new unary server interceptor that verifies the bearer token
+// of each request, rejecting it with codes.Unauthenticated on failure.
+// The account, user and project getters then return the verified claims instead of the raw headers,
+// unless the token may call on behalf of the identity in the metadata, see JWTConfig.DelegationRoles.
+// It fails if conf is invalid.
+func JWTUnaryServerInterceptor(conf JWTConfig) (grpc.UnaryServerInterceptor, error) {
+	v, err := newJWTVerifier(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := v.verify(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}, nil
+}
+
+// JWTStreamServerInterceptor returns a new stream server interceptor that verifies the bearer token
+// of each stream, see JWTUnaryServerInterceptor.
+func JWTStreamServerInterceptor(conf JWTConfig) (grpc.StreamServerInterceptor, error) {
+	v, err := newJWTVerifier(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := v.verify(ss.Context())
+		if err != nil {
+			return err
+		}
+		wrapped := grpc_middleware.WrapServerStream(ss)
+		wrapped.WrappedContext = ctx
+		return handler(srv, wrapped)
+	}, nil
+}
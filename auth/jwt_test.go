@@ -0,0 +1,372 @@
+package auth_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rigoiot/pkg/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// signToken signs claims with method and key, kid is set when not empty
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return raw
+}
+
+// callJWT runs the JWT unary interceptor of conf on a request carrying token and
+// the metadata pairs md, it returns the context seen by the handler
+func callJWT(t *testing.T, conf auth.JWTConfig, token string, md ...string) (context.Context, error) {
+	t.Helper()
+	interceptor, err := auth.JWTUnaryServerInterceptor(conf)
+	if err != nil {
+		t.Fatalf("JWTUnaryServerInterceptor: %v", err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(append(md, "authorization", "Bearer "+token)...))
+	var got context.Context
+	_, err = interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/test.Service/Method"},
+		func(ctx context.Context, _ interface{}) (interface{}, error) {
+			got = ctx
+			return nil, nil
+		})
+	return got, err
+}
+
+func hsConfig() auth.JWTConfig {
+	return auth.JWTConfig{Keys: auth.StaticKeySet{"": testSecret}}
+}
+
+func assertUnauthenticated(t *testing.T, err error, what string) {
+	t.Helper()
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("%s: error = %v, want Unauthenticated", what, err)
+	}
+}
+
+func TestJWTConfigRequiresKeys(t *testing.T) {
+	if _, err := auth.JWTUnaryServerInterceptor(auth.JWTConfig{}); err == nil {
+		t.Error("JWTUnaryServerInterceptor without keys: want an error")
+	}
+	if _, err := auth.JWTStreamServerInterceptor(auth.JWTConfig{}); err == nil {
+		t.Error("JWTStreamServerInterceptor without keys: want an error")
+	}
+}
+
+func TestJWTVerifiedClaimsOverrideHeaders(t *testing.T) {
+	token := signToken(t, jwt.SigningMethodHS256, testSecret, "", jwt.MapClaims{
+		"account_id": testAccountID,
+		"sub":        testUserID,
+		"project_id": testProjectID,
+		"roles":      []interface{}{"admin", "support"},
+		"scope":      "devices:read",
+	})
+	const forged = "3c2b1a0e-8d7c-46b5-a493-82f5e4d3c2b1"
+	ctx, err := callJWT(t, hsConfig(), token,
+		"AccountID", forged, "UserID", forged, "ProjectID", forged,
+		"Roles", "root", "ActorUserID", forged)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	if accountID, _ := auth.GetAccountID(ctx, nil); accountID.String() != testAccountID {
+		t.Errorf("GetAccountID = %s, want %s", accountID, testAccountID)
+	}
+	if userID, _ := auth.GetUserID(ctx, nil); userID.String() != testUserID {
+		t.Errorf("GetUserID = %s, want %s", userID, testUserID)
+	}
+	if projectID, _ := auth.GetProjectID(ctx, nil); projectID.String() != testProjectID {
+		t.Errorf("GetProjectID = %s, want %s", projectID, testProjectID)
+	}
+	id := auth.ParseIdentity(ctx)
+	if !id.HasRole("admin") || !id.HasRole("support") || id.HasRole("root") {
+		t.Errorf("roles = %v, want [admin support]", id.Roles)
+	}
+	if !id.HasScope("devices:read") {
+		t.Errorf("scopes = %v, want [devices:read]", id.Scopes)
+	}
+	if id.Actor != nil {
+		t.Errorf("actor = %v, want none for an authenticated caller", id.Actor)
+	}
+}
+
+func TestJWTDelegationRoles(t *testing.T) {
+	const supportUserID = "3c2b1a0e-8d7c-46b5-a493-82f5e4d3c2b1"
+	conf := hsConfig()
+	conf.DelegationRoles = []string{"delegate"}
+	token := signToken(t, jwt.SigningMethodHS256, testSecret, "", jwt.MapClaims{
+		"account_id": testProjectID,
+		"sub":        supportUserID,
+		"roles":      []interface{}{"delegate"},
+	})
+
+	ctx, err := callJWT(t, conf, token,
+		"AccountID", testAccountID, "UserID", testUserID, "ActorService", "portal", "Roles", "root")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	id := auth.ParseIdentity(ctx)
+	if id.UserID.String() != testUserID || id.AccountID.String() != testAccountID {
+		t.Errorf("subject = %s@%s, want %s@%s", id.UserID, id.AccountID, testUserID, testAccountID)
+	}
+	chain := id.Chain()
+	if len(chain) != 2 || chain[0].Service != "portal" || chain[1].UserID.String() != supportUserID {
+		t.Errorf("chain = %v, want [service:portal user:%s]", chain, supportUserID)
+	}
+	if !id.HasRole("delegate") || id.HasRole("root") {
+		t.Errorf("roles = %v, want [delegate]", id.Roles)
+	}
+
+	// without identity metadata the caller calls for itself
+	ctx, err = callJWT(t, conf, token)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if id := auth.ParseIdentity(ctx); id.UserID.String() != supportUserID || id.Actor != nil {
+		t.Errorf("identity = %+v, want the caller without actor", id)
+	}
+
+	// other tokens cannot keep the metadata identity
+	conf.DelegationRoles = []string{"gateway"}
+	ctx, err = callJWT(t, conf, token, "UserID", testUserID, "ActorService", "portal")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if id := auth.ParseIdentity(ctx); id.UserID.String() != supportUserID || id.Actor != nil {
+		t.Errorf("identity = %+v, want the token identity without actor", id)
+	}
+}
+
+func TestJWTTimeClaims(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		leeway time.Duration
+		valid  bool
+	}{
+		{"valid", jwt.MapClaims{"exp": now.Add(time.Minute).Unix(), "nbf": now.Add(-time.Minute).Unix()}, 0, true},
+		{"expired", jwt.MapClaims{"exp": now.Add(-30 * time.Second).Unix()}, 0, false},
+		{"expired within leeway", jwt.MapClaims{"exp": now.Add(-30 * time.Second).Unix()}, time.Minute, true},
+		{"expired beyond leeway", jwt.MapClaims{"exp": now.Add(-2 * time.Minute).Unix()}, time.Minute, false},
+		{"not yet valid", jwt.MapClaims{"nbf": now.Add(30 * time.Second).Unix()}, 0, false},
+		{"not yet valid within leeway", jwt.MapClaims{"nbf": now.Add(30 * time.Second).Unix()}, time.Minute, true},
+		{"issued in the future", jwt.MapClaims{"iat": now.Add(30 * time.Second).Unix()}, 0, false},
+		{"issued in the future within leeway", jwt.MapClaims{"iat": now.Add(30 * time.Second).Unix()}, time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := hsConfig()
+			conf.Leeway = tt.leeway
+			_, err := callJWT(t, conf, signToken(t, jwt.SigningMethodHS256, testSecret, "", tt.claims))
+			if tt.valid && err != nil {
+				t.Errorf("error = %v, want none", err)
+			}
+			if !tt.valid {
+				assertUnauthenticated(t, err, tt.name)
+			}
+		})
+	}
+}
+
+func TestJWTAudienceAndIssuer(t *testing.T) {
+	conf := hsConfig()
+	conf.Audience, conf.Issuer = "device-service", "https://auth.rigoiot.com"
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		valid  bool
+	}{
+		{"match", jwt.MapClaims{"aud": "device-service", "iss": "https://auth.rigoiot.com"}, true},
+		{"audience list", jwt.MapClaims{"aud": []interface{}{"other", "device-service"}, "iss": "https://auth.rigoiot.com"}, true},
+		{"wrong audience", jwt.MapClaims{"aud": "other", "iss": "https://auth.rigoiot.com"}, false},
+		{"missing audience", jwt.MapClaims{"iss": "https://auth.rigoiot.com"}, false},
+		{"wrong issuer", jwt.MapClaims{"aud": "device-service", "iss": "https://evil.example.com"}, false},
+		{"missing issuer", jwt.MapClaims{"aud": "device-service"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := callJWT(t, conf, signToken(t, jwt.SigningMethodHS256, testSecret, "", tt.claims))
+			if tt.valid && err != nil {
+				t.Errorf("error = %v, want none", err)
+			}
+			if !tt.valid {
+				assertUnauthenticated(t, err, tt.name)
+			}
+		})
+	}
+}
+
+func TestJWTAlgorithmRestriction(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.MapClaims{"sub": testUserID}
+
+	// alg none is never accepted, even without a key lookup
+	none := signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", claims)
+	_, err = callJWT(t, hsConfig(), none)
+	assertUnauthenticated(t, err, "alg none")
+
+	// a token signed with HS256 using the public RSA key as secret
+	rsaConf := auth.JWTConfig{Keys: auth.StaticKeySet{"rsa": &rsaKey.PublicKey}}
+	pub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = callJWT(t, rsaConf, signToken(t, jwt.SigningMethodHS256, pub, "rsa", claims))
+	assertUnauthenticated(t, err, "HS256 with the RSA public key")
+
+	if _, err := callJWT(t, rsaConf, signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", claims)); err != nil {
+		t.Errorf("RS256: error = %v, want none", err)
+	}
+
+	// algorithms out of Methods are refused
+	rsOnly := auth.JWTConfig{Keys: auth.StaticKeySet{"": testSecret}, Methods: []string{"RS256"}}
+	_, err = callJWT(t, rsOnly, signToken(t, jwt.SigningMethodHS256, testSecret, "", claims))
+	assertUnauthenticated(t, err, "HS256 out of Methods")
+}
+
+func TestJWTUnknownKid(t *testing.T) {
+	conf := auth.JWTConfig{Keys: auth.StaticKeySet{"k1": testSecret}}
+	claims := jwt.MapClaims{"sub": testUserID}
+	if _, err := callJWT(t, conf, signToken(t, jwt.SigningMethodHS256, testSecret, "k1", claims)); err != nil {
+		t.Errorf("kid k1: error = %v, want none", err)
+	}
+	_, err := callJWT(t, conf, signToken(t, jwt.SigningMethodHS256, testSecret, "k2", claims))
+	assertUnauthenticated(t, err, "unknown kid")
+	_, err = callJWT(t, conf, signToken(t, jwt.SigningMethodHS256, testSecret, "", claims))
+	assertUnauthenticated(t, err, "no kid")
+}
+
+func TestJWTMissingToken(t *testing.T) {
+	interceptor, err := auth.JWTUnaryServerInterceptor(hsConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{},
+		func(context.Context, interface{}) (interface{}, error) { return nil, nil })
+	assertUnauthenticated(t, err, "no token")
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	t.Helper()
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWKSFile(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path,
+		map[string]string{"kty": "RSA", "kid": "rsa", "use": "sig",
+			"n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		map[string]string{"kty": "oct", "kid": "oct", "k": b64(testSecret)},
+		// encryption keys are skipped
+		map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": "!", "e": "!"},
+	)
+	keys, err := auth.NewJWKSFile(path)
+	if err != nil {
+		t.Fatalf("NewJWKSFile: %v", err)
+	}
+	conf := auth.JWTConfig{Keys: keys}
+	claims := jwt.MapClaims{"sub": testUserID}
+
+	for _, tc := range []struct {
+		kid    string
+		method jwt.SigningMethod
+		key    interface{}
+	}{
+		{"rsa", jwt.SigningMethodRS256, rsaKey},
+		{"ec", jwt.SigningMethodES256, ecKey},
+		{"oct", jwt.SigningMethodHS256, testSecret},
+	} {
+		if _, err := callJWT(t, conf, signToken(t, tc.method, tc.key, tc.kid, claims)); err != nil {
+			t.Errorf("kid %s: error = %v, want none", tc.kid, err)
+		}
+	}
+	if _, err := keys.VerificationKey("RS256", "enc"); err == nil {
+		t.Error("encryption key loaded")
+	}
+	if _, err := keys.VerificationKey("RS256", ""); err == nil {
+		t.Error("key without kid found in a set of several keys")
+	}
+
+	// a broken file keeps the loaded keys
+	for _, content := range []string{
+		`{"keys": [`,
+		`{"keys": [{"kty": "EC", "kid": "ec", "crv": "P-384", "x": "AA", "y": "AA"}]}`,
+		`{"keys": [{"kty": "unknown", "kid": "x"}]}`,
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := keys.Reload(); err == nil {
+			t.Errorf("Reload %s: want an error", content)
+		}
+	}
+	if _, err := keys.VerificationKey("RS256", "rsa"); err != nil {
+		t.Errorf("key lost after a failed reload: %v", err)
+	}
+
+	if _, err := auth.NewJWKSFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("NewJWKSFile of a missing file: want an error")
+	}
+}
+
+func TestJWKSFileSingleKeyWithoutKid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, map[string]string{"kty": "oct", "kid": "only", "k": b64(testSecret)})
+	keys, err := auth.NewJWKSFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signToken(t, jwt.SigningMethodHS256, testSecret, "", jwt.MapClaims{"sub": testUserID})
+	if _, err := callJWT(t, auth.JWTConfig{Keys: keys}, token); err != nil {
+		t.Errorf("token without kid: error = %v, want none", err)
+	}
+}
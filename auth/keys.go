@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var errUnknownKey = errors.New("no verification key for token")
+
+// KeySource resolves the key used to verify the signature of a token
+type KeySource interface {
+	// VerificationKey returns the key for the algorithm and key id ("kid")
+	// of the token header; kid is empty when the token does not carry one
+	VerificationKey(alg, kid string) (interface{}, error)
+}
+
+// StaticKeySet is a KeySource backed by a fixed set of keys indexed by key id.
+// The key stored under "" is used for tokens without a kid.
+// Values are []byte for HS256, *rsa.PublicKey for RS256 and *ecdsa.PublicKey for ES256.
+type StaticKeySet map[string]interface{}
+
+// VerificationKey implements KeySource
+func (s StaticKeySet) VerificationKey(alg, kid string) (interface{}, error) {
+	key, ok := s[kid]
+	if !ok {
+		return nil, errUnknownKey
+	}
+	return key, nil
+}
+
+// JWKSFile is a KeySource loaded from a JSON Web Key Set file
+type JWKSFile struct {
+	path string
+
+	mu   sync.RWMutex
+	keys map[string]interface{}
+}
+
+// NewJWKSFile loads the key set stored at path
+func NewJWKSFile(path string) (*JWKSFile, error) {
+	f := &JWKSFile{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the key set file again, keeping the old keys on error
+func (f *JWKSFile) Reload() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("auth: read jwks file error: %v", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("auth: parse jwks file error: %v", err)
+	}
+	f.mu.Lock()
+	f.keys = keys
+	f.mu.Unlock()
+	return nil
+}
+
+// VerificationKey implements KeySource
+func (f *JWKSFile) VerificationKey(alg, kid string) (interface{}, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if key, ok := f.keys[kid]; ok {
+		return key, nil
+	}
+	// a set with a single key may be used by tokens without kid
+	if kid == "" && len(f.keys) == 1 {
+		for _, key := range f.keys {
+			return key, nil
+		}
+	}
+	return nil, errUnknownKey
+}
+
+// jwk is a single JSON Web Key, see RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.key()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) key() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// keyFunc adapts a KeySource to jwt.Keyfunc
+func keyFunc(src KeySource) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return src.VerificationKey(token.Method.Alg(), kid)
+	}
+}
@@ -2,23 +2,128 @@ package auth
 
 import (
 	"context"
-	"errors"
+	"strings"
 
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/grpc-ecosystem/go-grpc-middleware/util/metautils"
+	"golang.org/x/text/language"
+	"google.golang.org/grpc"
 )
 
 var (
-	errMissingLocale = errors.New("unable to get locale from context")
-
 	// LocaleKey ...
 	LocaleKey = "Locale"
+
+	// AcceptLanguageKeys are the metadata keys of Accept-Language headers, tried after LocaleKey
+	AcceptLanguageKeys = []string{"accept-language", "grpcgateway-accept-language"}
 )
 
 // GetLocale gets the locale from a context
 func GetLocale(ctx context.Context, _ interface{}) (string, error) {
-	val := metautils.ExtractIncoming(ctx).Get(LocaleKey)
-	if val == "" {
-		return "", errMissingLocale
+	return lookupValue(ctx, LocaleKey, false)
+}
+
+// LocaleNegotiator chooses the locale of a request among the supported ones
+type LocaleNegotiator struct {
+	supported []language.Tag
+	fallback  language.Tag
+}
+
+// NewLocaleNegotiator returns a negotiator choosing among supported, fallback is used
+// when no requested locale can be served and defaults to the first supported tag
+func NewLocaleNegotiator(fallback language.Tag, supported ...language.Tag) *LocaleNegotiator {
+	if fallback == language.Und && len(supported) > 0 {
+		fallback = supported[0]
+	}
+	return &LocaleNegotiator{supported: supported, fallback: fallback}
+}
+
+// Negotiate returns the supported locale best matching the request
+func (n *LocaleNegotiator) Negotiate(ctx context.Context) language.Tag {
+	for _, tag := range requestedLocales(ctx) {
+		if match, ok := n.Match(tag); ok {
+			return match
+		}
+	}
+	return n.fallback
+}
+
+// Match walks the fallback chain of tag, for example zh-TW, zh-Hant, zh,
+// and returns the first supported locale
+func (n *LocaleNegotiator) Match(tag language.Tag) (language.Tag, bool) {
+	for _, candidate := range FallbackChain(tag) {
+		for _, s := range n.supported {
+			if s == candidate {
+				return s, true
+			}
+		}
+	}
+	return language.Und, false
+}
+
+// FallbackChain returns tag followed by its parents and its base language,
+// for example zh-TW, zh-Hant, zh
+func FallbackChain(tag language.Tag) []language.Tag {
+	var chain []language.Tag
+	for t := tag; !t.IsRoot(); t = t.Parent() {
+		chain = append(chain, t)
+	}
+	if base, conf := tag.Base(); conf != language.No {
+		if b := language.Make(base.String()); len(chain) == 0 || chain[len(chain)-1] != b {
+			chain = append(chain, b)
+		}
+	}
+	return chain
+}
+
+// requestedLocales returns the locales asked for by the request, in order of preference
+func requestedLocales(ctx context.Context) []language.Tag {
+	var tags []language.Tag
+	if val := incomingValue(ctx, LocaleKey); val != "" {
+		// accept the zh_CN form too
+		if tag, err := language.Parse(strings.Replace(val, "_", "-", -1)); err == nil {
+			tags = append(tags, tag)
+		}
+	}
+	md := metautils.ExtractIncoming(ctx)
+	for _, key := range AcceptLanguageKeys {
+		if val := md.Get(key); val != "" {
+			// sorted by q-value
+			accepted, _, _ := language.ParseAcceptLanguage(val)
+			tags = append(tags, accepted...)
+		}
+	}
+	return tags
+}
+
+// localeKey is the context key of the negotiated locale
+type localeKey struct{}
+
+// NewLocaleContext returns a new context carrying the negotiated locale
+func NewLocaleContext(ctx context.Context, tag language.Tag) context.Context {
+	return context.WithValue(ctx, localeKey{}, tag)
+}
+
+// LocaleFromContext returns the locale stored in ctx by the locale interceptors
+func LocaleFromContext(ctx context.Context) (language.Tag, bool) {
+	tag, ok := ctx.Value(localeKey{}).(language.Tag)
+	return tag, ok
+}
+
+// LocaleUnaryServerInterceptor returns a new unary server interceptor that negotiates the locale
+// of each request and stores it in the context, see LocaleFromContext.
+func LocaleUnaryServerInterceptor(n *LocaleNegotiator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(NewLocaleContext(ctx, n.Negotiate(ctx)), req)
+	}
+}
+
+// LocaleStreamServerInterceptor returns a new stream server interceptor that negotiates the locale
+// of each stream, see LocaleUnaryServerInterceptor.
+func LocaleStreamServerInterceptor(n *LocaleNegotiator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		wrapped := grpc_middleware.WrapServerStream(ss)
+		wrapped.WrappedContext = NewLocaleContext(ss.Context(), n.Negotiate(ss.Context()))
+		return handler(srv, wrapped)
 	}
-	return val, nil
 }
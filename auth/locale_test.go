@@ -0,0 +1,99 @@
+package auth_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/rigoiot/pkg/auth"
+	"golang.org/x/text/language"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestFallbackChain(t *testing.T) {
+	tests := map[string]string{
+		"zh-TW":      "[zh-TW zh-Hant zh]",
+		"zh-HK":      "[zh-HK zh-Hant zh]",
+		"zh-CN":      "[zh-CN zh]",
+		"en-US":      "[en-US en]",
+		"en":         "[en]",
+		"sr-Latn-RS": "[sr-Latn-RS sr-Latn sr]",
+	}
+	for tag, want := range tests {
+		if got := fmt.Sprint(auth.FallbackChain(language.Make(tag))); got != want {
+			t.Errorf("FallbackChain(%s) = %s, want %s", tag, got, want)
+		}
+	}
+}
+
+func TestLocaleNegotiator(t *testing.T) {
+	n := auth.NewLocaleNegotiator(language.English, language.English, language.Chinese, language.TraditionalChinese)
+	tests := []struct {
+		name string
+		md   []string
+		want language.Tag
+	}{
+		{"no preference", nil, language.English},
+		{"locale header", []string{"Locale", "zh-TW"}, language.TraditionalChinese},
+		{"underscore locale", []string{"Locale", "zh_CN"}, language.Chinese},
+		{"q-value order", []string{"accept-language", "fr;q=0.5, zh-TW;q=0.9, en;q=0.7"}, language.TraditionalChinese},
+		{"first supported by q-value", []string{"accept-language", "de, fr;q=0.9, zh-CN;q=0.8, en;q=0.1"}, language.Chinese},
+		{"nothing supported", []string{"accept-language", "fr, de"}, language.English},
+		{"locale header first", []string{"Locale", "en-GB", "accept-language", "zh-TW"}, language.English},
+		{"malformed locale", []string{"Locale", "???", "accept-language", "zh-HK"}, language.TraditionalChinese},
+		{"grpc gateway header", []string{"grpcgateway-accept-language", "zh-Hant-TW"}, language.TraditionalChinese},
+	}
+	for _, tt := range tests {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(tt.md...))
+		if got := n.Negotiate(ctx); got != tt.want {
+			t.Errorf("%s: Negotiate = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLocaleNegotiatorDefaultFallback(t *testing.T) {
+	n := auth.NewLocaleNegotiator(language.Und, language.Chinese, language.English)
+	if got := n.Negotiate(context.Background()); got != language.Chinese {
+		t.Errorf("Negotiate = %s, want the first supported locale", got)
+	}
+	if _, ok := n.Match(language.French); ok {
+		t.Error("Match(fr) succeeded")
+	}
+	if got, ok := n.Match(language.MustParse("en-AU")); !ok || got != language.English {
+		t.Errorf("Match(en-AU) = %s, %v, want en", got, ok)
+	}
+}
+
+func TestLocaleInterceptors(t *testing.T) {
+	n := auth.NewLocaleNegotiator(language.English, language.English, language.TraditionalChinese)
+	rec, conn := startServer(t, []grpc.ServerOption{
+		grpc.UnaryInterceptor(auth.LocaleUnaryServerInterceptor(n)),
+		grpc.StreamInterceptor(auth.LocaleStreamServerInterceptor(n)),
+	})
+	client := healthpb.NewHealthClient(conn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "accept-language", "zh-TW,en;q=0.5")
+
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if tag, ok := auth.LocaleFromContext(<-rec.ctx); !ok || tag != language.TraditionalChinese {
+		t.Errorf("unary locale = %s, %v, want zh-Hant", tag, ok)
+	}
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if tag, ok := auth.LocaleFromContext(<-rec.ctx); !ok || tag != language.TraditionalChinese {
+		t.Errorf("stream locale = %s, %v, want zh-Hant", tag, ok)
+	}
+
+	if _, ok := auth.LocaleFromContext(context.Background()); ok {
+		t.Error("LocaleFromContext found a locale in an empty context")
+	}
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/util/metautils"
+)
+
+// verifiedKey is the context key of the identity values proven by an authenticator
+type verifiedKey struct{}
+
+// withVerified stores verified metadata values in ctx, on top of any values
+// verified earlier in the chain
+func withVerified(ctx context.Context, values map[string]string) context.Context {
+	merged := make(map[string]string, len(values))
+	if prev, ok := ctx.Value(verifiedKey{}).(map[string]string); ok {
+		for k, v := range prev {
+			merged[k] = v
+		}
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, verifiedKey{}, merged)
+}
+
+// incomingValue returns the value of key for the current request. Values
+// verified by an authenticator win over raw incoming metadata, so a caller
+// cannot override its verified identity by sending the header itself.
+func incomingValue(ctx context.Context, key string) string {
+	if verified, ok := ctx.Value(verifiedKey{}).(map[string]string); ok {
+		if val, ok := verified[key]; ok {
+			return val
+		}
+	}
+	return metautils.ExtractIncoming(ctx).Get(key)
+}
+
+// verifiedValue returns the value of key proven by an authenticator, ok is false
+// when no authenticator set it
+func verifiedValue(ctx context.Context, key string) (string, bool) {
+	verified, _ := ctx.Value(verifiedKey{}).(map[string]string)
+	val, ok := verified[key]
+	return val, ok
+}
+
+// authenticated reports whether an authenticator verified the request in ctx
+func authenticated(ctx context.Context) bool {
+	_, ok := ctx.Value(verifiedKey{}).(map[string]string)
+	return ok
+}
+
+// withoutActor hides the actor metadata sent by an authenticated caller,
+// which is the actor itself
+func withoutActor(ctx context.Context) context.Context {
+	values := make(map[string]string, len(actorKeys))
+	for _, key := range actorKeys {
+		values[*key] = ""
+	}
+	return withVerified(ctx, values)
+}
@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rigoiot/pkg/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule grants access to the methods matching Method
+type Rule struct {
+	// Method is a full gRPC method name such as "/device.DeviceService/GetDevice",
+	// a prefix ending with "*" such as "/device.DeviceService/*", or a path.Match pattern
+	Method string `json:"method" yaml:"method"`
+	// Public rules allow any caller
+	Public bool `json:"public,omitempty" yaml:"public,omitempty"`
+	// Roles of which the caller must hold at least one
+	Roles []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+	// Scopes which the caller must all be granted
+	Scopes []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+}
+
+// Policy maps gRPC methods to the roles and scopes they require.
+// Rules are evaluated in order and the first rule matching the method applies.
+type Policy struct {
+	// DenyByDefault rejects methods matched by no rule, they are allowed otherwise
+	DenyByDefault bool   `json:"deny_by_default" yaml:"deny_by_default"`
+	Rules         []Rule `json:"rules" yaml:"rules"`
+	// ProjectRoles grants extra roles per ProjectID, then per UserID
+	ProjectRoles map[string]map[string][]string `json:"project_roles,omitempty" yaml:"project_roles,omitempty"`
+}
+
+// PolicySource provides the policy in effect, see PolicyFile for a hot reloaded source
+type PolicySource interface {
+	Policy() *Policy
+}
+
+// NewPolicy returns an empty policy, allowing every method unless denyByDefault is set
+func NewPolicy(denyByDefault bool) *Policy {
+	return &Policy{DenyByDefault: denyByDefault}
+}
+
+// Policy implements PolicySource
+func (p *Policy) Policy() *Policy {
+	return p
+}
+
+// Public allows any caller to call the methods matching pattern
+func (p *Policy) Public(pattern string) *Policy {
+	p.Rules = append(p.Rules, Rule{Method: pattern, Public: true})
+	return p
+}
+
+// AllowRoles allows callers holding any of roles to call the methods matching pattern
+func (p *Policy) AllowRoles(pattern string, roles ...string) *Policy {
+	p.Rules = append(p.Rules, Rule{Method: pattern, Roles: roles})
+	return p
+}
+
+// AllowScopes allows callers granted all of scopes to call the methods matching pattern
+func (p *Policy) AllowScopes(pattern string, scopes ...string) *Policy {
+	p.Rules = append(p.Rules, Rule{Method: pattern, Scopes: scopes})
+	return p
+}
+
+// Bind grants roles to the user within the project
+func (p *Policy) Bind(projectID, userID string, roles ...string) *Policy {
+	if p.ProjectRoles == nil {
+		p.ProjectRoles = map[string]map[string][]string{}
+	}
+	if p.ProjectRoles[projectID] == nil {
+		p.ProjectRoles[projectID] = map[string][]string{}
+	}
+	p.ProjectRoles[projectID][userID] = append(p.ProjectRoles[projectID][userID], roles...)
+	return p
+}
+
+// Validate checks the rule patterns
+func (p *Policy) Validate() error {
+	for i, r := range p.Rules {
+		if r.Method == "" {
+			return fmt.Errorf("auth: policy rule %d has no method", i)
+		}
+		if _, err := path.Match(r.Method, ""); err != nil {
+			return fmt.Errorf("auth: policy rule %d has invalid method pattern %q: %v", i, r.Method, err)
+		}
+	}
+	return nil
+}
+
+// Authorize returns a codes.PermissionDenied status with the reason if id may not call method.
+// Rules requiring roles or scopes are only satisfied by a verified identity, others
+// get a codes.Unauthenticated status.
+func (p *Policy) Authorize(id *Identity, method string) error {
+	for _, r := range p.Rules {
+		if !matchMethod(r.Method, method) {
+			continue
+		}
+		if r.Public {
+			return nil
+		}
+		if (len(r.Roles) > 0 || len(r.Scopes) > 0) && (id == nil || !id.Verified) {
+			return status.Errorf(codes.Unauthenticated, "%s requires an authenticated caller", method)
+		}
+		if len(r.Roles) > 0 {
+			roles := p.roles(id)
+			granted := false
+			for _, role := range r.Roles {
+				if contains(roles, role) {
+					granted = true
+					break
+				}
+			}
+			if !granted {
+				return status.Errorf(codes.PermissionDenied, "%s requires one of roles: %s", method, strings.Join(r.Roles, ", "))
+			}
+		}
+		for _, scope := range r.Scopes {
+			if !id.HasScope(scope) {
+				return status.Errorf(codes.PermissionDenied, "%s requires scope: %s", method, scope)
+			}
+		}
+		return nil
+	}
+	if p.DenyByDefault {
+		return status.Errorf(codes.PermissionDenied, "%s is not allowed by policy", method)
+	}
+	return nil
+}
+
+// roles returns the roles of id extended with its project bindings
+func (p *Policy) roles(id *Identity) []string {
+	bound := p.ProjectRoles[id.ProjectID.String()][id.UserID.String()]
+	if !id.HasProject() || !id.HasUser() || len(bound) == 0 {
+		return id.Roles
+	}
+	return append(append([]string{}, id.Roles...), bound...)
+}
+
+// matchMethod reports whether method matches pattern, see Rule.Method
+func matchMethod(pattern, method string) bool {
+	if pattern == method {
+		return true
+	}
+	if strings.HasSuffix(pattern, "*") && strings.HasPrefix(method, strings.TrimSuffix(pattern, "*")) {
+		return true
+	}
+	ok, _ := path.Match(pattern, method)
+	return ok
+}
+
+// ParsePolicy decodes a YAML or JSON policy
+func ParsePolicy(data []byte) (*Policy, error) {
+	p := &Policy{}
+	// YAML is a superset of JSON
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("auth: parse policy error: %v", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadPolicyFile reads a policy from a .yaml, .yml or .json file
+func LoadPolicyFile(name string) (*Policy, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("auth: read policy file error: %v", err)
+	}
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		p := &Policy{}
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, fmt.Errorf("auth: parse policy error: %v", err)
+		}
+		return p, p.Validate()
+	}
+	return ParsePolicy(data)
+}
+
+// PolicyFile is a PolicySource reloading its file when it changes
+type PolicyFile struct {
+	name   string
+	policy atomic.Value // *Policy
+
+	modTime time.Time
+	size    int64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// WatchPolicyFile loads the policy file and checks it for changes every interval,
+// 10 seconds when not positive. A policy failing to load is logged and the last
+// good one is kept.
+func WatchPolicyFile(name string, interval time.Duration) (*PolicyFile, error) {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	f := &PolicyFile{name: name, stop: make(chan struct{})}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	go f.watch(interval)
+	return f, nil
+}
+
+// Policy implements PolicySource
+func (f *PolicyFile) Policy() *Policy {
+	return f.policy.Load().(*Policy)
+}
+
+// Close stops watching the file
+func (f *PolicyFile) Close() {
+	f.stopOnce.Do(func() { close(f.stop) })
+}
+
+func (f *PolicyFile) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			reloaded, err := f.reload()
+			if err != nil {
+				logger.Errorf("auth: reload policy file %s error: %v", f.name, err)
+			} else if reloaded {
+				logger.Infof("auth: reloaded policy file %s", f.name)
+			}
+		}
+	}
+}
+
+// reload loads the file if it changed since the last load
+func (f *PolicyFile) reload() (bool, error) {
+	fi, err := os.Stat(f.name)
+	if err != nil {
+		return false, fmt.Errorf("auth: stat policy file error: %v", err)
+	}
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return false, nil
+	}
+	// remember the version even if it is broken, so it is reported once
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	p, err := LoadPolicyFile(f.name)
+	if err != nil {
+		return false, err
+	}
+	f.policy.Store(p)
+	return true, nil
+}
+
+// RequestIdentity returns the identity stored by the server interceptors, parsing it if absent
+func RequestIdentity(ctx context.Context) *Identity {
+	if id, ok := FromContext(ctx); ok {
+		return id
+	}
+	return ParseIdentity(ctx)
+}
+
+// AuthorizationInterceptor returns a new unary server interceptor that authorizes each call
+// against the policy, rejecting it with codes.PermissionDenied.
+// It should be chained after the authentication interceptors.
+func AuthorizationInterceptor(src PolicySource) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := src.Policy().Authorize(RequestIdentity(ctx), info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// AuthorizationStreamInterceptor returns a new stream server interceptor that authorizes each stream
+// against the policy, see AuthorizationInterceptor.
+func AuthorizationStreamInterceptor(src PolicySource) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := src.Policy().Authorize(RequestIdentity(ss.Context()), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
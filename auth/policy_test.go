@@ -0,0 +1,223 @@
+package auth_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rigoiot/pkg/auth"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// verifiedIdentity returns the test identity as verified by an authenticator
+func verifiedIdentity(roles ...string) *auth.Identity {
+	id := testIdentity()
+	id.Verified, id.Roles = true, roles
+	return id
+}
+
+func TestPolicyMethodMatching(t *testing.T) {
+	p := auth.NewPolicy(true).
+		AllowRoles("/device.DeviceService/DeleteDevice", "admin").
+		AllowRoles("/device.DeviceService/*", "operator").
+		AllowRoles("/*.AlarmService/List*", "viewer")
+
+	tests := []struct {
+		method string
+		roles  []string
+		code   codes.Code
+	}{
+		// exact rules win over the later prefix rule
+		{"/device.DeviceService/DeleteDevice", []string{"operator"}, codes.PermissionDenied},
+		{"/device.DeviceService/DeleteDevice", []string{"admin"}, codes.OK},
+		{"/device.DeviceService/GetDevice", []string{"operator"}, codes.OK},
+		{"/device.DeviceService/GetDevice", []string{"viewer"}, codes.PermissionDenied},
+		{"/alarm.AlarmService/ListAlarms", []string{"viewer"}, codes.OK},
+		// path.Match patterns do not cross the slash
+		{"/alarm.AlarmService/GetAlarm", []string{"viewer"}, codes.PermissionDenied},
+		// the prefix includes the slash, other services fall to deny by default
+		{"/device.DeviceServiceV2/GetDevice", []string{"operator"}, codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		if err := p.Authorize(verifiedIdentity(tt.roles...), tt.method); status.Code(err) != tt.code {
+			t.Errorf("Authorize(%v, %s) = %v, want %s", tt.roles, tt.method, err, tt.code)
+		}
+	}
+}
+
+func TestPolicyDenyByDefault(t *testing.T) {
+	id := verifiedIdentity("admin")
+	if err := auth.NewPolicy(false).Authorize(id, "/device.DeviceService/GetDevice"); err != nil {
+		t.Errorf("allow by default: %v", err)
+	}
+	p := auth.NewPolicy(true).Public("/grpc.health.v1.Health/*")
+	if err := p.Authorize(id, "/device.DeviceService/GetDevice"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("deny by default: %v, want PermissionDenied", err)
+	}
+	// public methods need no identity at all
+	if err := p.Authorize(nil, "/grpc.health.v1.Health/Check"); err != nil {
+		t.Errorf("public method: %v", err)
+	}
+}
+
+func TestPolicyScopes(t *testing.T) {
+	p := auth.NewPolicy(true).AllowScopes("/device.DeviceService/*", "devices:read", "devices:write")
+	id := verifiedIdentity()
+	id.Scopes = []string{"devices:read"}
+	if err := p.Authorize(id, "/device.DeviceService/UpdateDevice"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("missing scope: %v, want PermissionDenied", err)
+	}
+	id.Scopes = append(id.Scopes, "devices:write")
+	if err := p.Authorize(id, "/device.DeviceService/UpdateDevice"); err != nil {
+		t.Errorf("all scopes: %v", err)
+	}
+}
+
+func TestPolicyProjectRoles(t *testing.T) {
+	p := auth.NewPolicy(true).
+		AllowRoles("/device.DeviceService/*", "project-admin").
+		Bind(testProjectID, testUserID, "project-admin")
+
+	if err := p.Authorize(verifiedIdentity(), "/device.DeviceService/GetDevice"); err != nil {
+		t.Errorf("bound user: %v", err)
+	}
+	other := verifiedIdentity()
+	other.ProjectID = uuid.NewV4()
+	if err := p.Authorize(other, "/device.DeviceService/GetDevice"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("other project: %v, want PermissionDenied", err)
+	}
+}
+
+func TestPolicyRequiresVerifiedIdentity(t *testing.T) {
+	p := auth.NewPolicy(true).
+		AllowRoles("/device.DeviceService/*", "admin").
+		AllowScopes("/alarm.AlarmService/*", "alarms:read").
+		Bind(testProjectID, testUserID, "admin")
+
+	unverified := testIdentity()
+	unverified.Roles, unverified.Scopes = []string{"admin"}, []string{"alarms:read"}
+	for _, method := range []string{"/device.DeviceService/GetDevice", "/alarm.AlarmService/ListAlarms"} {
+		if err := p.Authorize(unverified, method); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("unverified %s: %v, want Unauthenticated", method, err)
+		}
+		if err := p.Authorize(nil, method); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("nil identity %s: %v, want Unauthenticated", method, err)
+		}
+	}
+}
+
+func TestAuthorizationInterceptorRefusesHeaderRoles(t *testing.T) {
+	p := auth.NewPolicy(true).AllowRoles("/grpc.health.v1.Health/*", "admin")
+	_, conn := startServer(t, []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(auth.UnaryServerInterceptor(), auth.AuthorizationInterceptor(p)),
+	})
+	ctx := metadata.AppendToOutgoingContext(identityContext(), "Roles", "admin")
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Check with a Roles header: %v, want Unauthenticated", err)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := auth.ParsePolicy([]byte(`
+deny_by_default: true
+rules:
+  - method: /grpc.health.v1.Health/*
+    public: true
+  - method: /device.DeviceService/*
+    roles: [admin]
+project_roles:
+  ` + testProjectID + `:
+    ` + testUserID + `: [admin]
+`))
+	if err != nil {
+		t.Fatalf("ParsePolicy: %v", err)
+	}
+	if !p.DenyByDefault || len(p.Rules) != 2 || !p.Rules[0].Public {
+		t.Errorf("policy = %+v", p)
+	}
+	if err := p.Authorize(verifiedIdentity(), "/device.DeviceService/GetDevice"); err != nil {
+		t.Errorf("bound user: %v", err)
+	}
+
+	for _, data := range []string{
+		`rules: [`,
+		`rules: [{roles: [admin]}]`,
+		`rules: [{method: "/device.[DeviceService/*"}]`,
+		`deny_by_default: maybe`,
+	} {
+		if _, err := auth.ParsePolicy([]byte(data)); err == nil {
+			t.Errorf("ParsePolicy(%s): want an error", data)
+		}
+	}
+}
+
+func TestPolicyFileReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "policy.json")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"deny_by_default": true, "rules": [{"method": "/a.A/*", "public": true}]}`)
+	f, err := auth.WatchPolicyFile(name, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("WatchPolicyFile: %v", err)
+	}
+	defer f.Close()
+	if err := f.Policy().Authorize(nil, "/a.A/Get"); err != nil {
+		t.Errorf("initial policy: %v", err)
+	}
+
+	waitPolicy := func(allowed bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for (f.Policy().Authorize(nil, "/b.B/Get") == nil) != allowed {
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for the policy reload")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	write(`{"deny_by_default": true, "rules": [{"method": "/b.B/*", "public": true}, {"method": "/a.A/*", "public": true}]}`)
+	waitPolicy(true)
+
+	// a broken file keeps the last good policy
+	write(`{"rules": [`)
+	time.Sleep(50 * time.Millisecond)
+	waitPolicy(true)
+
+	if _, err := auth.WatchPolicyFile(filepath.Join(t.TempDir(), "missing.yaml"), 0); err == nil {
+		t.Error("WatchPolicyFile of a missing file: want an error")
+	}
+}
+
+func TestWatchPolicyFileDefaultInterval(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(name, []byte("rules: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := auth.WatchPolicyFile(name, 0)
+	if err != nil {
+		t.Fatalf("WatchPolicyFile: %v", err)
+	}
+	f.Close()
+}
+
+func TestRequestIdentity(t *testing.T) {
+	stored := testIdentity()
+	if id := auth.RequestIdentity(auth.NewContext(context.Background(), stored)); id != stored {
+		t.Errorf("RequestIdentity = %v, want the stored identity", id)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("UserID", testUserID))
+	if id := auth.RequestIdentity(ctx); id.UserID.String() != testUserID {
+		t.Errorf("RequestIdentity parsed %v, want user %s", id.UserID, testUserID)
+	}
+}
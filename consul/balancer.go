@@ -0,0 +1,364 @@
+package consul
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rigoiot/pkg/logger"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Names of the balancers registered with gRPC, select one with the service config:
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingPolicy":"consul_weighted_round_robin"}`)
+//
+// or with ServiceConfig to set the zone of the client
+const (
+	// WeightedRoundRobin spreads the requests in proportion to the instance weights
+	WeightedRoundRobin = "consul_weighted_round_robin"
+
+	// LeastRequest sends each request to the instance with the fewest
+	// outstanding requests relative to its weight
+	LeastRequest = "consul_least_request"
+)
+
+// ZoneMetaKey is the service meta key holding the zone of an instance
+const ZoneMetaKey = "zone"
+
+// LoadBalancingConfig is the config of the consul balancers in the loadBalancingConfig
+// of the service config, for example:
+//
+//	{"loadBalancingConfig": [{"consul_least_request": {"zone": "zone-a"}}]}
+type LoadBalancingConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// Zone is the zone of the client. When set, the balancer only picks the ready
+	// instances of the zone and falls back to the other zones when it has none.
+	Zone string `json:"zone,omitempty"`
+}
+
+// ServiceConfig returns the service config selecting the consul balancer policy,
+// WeightedRoundRobin or LeastRequest, for a client in zone:
+//
+//	grpc.WithDefaultServiceConfig(consul.ServiceConfig(consul.LeastRequest, "zone-a"))
+//
+// Each client connection has its own zone, an empty zone disables the zone affinity.
+func ServiceConfig(policy, zone string) string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"loadBalancingConfig": []map[string]*LoadBalancingConfig{{policy: {Zone: zone}}},
+	})
+	return string(data)
+}
+
+func init() {
+	balancer.Register(&balancerBuilder{name: WeightedRoundRobin, newPicker: newWeightedPicker})
+	balancer.Register(&balancerBuilder{name: LeastRequest, newPicker: newLeastRequestPicker})
+}
+
+// balancerBuilder builds the balancers of one picking policy
+type balancerBuilder struct {
+	name      string
+	newPicker func(entries []pickEntry) balancer.V2Picker
+}
+
+func (b *balancerBuilder) Build(cc balancer.ClientConn, _ balancer.BuildOptions) balancer.Balancer {
+	return &consulBalancer{
+		cc:        cc,
+		newPicker: b.newPicker,
+		subConns:  map[string]*subConn{},
+		scs:       map[balancer.SubConn]*subConn{},
+		csEvltr:   &balancer.ConnectivityStateEvaluator{},
+		state:     connectivity.Connecting,
+		picker:    base.NewErrPickerV2(balancer.ErrNoSubConnAvailable),
+	}
+}
+
+func (b *balancerBuilder) Name() string {
+	return b.name
+}
+
+// ParseConfig parses the LoadBalancingConfig of the service config
+func (b *balancerBuilder) ParseConfig(data json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	conf := &LoadBalancingConfig{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("consul: invalid %s config: %v", b.name, err)
+	}
+	return conf, nil
+}
+
+// subConn is the connection to one address
+type subConn struct {
+	outstanding int64 // requests in flight, first for 64-bit alignment
+
+	sc    balancer.SubConn
+	inst  *Instance // nil when the address has no consul instance
+	state connectivity.State
+}
+
+// consulBalancer keeps one SubConn per address like the base balancer, but keys
+// them by address only: the instance attributes change with the consul updates
+// and must not recreate the connections
+type consulBalancer struct {
+	cc        balancer.ClientConn
+	zone      string // from the LoadBalancingConfig
+	newPicker func(entries []pickEntry) balancer.V2Picker
+
+	subConns map[string]*subConn // by address
+	scs      map[balancer.SubConn]*subConn
+	csEvltr  *balancer.ConnectivityStateEvaluator
+	state    connectivity.State
+	picker   balancer.V2Picker
+
+	resolverErr error // the last error reported by the resolver
+	connErr     error // the last connection error
+}
+
+// HandleResolvedAddrs is replaced by UpdateClientConnState and never called by
+// gRPC on a V2Balancer
+func (b *consulBalancer) HandleResolvedAddrs([]resolver.Address, error) {
+	logger.Printf("consul: balancer: HandleResolvedAddrs is deprecated, ignored")
+}
+
+// HandleSubConnStateChange is replaced by UpdateSubConnState and never called by
+// gRPC on a V2Balancer
+func (b *consulBalancer) HandleSubConnStateChange(balancer.SubConn, connectivity.State) {
+	logger.Printf("consul: balancer: HandleSubConnStateChange is deprecated, ignored")
+}
+
+// UpdateClientConnState creates and removes the SubConns of the resolved addresses
+// and picks up the new weights and zones
+func (b *consulBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.resolverErr = nil
+	b.zone = ""
+	if conf, ok := s.BalancerConfig.(*LoadBalancingConfig); ok && conf != nil {
+		b.zone = conf.Zone
+	}
+	addrs := make(map[string]bool, len(s.ResolverState.Addresses))
+	for _, a := range s.ResolverState.Addresses {
+		addrs[a.Addr] = true
+		inst, _ := InstanceFromAddress(a)
+		if sc, ok := b.subConns[a.Addr]; ok {
+			sc.inst = inst
+			continue
+		}
+		sc, err := b.cc.NewSubConn([]resolver.Address{a}, balancer.NewSubConnOptions{HealthCheckEnabled: true})
+		if err != nil {
+			logger.Printf("consul: create SubConn of %s error: %v", a.Addr, err)
+			continue
+		}
+		b.subConns[a.Addr] = &subConn{sc: sc, inst: inst, state: connectivity.Idle}
+		b.scs[sc] = b.subConns[a.Addr]
+		sc.Connect()
+	}
+	for addr, sc := range b.subConns {
+		if !addrs[addr] {
+			// the state is kept in scs until Shutdown
+			b.cc.RemoveSubConn(sc.sc)
+			delete(b.subConns, addr)
+		}
+	}
+	if len(s.ResolverState.Addresses) == 0 {
+		b.ResolverError(errors.New("produced zero addresses"))
+		return balancer.ErrBadResolverState
+	}
+
+	b.regeneratePicker()
+	b.cc.UpdateState(balancer.State{ConnectivityState: b.state, Picker: b.picker})
+	return nil
+}
+
+// ResolverError reports the error in the picker when no SubConn can be used
+func (b *consulBalancer) ResolverError(err error) {
+	b.resolverErr = err
+	if len(b.subConns) == 0 {
+		b.state = connectivity.TransientFailure
+	}
+	if b.state != connectivity.TransientFailure {
+		return
+	}
+	b.regeneratePicker()
+	b.cc.UpdateState(balancer.State{ConnectivityState: b.state, Picker: b.picker})
+}
+
+func (b *consulBalancer) UpdateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+	s, ok := b.scs[sc]
+	if !ok {
+		return
+	}
+	old := s.state
+	if old == connectivity.TransientFailure && state.ConnectivityState == connectivity.Connecting {
+		// keep reporting the failure while reconnecting, see the base balancer
+		return
+	}
+	s.state = state.ConnectivityState
+	switch s.state {
+	case connectivity.Idle:
+		sc.Connect()
+	case connectivity.Shutdown:
+		delete(b.scs, sc)
+	case connectivity.TransientFailure:
+		b.connErr = state.ConnectionError
+	}
+
+	b.state = b.csEvltr.RecordTransition(old, s.state)
+	if (s.state == connectivity.Ready) != (old == connectivity.Ready) ||
+		b.state == connectivity.TransientFailure {
+		b.regeneratePicker()
+	}
+	b.cc.UpdateState(balancer.State{ConnectivityState: b.state, Picker: b.picker})
+}
+
+// Close does nothing, gRPC removes the SubConns
+func (b *consulBalancer) Close() {
+}
+
+// regeneratePicker builds the picker from the ready SubConns, restricted to the
+// local zone when it has any
+func (b *consulBalancer) regeneratePicker() {
+	if b.state == connectivity.TransientFailure {
+		b.picker = base.NewErrPickerV2(balancer.TransientFailureError(b.mergeErrors()))
+		return
+	}
+
+	var ready, local []pickEntry
+	addrs := make([]string, 0, len(b.subConns))
+	for addr := range b.subConns {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		s := b.subConns[addr]
+		if s.state != connectivity.Ready {
+			continue
+		}
+		e := pickEntry{sc: s.sc, weight: 1, outstanding: &s.outstanding}
+		if s.inst != nil {
+			e.weight = s.inst.Weight
+		}
+		ready = append(ready, e)
+		if b.zone != "" && s.inst != nil && s.inst.Meta[ZoneMetaKey] == b.zone {
+			local = append(local, e)
+		}
+	}
+	if len(local) > 0 {
+		ready = local
+	}
+	if len(ready) == 0 {
+		b.picker = base.NewErrPickerV2(balancer.ErrNoSubConnAvailable)
+		return
+	}
+	b.picker = b.newPicker(positiveWeights(ready))
+}
+
+// mergeErrors builds an error from the last connection and resolver errors
+func (b *consulBalancer) mergeErrors() error {
+	if b.connErr == nil {
+		return fmt.Errorf("last resolver error: %v", b.resolverErr)
+	}
+	if b.resolverErr == nil {
+		return fmt.Errorf("last connection error: %v", b.connErr)
+	}
+	return fmt.Errorf("last connection error: %v; last resolver error: %v", b.connErr, b.resolverErr)
+}
+
+// pickEntry is a ready SubConn seen by the pickers
+type pickEntry struct {
+	sc          balancer.SubConn
+	weight      int
+	outstanding *int64
+}
+
+// positiveWeights drops the instances of weight zero, for example the warning ones
+// registered with WithWeights(n, 0), unless all of them weigh zero: they are then
+// picked evenly. The entries are rotated randomly so that the clients do not all
+// start with the same instance.
+func positiveWeights(entries []pickEntry) []pickEntry {
+	var weighted []pickEntry
+	for _, e := range entries {
+		if e.weight > 0 {
+			weighted = append(weighted, e)
+		}
+	}
+	if len(weighted) == 0 {
+		weighted = append(weighted, entries...)
+		for i := range weighted {
+			weighted[i].weight = 1
+		}
+	}
+	n := rand.Intn(len(weighted))
+	return append(weighted[n:], weighted[:n]...)
+}
+
+// weightedPicker is a smooth weighted round-robin: the instances are interleaved
+// in proportion to their weights rather than picked in bursts
+type weightedPicker struct {
+	entries []pickEntry
+	total   int
+
+	mu      sync.Mutex
+	current []int
+}
+
+func newWeightedPicker(entries []pickEntry) balancer.V2Picker {
+	p := &weightedPicker{entries: entries, current: make([]int, len(entries))}
+	for _, e := range entries {
+		p.total += e.weight
+	}
+	return p
+}
+
+func (p *weightedPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	best := 0
+	for i, e := range p.entries {
+		p.current[i] += e.weight
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	p.mu.Unlock()
+	return balancer.PickResult{SubConn: p.entries[best].sc}, nil
+}
+
+// leastRequestPicker picks the instance with the fewest outstanding requests per
+// unit of weight, ties are broken in turn. The counters belong to the SubConns
+// and survive the picker updates.
+type leastRequestPicker struct {
+	entries []pickEntry
+	next    uint32
+}
+
+func newLeastRequestPicker(entries []pickEntry) balancer.V2Picker {
+	return &leastRequestPicker{entries: entries}
+}
+
+func (p *leastRequestPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	n := uint32(len(p.entries))
+	start := atomic.AddUint32(&p.next, 1)
+	var best *pickEntry
+	var bestLoad float64
+	for i := uint32(0); i < n; i++ {
+		e := &p.entries[(start+i)%n]
+		load := float64(atomic.LoadInt64(e.outstanding)) / float64(e.weight)
+		if best == nil || load < bestLoad {
+			best, bestLoad = e, load
+		}
+	}
+
+	outstanding := best.outstanding
+	atomic.AddInt64(outstanding, 1)
+	return balancer.PickResult{
+		SubConn: best.sc,
+		Done:    func(balancer.DoneInfo) { atomic.AddInt64(outstanding, -1) },
+	}, nil
+}
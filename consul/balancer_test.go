@@ -0,0 +1,291 @@
+package consul_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rigoiot/pkg/consul"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// fakeSubConn is a SubConn whose state is driven by the test
+type fakeSubConn struct {
+	addr string
+}
+
+func (sc *fakeSubConn) UpdateAddresses([]resolver.Address) {}
+func (sc *fakeSubConn) Connect()                           {}
+
+// fakeBalancerConn records the SubConns and the pickers of a balancer
+type fakeBalancerConn struct {
+	balancer.ClientConn
+
+	subConns map[string]*fakeSubConn
+	created  int
+	picker   balancer.V2Picker
+}
+
+func (cc *fakeBalancerConn) NewSubConn(addrs []resolver.Address, _ balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	sc := &fakeSubConn{addr: addrs[0].Addr}
+	cc.subConns[sc.addr] = sc
+	cc.created++
+	return sc, nil
+}
+
+func (cc *fakeBalancerConn) RemoveSubConn(sc balancer.SubConn) {
+	delete(cc.subConns, sc.(*fakeSubConn).addr)
+}
+
+func (cc *fakeBalancerConn) UpdateState(s balancer.State) {
+	cc.picker = s.Picker
+}
+
+// buildBalancer builds the registered balancer name on a fake ClientConn
+func buildBalancer(t *testing.T, name string) (balancer.V2Balancer, *fakeBalancerConn) {
+	t.Helper()
+	builder := balancer.Get(name)
+	if builder == nil {
+		t.Fatalf("balancer %s not registered", name)
+	}
+	cc := &fakeBalancerConn{subConns: map[string]*fakeSubConn{}}
+	return builder.Build(cc, balancer.BuildOptions{}).(balancer.V2Balancer), cc
+}
+
+// instance returns the address of a consul instance of weight in zone
+func instance(addr string, weight int, zone string) resolver.Address {
+	return consul.NewAddress(addr, &consul.Instance{ID: addr, Weight: weight, Meta: map[string]string{consul.ZoneMetaKey: zone}})
+}
+
+// resolve updates the addresses of b and sets the new SubConns ready
+func resolve(t *testing.T, b balancer.V2Balancer, cc *fakeBalancerConn, addrs ...resolver.Address) {
+	t.Helper()
+	resolveConfig(t, b, cc, nil, addrs...)
+}
+
+// resolveConfig is resolve with the balancer config conf
+func resolveConfig(t *testing.T, b balancer.V2Balancer, cc *fakeBalancerConn, conf serviceconfig.LoadBalancingConfig, addrs ...resolver.Address) {
+	t.Helper()
+	s := balancer.ClientConnState{ResolverState: resolver.State{Addresses: addrs}, BalancerConfig: conf}
+	if err := b.UpdateClientConnState(s); err != nil {
+		t.Fatalf("UpdateClientConnState: %v", err)
+	}
+	for _, sc := range cc.subConns {
+		b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	}
+}
+
+// picks returns how many of n picks went to each address, the RPCs are done if done is set
+func picks(t *testing.T, cc *fakeBalancerConn, n int, done bool) map[string]int {
+	t.Helper()
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		res, err := cc.picker.Pick(balancer.PickInfo{FullMethodName: "/device.Service/Get", Ctx: context.Background()})
+		if err != nil {
+			t.Fatalf("Pick: %v", err)
+		}
+		counts[res.SubConn.(*fakeSubConn).addr]++
+		if done && res.Done != nil {
+			res.Done(balancer.DoneInfo{})
+		}
+	}
+	return counts
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	b, cc := buildBalancer(t, consul.WeightedRoundRobin)
+	resolve(t, b, cc, instance("10.0.0.1:8001", 1, ""), instance("10.0.0.2:8001", 3, ""))
+
+	counts := picks(t, cc, 400, true)
+	if counts["10.0.0.1:8001"] != 100 || counts["10.0.0.2:8001"] != 300 {
+		t.Errorf("picks = %v, want 100 and 300", counts)
+	}
+
+	// new weights apply without reconnecting
+	resolve(t, b, cc, instance("10.0.0.1:8001", 1, ""), instance("10.0.0.2:8001", 1, ""))
+	if cc.created != 2 {
+		t.Errorf("%d SubConns created, want 2", cc.created)
+	}
+	counts = picks(t, cc, 100, true)
+	if counts["10.0.0.1:8001"] != 50 || counts["10.0.0.2:8001"] != 50 {
+		t.Errorf("picks = %v, want 50 and 50", counts)
+	}
+
+	// instances of weight zero are skipped
+	resolve(t, b, cc, instance("10.0.0.1:8001", 0, ""), instance("10.0.0.2:8001", 1, ""))
+	if counts = picks(t, cc, 10, true); counts["10.0.0.2:8001"] != 10 {
+		t.Errorf("picks = %v, want all on 10.0.0.2:8001", counts)
+	}
+
+	// removed addresses are not picked
+	resolve(t, b, cc, instance("10.0.0.1:8001", 1, ""))
+	if counts = picks(t, cc, 10, true); counts["10.0.0.1:8001"] != 10 {
+		t.Errorf("picks = %v, want all on 10.0.0.1:8001", counts)
+	}
+}
+
+// zoneConfig parses the config of the balancer name for zone
+func zoneConfig(t *testing.T, name, zone string) serviceconfig.LoadBalancingConfig {
+	t.Helper()
+	conf, err := balancer.Get(name).(balancer.ConfigParser).ParseConfig(json.RawMessage(`{"zone": "` + zone + `"}`))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	return conf
+}
+
+func TestZoneAffinity(t *testing.T) {
+	b, cc := buildBalancer(t, consul.WeightedRoundRobin)
+	resolveConfig(t, b, cc, zoneConfig(t, consul.WeightedRoundRobin, "zone-a"),
+		instance("10.0.0.1:8001", 1, "zone-a"),
+		instance("10.0.0.2:8001", 1, "zone-b"),
+		instance("10.0.0.3:8001", 1, "zone-a"),
+	)
+	counts := picks(t, cc, 100, true)
+	if counts["10.0.0.1:8001"] != 50 || counts["10.0.0.3:8001"] != 50 {
+		t.Errorf("picks = %v, want the zone-a instances only", counts)
+	}
+
+	// falls back to the other zones when no local instance is ready
+	for _, addr := range []string{"10.0.0.1:8001", "10.0.0.3:8001"} {
+		b.UpdateSubConnState(cc.subConns[addr], balancer.SubConnState{ConnectivityState: connectivity.TransientFailure})
+	}
+	if counts = picks(t, cc, 10, true); counts["10.0.0.2:8001"] != 10 {
+		t.Errorf("picks = %v, want the zone-b instance", counts)
+	}
+
+	// back to the local zone once it recovers
+	b.UpdateSubConnState(cc.subConns["10.0.0.1:8001"], balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	if counts = picks(t, cc, 10, true); counts["10.0.0.1:8001"] != 10 {
+		t.Errorf("picks = %v, want the recovered zone-a instance", counts)
+	}
+}
+
+func TestParseBalancerConfig(t *testing.T) {
+	parser := balancer.Get(consul.LeastRequest).(balancer.ConfigParser)
+	if _, err := parser.ParseConfig(json.RawMessage(`{"zone": 1}`)); err == nil {
+		t.Error("ParseConfig of a numeric zone succeeded")
+	}
+	// unknown fields are ignored for compatibility
+	conf, err := parser.ParseConfig(json.RawMessage(`{"zone": "zone-a", "region": "eu"}`))
+	if err != nil || conf.(*consul.LoadBalancingConfig).Zone != "zone-a" {
+		t.Errorf("ParseConfig = %+v, %v", conf, err)
+	}
+}
+
+func TestDeprecatedBalancerMethods(t *testing.T) {
+	b, cc := buildBalancer(t, consul.LeastRequest)
+	resolve(t, b, cc, instance("10.0.0.1:8001", 1, ""))
+	// ignored instead of panicking
+	old := b.(balancer.Balancer)
+	old.HandleResolvedAddrs(nil, nil)
+	old.HandleSubConnStateChange(cc.subConns["10.0.0.1:8001"], connectivity.Shutdown)
+	if counts := picks(t, cc, 2, true); counts["10.0.0.1:8001"] != 2 {
+		t.Errorf("picks = %v after the deprecated calls", counts)
+	}
+}
+
+// zoneServer starts a gRPC server whose health service only knows zone
+func zoneServer(t *testing.T, zone string) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	hs.SetServingStatus(zone, healthpb.HealthCheckResponse_SERVING)
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+func TestZonePerClient(t *testing.T) {
+	r := manual.NewBuilderWithScheme("zones")
+	r.InitialState(resolver.State{Addresses: []resolver.Address{
+		instance(zoneServer(t, "zone-a"), 1, "zone-a"),
+		instance(zoneServer(t, "zone-b"), 1, "zone-b"),
+	}})
+
+	// two clients of one process, each in its own zone
+	for _, zone := range []string{"zone-a", "zone-b"} {
+		conn, err := grpc.Dial("zones:///device-service", grpc.WithInsecure(), grpc.WithResolvers(r),
+			grpc.WithDefaultServiceConfig(consul.ServiceConfig(consul.WeightedRoundRobin, zone)))
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+
+		client := healthpb.NewHealthClient(conn)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// only the server of the zone knows the zone service, the other zone is
+		// picked until the connection to the local one is ready
+		req := &healthpb.HealthCheckRequest{Service: zone}
+		for {
+			if _, err := client.Check(ctx, req, grpc.WaitForReady(true)); err == nil {
+				break
+			} else if ctx.Err() != nil {
+				t.Fatalf("%s client: %v", zone, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := client.Check(ctx, req); err != nil {
+				t.Fatalf("%s client, check %d: %v", zone, i, err)
+			}
+		}
+	}
+}
+
+func TestLeastRequest(t *testing.T) {
+	b, cc := buildBalancer(t, consul.LeastRequest)
+	resolve(t, b, cc, instance("10.0.0.1:8001", 1, ""), instance("10.0.0.2:8001", 1, ""))
+
+	// outstanding requests are spread evenly
+	var pending []balancer.PickResult
+	for i := 0; i < 4; i++ {
+		res, err := cc.picker.Pick(balancer.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			t.Fatalf("Pick: %v", err)
+		}
+		pending = append(pending, res)
+	}
+	counts := map[string]int{}
+	for _, res := range pending {
+		counts[res.SubConn.(*fakeSubConn).addr]++
+	}
+	if counts["10.0.0.1:8001"] != 2 || counts["10.0.0.2:8001"] != 2 {
+		t.Errorf("outstanding = %v, want 2 and 2", counts)
+	}
+
+	// finishing the requests of one instance makes it the least loaded,
+	// the counters survive the picker updates
+	resolve(t, b, cc, instance("10.0.0.1:8001", 1, ""), instance("10.0.0.2:8001", 1, ""))
+	for _, res := range pending {
+		if res.SubConn.(*fakeSubConn).addr == "10.0.0.2:8001" {
+			res.Done(balancer.DoneInfo{})
+		}
+	}
+	if counts = picks(t, cc, 2, false); counts["10.0.0.2:8001"] != 2 {
+		t.Errorf("picks = %v, want 10.0.0.2:8001", counts)
+	}
+
+	// the load is relative to the weights
+	b, cc = buildBalancer(t, consul.LeastRequest)
+	resolve(t, b, cc, instance("10.0.0.1:8001", 1, ""), instance("10.0.0.2:8001", 3, ""))
+	counts = picks(t, cc, 8, false)
+	if counts["10.0.0.1:8001"] != 2 || counts["10.0.0.2:8001"] != 6 {
+		t.Errorf("outstanding = %v, want 2 and 6", counts)
+	}
+}
@@ -0,0 +1,102 @@
+package consul
+
+import (
+	"fmt"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// CheckType is the kind of a health check
+type CheckType string
+
+// Health check types
+const (
+	CheckTTL  CheckType = "ttl"
+	CheckGRPC CheckType = "grpc"
+	CheckHTTP CheckType = "http"
+	CheckTCP  CheckType = "tcp"
+)
+
+// Check describes a health check of a registered service
+type Check struct {
+	Type CheckType
+
+	// TTL of a CheckTTL, the Registration updates it every interval
+	TTL time.Duration
+
+	// Interval and Timeout of the checks run by consul itself
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// Target is the gRPC "host:port/service", the HTTP URL or the TCP "host:port" to check,
+	// gRPC and TCP checks default to the service address
+	Target string
+
+	// TLS enables TLS for gRPC checks, TLSSkipVerify skips the certificate verification
+	// of gRPC and HTTP checks
+	TLS           bool
+	TLSSkipVerify bool
+}
+
+// TTLCheck returns a check that turns critical unless updated within ttl
+func TTLCheck(ttl time.Duration) Check {
+	return Check{Type: CheckTTL, TTL: ttl}
+}
+
+// GRPCCheck returns a check calling the standard gRPC health service of the instance every interval
+func GRPCCheck(interval time.Duration) Check {
+	return Check{Type: CheckGRPC, Interval: interval}
+}
+
+// HTTPCheck returns a check requesting url every interval, 2xx responses are passing
+func HTTPCheck(url string, interval time.Duration) Check {
+	return Check{Type: CheckHTTP, Target: url, Interval: interval}
+}
+
+// TCPCheck returns a check connecting to the instance every interval
+func TCPCheck(interval time.Duration) Check {
+	return Check{Type: CheckTCP, Interval: interval}
+}
+
+// agentCheck converts c to the consul API, address is the "host:port" of the service
+func (c Check) agentCheck(address string) (*consul.AgentServiceCheck, error) {
+	check := &consul.AgentServiceCheck{}
+	if c.Interval > 0 {
+		check.Interval = c.Interval.String()
+	}
+	if c.Timeout > 0 {
+		check.Timeout = c.Timeout.String()
+	}
+	target := c.Target
+	if target == "" {
+		target = address
+	}
+
+	switch c.Type {
+	case CheckTTL:
+		if c.TTL <= 0 {
+			return nil, fmt.Errorf("consul: TTL check without TTL")
+		}
+		check.TTL = c.TTL.String()
+		check.Status = consul.HealthPassing
+	case CheckGRPC:
+		check.GRPC = target
+		check.GRPCUseTLS = c.TLS
+		check.TLSSkipVerify = c.TLSSkipVerify
+	case CheckHTTP:
+		if c.Target == "" {
+			return nil, fmt.Errorf("consul: HTTP check without URL")
+		}
+		check.HTTP = c.Target
+		check.TLSSkipVerify = c.TLSSkipVerify
+	case CheckTCP:
+		check.TCP = target
+	default:
+		return nil, fmt.Errorf("consul: unknown check type %q", c.Type)
+	}
+	if c.Type != CheckTTL && c.Interval <= 0 {
+		return nil, fmt.Errorf("consul: %s check without interval", c.Type)
+	}
+	return check, nil
+}
@@ -0,0 +1,44 @@
+package consul
+
+import (
+	"fmt"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// ClientConfig holds the optional settings of the consul client,
+// the zero value talks plain HTTP to the default datacenter without ACL token
+type ClientConfig struct {
+	// Scheme is "http" or "https", it defaults to "https" when TLS is set
+	Scheme string
+	// Datacenter of the agent when empty
+	Datacenter string
+	// Token is the ACL token sent with every request
+	Token string
+	// TLS configures the client certificates and the CA of the agent
+	TLS *consul.TLSConfig
+}
+
+// newClient creates the consul client of the agent at target, for example: "127.0.0.1:8500"
+func newClient(target string, conf ClientConfig) (*consul.Client, error) {
+	c := &consul.Config{
+		Scheme:     conf.Scheme,
+		Address:    target,
+		Datacenter: conf.Datacenter,
+		Token:      conf.Token,
+	}
+	if conf.TLS != nil {
+		c.TLSConfig = *conf.TLS
+		if c.Scheme == "" {
+			c.Scheme = "https"
+		}
+	}
+	if c.Scheme == "" {
+		c.Scheme = "http"
+	}
+	client, err := consul.NewClient(c)
+	if err != nil {
+		return nil, fmt.Errorf("consul: create consul client error: %v", err)
+	}
+	return client, nil
+}
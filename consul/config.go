@@ -0,0 +1,250 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/rigoiot/pkg/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigOptions describes where a Config is read from and how it is checked
+type ConfigOptions[T any] struct {
+	// Key holding a JSON or YAML document, or the prefix of a flat key tree when Prefix is set:
+	// "<prefix>/db/host" = "10.0.0.1" decodes like the YAML "db: {host: 10.0.0.1}"
+	Key    string
+	Prefix bool
+
+	// Client configures the ACL token, TLS and datacenter of the consul client
+	Client ClientConfig
+
+	// Defaults is called on the zero value before each decoding
+	Defaults func(*T)
+	// Validate rejects a decoded value, the last good value is kept
+	Validate func(T) error
+	// OnChange is called from the watch goroutine when the value changes
+	OnChange func(old, new T)
+
+	// Snapshot is a file the last good value is saved to, it is loaded at start
+	// so that a cold start works while consul is down
+	Snapshot string
+}
+
+// Config is a value of type T kept in sync with consul KV
+type Config[T any] struct {
+	opts    ConfigOptions[T]
+	watcher *KVWatcher
+
+	mu        sync.RWMutex
+	value     T
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// NewConfig loads the snapshot file if any, then watches the key on the consul agent
+// at target, for example: "127.0.0.1:8500", until Close
+func NewConfig[T any](target string, opts ConfigOptions[T]) (*Config[T], error) {
+	if opts.Key == "" {
+		return nil, fmt.Errorf("consul: config key is required")
+	}
+	c := &Config[T]{opts: opts, ready: make(chan struct{})}
+	c.value = c.newValue()
+
+	if opts.Snapshot != "" {
+		if err := c.loadSnapshot(); err != nil && !os.IsNotExist(err) {
+			logger.Printf("consul: load config snapshot '%s' error: %v", opts.Snapshot, err)
+		}
+	}
+
+	var err error
+	if opts.Prefix {
+		c.watcher, err = WatchPrefix(target, opts.Client, opts.Key, c.reload)
+	} else {
+		c.watcher, err = WatchKey(target, opts.Client, opts.Key, func(value []byte) {
+			c.reload(consul.KVPairs{{Key: opts.Key, Value: value}})
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get returns the current value: the defaults until a value is loaded
+func (c *Config[T]) Get() T {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.value
+}
+
+// Ready is closed once a value is loaded from consul or from the snapshot
+func (c *Config[T]) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// Close stops watching consul
+func (c *Config[T]) Close() {
+	c.watcher.Close()
+}
+
+// newValue returns the zero value with the defaults applied
+func (c *Config[T]) newValue() T {
+	var v T
+	if c.opts.Defaults != nil {
+		c.opts.Defaults(&v)
+	}
+	return v
+}
+
+// reload decodes and applies the pairs read from consul
+func (c *Config[T]) reload(pairs consul.KVPairs) {
+	v, err := c.decode(pairs)
+	if err == nil && c.opts.Validate != nil {
+		err = c.opts.Validate(v)
+	}
+	if err != nil {
+		consulConfigReloadsTotal.WithLabelValues(c.opts.Key, "error").Inc()
+		logger.Printf("consul: reload config '%s' error, keep the last good value: %v", c.opts.Key, err)
+		return
+	}
+	consulConfigReloadsTotal.WithLabelValues(c.opts.Key, "success").Inc()
+
+	if c.set(v) && c.opts.Snapshot != "" {
+		if err := c.saveSnapshot(v); err != nil {
+			logger.Printf("consul: save config snapshot '%s' error: %v", c.opts.Snapshot, err)
+		}
+	}
+}
+
+// set stores v and calls OnChange, it reports whether the value changed
+func (c *Config[T]) set(v T) bool {
+	c.mu.Lock()
+	old := c.value
+	changed := !reflect.DeepEqual(old, v)
+	c.value = v
+	c.mu.Unlock()
+
+	c.readyOnce.Do(func() { close(c.ready) })
+	if changed && c.opts.OnChange != nil {
+		c.opts.OnChange(old, v)
+	}
+	return changed
+}
+
+// decode returns the defaults overridden by the document or the key tree
+func (c *Config[T]) decode(pairs consul.KVPairs) (T, error) {
+	v := c.newValue()
+	if !c.opts.Prefix {
+		if len(pairs) == 0 {
+			return v, nil
+		}
+		return v, unmarshalDocument(pairs[0].Value, &v)
+	}
+
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	prefix := strings.TrimSuffix(c.opts.Key, "/") + "/"
+	for _, p := range pairs {
+		// folder keys, created by the consul UI for example
+		if strings.HasSuffix(p.Key, "/") {
+			continue
+		}
+		path := strings.Split(strings.Trim(strings.TrimPrefix(p.Key, prefix), "/"), "/")
+		if len(path) == 1 && path[0] == "" {
+			continue
+		}
+		if err := setTreeValue(root, path, string(p.Value)); err != nil {
+			return v, fmt.Errorf("key %s: %v", p.Key, err)
+		}
+	}
+	return v, root.Decode(&v)
+}
+
+// unmarshalDocument decodes a JSON or YAML document, an empty one leaves v unchanged
+func unmarshalDocument(data []byte, v interface{}) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil
+	}
+	if data[0] == '{' || data[0] == '[' {
+		return json.Unmarshal(data, v)
+	}
+	return yaml.Unmarshal(data, v)
+}
+
+// setTreeValue sets the scalar at path in the mapping node, the type of the
+// scalar is resolved like a plain YAML value. An empty value and a folder of the
+// same name make a folder.
+func setTreeValue(node *yaml.Node, path []string, value string) error {
+	for i, name := range path {
+		var child *yaml.Node
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			if node.Content[j].Value == name {
+				child = node.Content[j+1]
+				break
+			}
+		}
+		last := i == len(path)-1
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode}
+			if last {
+				child = &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+			}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, child)
+		} else if last && child.Kind == yaml.MappingNode && value == "" {
+			return nil
+		} else if !last && child.Kind == yaml.ScalarNode && child.Value == "" {
+			*child = yaml.Node{Kind: yaml.MappingNode}
+		} else if last || child.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s is both a value and a folder", strings.Join(path[:i+1], "/"))
+		}
+		node = child
+	}
+	return nil
+}
+
+// loadSnapshot sets the value saved in the snapshot file
+func (c *Config[T]) loadSnapshot() error {
+	data, err := os.ReadFile(c.opts.Snapshot)
+	if err != nil {
+		return err
+	}
+	v := c.newValue()
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if c.opts.Validate != nil {
+		if err := c.opts.Validate(v); err != nil {
+			return err
+		}
+	}
+	c.set(v)
+	return nil
+}
+
+// saveSnapshot writes v to the snapshot file through a temporary file
+func (c *Config[T]) saveSnapshot(v T) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.opts.Snapshot), filepath.Base(c.opts.Snapshot)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.opts.Snapshot)
+}
@@ -0,0 +1,140 @@
+package consul_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rigoiot/pkg/consul"
+)
+
+type serviceConfig struct {
+	DB struct {
+		Host string `json:"host" yaml:"host"`
+		Port int    `json:"port" yaml:"port"`
+	} `json:"db" yaml:"db"`
+	Flags map[string]bool `json:"flags" yaml:"flags"`
+}
+
+type change struct{ old, new serviceConfig }
+
+func configOptions(key string, changes chan change) consul.ConfigOptions[serviceConfig] {
+	return consul.ConfigOptions[serviceConfig]{
+		Key: key,
+		Defaults: func(c *serviceConfig) {
+			c.DB.Host = "localhost"
+			c.DB.Port = 5432
+		},
+		Validate: func(c serviceConfig) error {
+			if c.DB.Port <= 0 {
+				return errors.New("invalid port")
+			}
+			return nil
+		},
+		OnChange: func(old, new serviceConfig) { changes <- change{old, new} },
+	}
+}
+
+func nextChange(t *testing.T, changes chan change) change {
+	t.Helper()
+
+	select {
+	case c := <-changes:
+		return c
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for config change")
+	}
+	return change{}
+}
+
+func TestConfigKey(t *testing.T) {
+	f := newFakeConsul(t)
+	f.putKV("config/device-service", []byte(`{"db": {"host": "10.0.0.1"}}`))
+
+	changes := make(chan change, 10)
+	c, err := consul.NewConfig(f.Addr(), configOptions("config/device-service", changes))
+	if err != nil {
+		t.Fatalf("NewConfig: %v", err)
+	}
+	defer c.Close()
+
+	ch := nextChange(t, changes)
+	if ch.old.DB.Host != "localhost" || ch.new.DB.Host != "10.0.0.1" || ch.new.DB.Port != 5432 {
+		t.Errorf("change = %+v", ch)
+	}
+	<-c.Ready()
+
+	// an invalid value is ignored
+	f.putKV("config/device-service", []byte("db: {port: -1}"))
+	f.putKV("config/device-service", []byte("db:\n  host: 10.0.0.2\nflags:\n  new_ui: true\n"))
+	ch = nextChange(t, changes)
+	if ch.old.DB.Host != "10.0.0.1" || ch.new.DB.Host != "10.0.0.2" || !ch.new.Flags["new_ui"] {
+		t.Errorf("change = %+v", ch)
+	}
+	if got := c.Get(); got.DB.Host != "10.0.0.2" {
+		t.Errorf("Get = %+v", got)
+	}
+}
+
+func TestConfigPrefix(t *testing.T) {
+	f := newFakeConsul(t)
+	// folders created by the consul UI
+	f.putKV("config/device-service/", nil)
+	f.putKV("config/device-service/db/", nil)
+	f.putKV("config/device-service/db/host", []byte("10.0.0.1"))
+	f.putKV("config/device-service/db/port", []byte("6432"))
+	// an empty value named like a folder
+	f.putKV("config/device-service/flags", nil)
+	f.putKV("config/device-service/flags/new_ui", []byte("true"))
+
+	changes := make(chan change, 10)
+	opts := configOptions("config/device-service", changes)
+	opts.Prefix = true
+	c, err := consul.NewConfig(f.Addr(), opts)
+	if err != nil {
+		t.Fatalf("NewConfig: %v", err)
+	}
+	defer c.Close()
+
+	ch := nextChange(t, changes)
+	if ch.new.DB.Host != "10.0.0.1" || ch.new.DB.Port != 6432 || !ch.new.Flags["new_ui"] {
+		t.Errorf("config = %+v", ch.new)
+	}
+}
+
+func TestConfigSnapshot(t *testing.T) {
+	f := newFakeConsul(t)
+	f.putKV("config/device-service", []byte(`{"db": {"host": "10.0.0.1", "port": 6432}}`))
+	snapshot := filepath.Join(t.TempDir(), "config.json")
+
+	changes := make(chan change, 10)
+	opts := configOptions("config/device-service", changes)
+	opts.Snapshot = snapshot
+	c, err := consul.NewConfig(f.Addr(), opts)
+	if err != nil {
+		t.Fatalf("NewConfig: %v", err)
+	}
+	nextChange(t, changes)
+	c.Close()
+	if _, err := os.Stat(snapshot); err != nil {
+		t.Fatalf("snapshot not saved: %v", err)
+	}
+
+	// cold start without consul
+	f.Close()
+	c, err = consul.NewConfig(f.Addr(), opts)
+	if err != nil {
+		t.Fatalf("NewConfig: %v", err)
+	}
+	defer c.Close()
+	select {
+	case <-c.Ready():
+	default:
+		t.Fatal("config not ready from the snapshot")
+	}
+	if got := c.Get(); got.DB.Host != "10.0.0.1" || got.DB.Port != 6432 {
+		t.Errorf("Get = %+v", got)
+	}
+}
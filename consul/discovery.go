@@ -0,0 +1,138 @@
+package consul
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Consistency is the consistency mode of the discovery queries
+type Consistency string
+
+// Consistency modes, see https://developer.hashicorp.com/consul/api-docs/features/consistency
+const (
+	ConsistencyDefault    Consistency = "default"
+	ConsistencyStale      Consistency = "stale"
+	ConsistencyConsistent Consistency = "consistent"
+)
+
+// Discovery selects the instances returned by the consul resolver,
+// it is read from the query parameters of the dial target:
+//
+//	tag          - required tag, repeated for several tags
+//	dc           - datacenter, the one of the agent by default
+//	node-meta    - required node metadata as "key:value", repeatable
+//	filter       - filter expression, e.g. Service.Meta.zone == "a"
+//	consistency  - default, stale or consistent
+//	fallback     - "warning" to use instances in warning state when none is passing
+type Discovery struct {
+	Tags              []string
+	Datacenter        string
+	NodeMeta          map[string]string
+	Filter            string
+	Consistency       Consistency
+	FallbackToWarning bool
+}
+
+// Target returns the dial target of service at the consul agent address with d
+func Target(agent, service string, d Discovery) string {
+	q := url.Values{}
+	for _, tag := range d.Tags {
+		q.Add("tag", tag)
+	}
+	if d.Datacenter != "" {
+		q.Set("dc", d.Datacenter)
+	}
+	keys := make([]string, 0, len(d.NodeMeta))
+	for k := range d.NodeMeta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		q.Add("node-meta", k+":"+d.NodeMeta[k])
+	}
+	if d.Filter != "" {
+		q.Set("filter", d.Filter)
+	}
+	if d.Consistency != "" && d.Consistency != ConsistencyDefault {
+		q.Set("consistency", string(d.Consistency))
+	}
+	if d.FallbackToWarning {
+		q.Set("fallback", consul.HealthWarning)
+	}
+
+	target := fmt.Sprintf("%s://%s/%s", Scheme, agent, service)
+	if len(q) > 0 {
+		target += "?" + q.Encode()
+	}
+	return target
+}
+
+// parseDiscovery reads the discovery options from the query parameters of a target
+func parseDiscovery(q url.Values) (Discovery, error) {
+	d := Discovery{
+		Tags:        q["tag"],
+		Datacenter:  q.Get("dc"),
+		Filter:      q.Get("filter"),
+		Consistency: Consistency(q.Get("consistency")),
+	}
+	for _, kv := range q["node-meta"] {
+		parts := strings.SplitN(kv, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return d, fmt.Errorf("consul: invalid node-meta %q, want key:value", kv)
+		}
+		if d.NodeMeta == nil {
+			d.NodeMeta = map[string]string{}
+		}
+		d.NodeMeta[parts[0]] = parts[1]
+	}
+	switch d.Consistency {
+	case "", ConsistencyDefault, ConsistencyStale, ConsistencyConsistent:
+	default:
+		return d, fmt.Errorf("consul: invalid consistency %q", d.Consistency)
+	}
+	switch fallback := q.Get("fallback"); fallback {
+	case "":
+	case consul.HealthWarning:
+		d.FallbackToWarning = true
+	default:
+		return d, fmt.Errorf("consul: invalid fallback %q", fallback)
+	}
+	return d, nil
+}
+
+// queryOptions returns the options of a discovery query waiting for index li
+func (d Discovery) queryOptions(li uint64) *consul.QueryOptions {
+	return &consul.QueryOptions{
+		Datacenter:        d.Datacenter,
+		NodeMeta:          d.NodeMeta,
+		Filter:            d.Filter,
+		AllowStale:        d.Consistency == ConsistencyStale,
+		RequireConsistent: d.Consistency == ConsistencyConsistent,
+		WaitIndex:         li,
+	}
+}
+
+// selectHealthy returns the passing entries, or the entries in warning state
+// when none is passing and the fallback is enabled
+func (d Discovery) selectHealthy(entries []*consul.ServiceEntry) []*consul.ServiceEntry {
+	if !d.FallbackToWarning {
+		return entries
+	}
+	var passing, warning []*consul.ServiceEntry
+	for _, e := range entries {
+		switch e.Checks.AggregatedStatus() {
+		case consul.HealthPassing:
+			passing = append(passing, e)
+		case consul.HealthWarning:
+			warning = append(warning, e)
+		}
+	}
+	if len(passing) > 0 {
+		return passing
+	}
+	return warning
+}
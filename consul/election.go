@@ -0,0 +1,368 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/rigoiot/pkg/logger"
+)
+
+var (
+	// ErrAlreadyCampaigning is returned by Campaign while a campaign runs or the candidate leads
+	ErrAlreadyCampaigning = errors.New("consul: already campaigning")
+
+	// ErrSessionLost is returned by Campaign when the session expires before the leadership is acquired
+	ErrSessionLost = errors.New("consul: session lost")
+)
+
+// defaultLockDelay is the lock delay of consul sessions when not set
+const defaultLockDelay = 15 * time.Second
+
+// ElectionOptions configures an Election
+type ElectionOptions struct {
+	// Client configures the ACL token, TLS and datacenter of the consul client
+	Client ClientConfig
+
+	// Value is stored in the key while leading, for example the host name of the replica
+	Value []byte
+
+	// TTL of the session, renewed every TTL/2, 15s by default. The leadership is lost
+	// when the session cannot be renewed in time.
+	TTL time.Duration
+
+	// LockDelay prevents acquiring the key after its holder's session was invalidated,
+	// 15s by default in consul
+	LockDelay time.Duration
+}
+
+// Election campaigns for the leadership of a key among the replicas of a service,
+// for example to run periodic jobs on exactly one of them
+type Election struct {
+	client *consul.Client
+	key    string
+	opts   ElectionOptions
+	watch  WatchConfig
+
+	mu      sync.Mutex
+	running bool  // a campaign is in progress
+	term    *term // the leadership held, nil when following
+	changes chan bool
+}
+
+// term is the leadership held with one session
+type term struct {
+	session string
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewElection returns the candidate of the election on key at the consul agent at target,
+// for example: "127.0.0.1:8500"
+func NewElection(target string, key string, opts ElectionOptions) (*Election, error) {
+	client, err := newClient(target, opts.Client)
+	if err != nil {
+		return nil, err
+	}
+	return newElection(client, key, opts), nil
+}
+
+func newElection(client *consul.Client, key string, opts ElectionOptions) *Election {
+	if opts.TTL <= 0 {
+		opts.TTL = 15 * time.Second
+	}
+	return &Election{
+		client:  client,
+		key:     key,
+		opts:    opts,
+		watch:   DefaultWatchConfig,
+		changes: make(chan bool, 1),
+	}
+}
+
+// Leadership returns the channel of the leadership changes, true when elected and false
+// when the leadership is resigned or lost. Only the latest change is kept until received.
+func (e *Election) Leadership() <-chan bool {
+	return e.changes
+}
+
+// IsLeader reports whether the candidate currently leads
+func (e *Election) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.term != nil
+}
+
+// notify sends the leadership change, replacing an unreceived one, e.mu must be held
+func (e *Election) notify(leader bool) {
+	select {
+	case <-e.changes:
+	default:
+	}
+	e.changes <- leader
+}
+
+// Campaign blocks until the candidate leads or ctx is done. The leadership is kept
+// until Resign or its loss, reported by Leadership, after which Campaign can be called again.
+func (e *Election) Campaign(ctx context.Context) error {
+	e.mu.Lock()
+	if e.running || e.term != nil {
+		e.mu.Unlock()
+		return ErrAlreadyCampaigning
+	}
+	e.running = true
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		e.running = false
+		e.mu.Unlock()
+	}()
+
+	id, _, err := e.client.Session().Create(&consul.SessionEntry{
+		Name:      e.key,
+		TTL:       e.opts.TTL.String(),
+		LockDelay: e.opts.LockDelay,
+		Behavior:  consul.SessionBehaviorRelease,
+	}, (&consul.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("consul: create session error: %v", err)
+	}
+
+	t := &term{session: id}
+	tctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	t.wg.Add(1)
+	go e.renew(tctx, t)
+
+	if err := e.acquire(ctx, tctx, id); err != nil {
+		cancel()
+		t.wg.Wait()
+		e.client.Session().Destroy(id, nil)
+		return err
+	}
+
+	e.mu.Lock()
+	e.term = t
+	e.notify(true)
+	e.mu.Unlock()
+
+	t.wg.Add(1)
+	go e.monitor(tctx, t)
+	return nil
+}
+
+// acquire blocks until the key is acquired with session id, parent is done
+// or the session is lost (tctx done)
+func (e *Election) acquire(parent, tctx context.Context, id string) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	stop := context.AfterFunc(tctx, cancel)
+	defer stop()
+
+	interrupted := func() error {
+		if err := parent.Err(); err != nil {
+			return err
+		}
+		return ErrSessionLost
+	}
+
+	var (
+		li       uint64 // LastIndex to watch consul
+		failures int    // consecutive errors
+	)
+	for {
+		wo := (&consul.WriteOptions{}).WithContext(ctx)
+		acquired, _, err := e.client.KV().Acquire(&consul.KVPair{Key: e.key, Value: e.opts.Value, Session: id}, wo)
+		if err == nil && acquired {
+			return nil
+		}
+
+		var pair *consul.KVPair
+		var meta *consul.QueryMeta
+		if err == nil {
+			q := (&consul.QueryOptions{WaitIndex: li}).WithContext(ctx)
+			pair, meta, err = e.client.KV().Get(e.key, q)
+		}
+		if ctx.Err() != nil {
+			return interrupted()
+		}
+		if err != nil {
+			logger.Printf("consul: campaign for '%s' error: %v", e.key, err)
+			if !e.sleep(ctx, e.watch.backoff(failures)) {
+				return interrupted()
+			}
+			failures++
+			continue
+		}
+		failures = 0
+
+		if pair == nil || pair.Session == "" {
+			// the key is free but was not acquired: the lock delay of the
+			// previous holder is in effect
+			li = 0
+			if !e.sleep(ctx, e.lockDelay()) {
+				return interrupted()
+			}
+			continue
+		}
+		// held by another session, wait for the key to change
+		li = meta.LastIndex
+	}
+}
+
+func (e *Election) lockDelay() time.Duration {
+	if e.opts.LockDelay > 0 {
+		return e.opts.LockDelay
+	}
+	return defaultLockDelay
+}
+
+// sleep waits for d, it returns false when ctx is done first
+func (e *Election) sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// renew is the routine renewing the session of t every TTL/2
+// until tctx is done, the leadership is lost when the session expires
+func (e *Election) renew(tctx context.Context, t *term) {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(e.opts.TTL / 2)
+	defer ticker.Stop()
+	lastRenew := time.Now()
+	for {
+		select {
+		case <-tctx.Done():
+			return
+		case <-ticker.C:
+		}
+		entry, _, err := e.client.Session().Renew(t.session, (&consul.WriteOptions{}).WithContext(tctx))
+		if tctx.Err() != nil {
+			return
+		}
+		switch {
+		case err != nil && time.Since(lastRenew) < e.opts.TTL:
+			logger.Printf("consul: renew session of '%s' error: %v", e.key, err)
+		case err != nil:
+			e.lose(t, fmt.Sprintf("session not renewed: %v", err))
+			return
+		case entry == nil:
+			e.lose(t, "session expired")
+			return
+		default:
+			lastRenew = time.Now()
+		}
+	}
+}
+
+// monitor is the routine watching the key while leading,
+// the leadership is lost when the key is no longer held by the session
+func (e *Election) monitor(tctx context.Context, t *term) {
+	defer t.wg.Done()
+
+	var (
+		li       uint64 // LastIndex to watch consul
+		failures int    // consecutive errors
+	)
+	for {
+		q := (&consul.QueryOptions{WaitIndex: li}).WithContext(tctx)
+		pair, meta, err := e.client.KV().Get(e.key, q)
+		if tctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Printf("consul: watch leadership of '%s' error: %v", e.key, err)
+			if !e.sleep(tctx, e.watch.backoff(failures)) {
+				return
+			}
+			failures++
+			continue
+		}
+		failures = 0
+		if pair == nil || pair.Session != t.session {
+			e.lose(t, "key released")
+			return
+		}
+		li = meta.LastIndex
+	}
+}
+
+// lose ends the leadership t, it is called from the routines of t
+func (e *Election) lose(t *term, reason string) {
+	t.cancel()
+	e.mu.Lock()
+	if e.term != t {
+		// resigned meanwhile
+		e.mu.Unlock()
+		return
+	}
+	e.term = nil
+	e.notify(false)
+	e.mu.Unlock()
+
+	logger.Printf("consul: leadership of '%s' lost: %s", e.key, reason)
+	e.client.Session().Destroy(t.session, nil)
+}
+
+// Resign releases the key and destroys the session if the candidate leads
+func (e *Election) Resign() error {
+	e.mu.Lock()
+	t := e.term
+	e.term = nil
+	if t != nil {
+		e.notify(false)
+	}
+	e.mu.Unlock()
+	if t == nil {
+		return nil
+	}
+
+	t.cancel()
+	t.wg.Wait()
+	_, _, err := e.client.KV().Release(&consul.KVPair{Key: e.key, Value: e.opts.Value, Session: t.session}, nil)
+	if _, derr := e.client.Session().Destroy(t.session, nil); err == nil {
+		err = derr
+	}
+	if err != nil {
+		return fmt.Errorf("consul: resign '%s' error: %v", e.key, err)
+	}
+	return nil
+}
+
+// Locker provides distributed mutexes on one consul agent
+type Locker struct {
+	client *consul.Client
+	opts   ElectionOptions
+}
+
+// NewLocker returns the locker of the consul agent at target, for example: "127.0.0.1:8500",
+// opts apply to the sessions holding the locks
+func NewLocker(target string, opts ElectionOptions) (*Locker, error) {
+	client, err := newClient(target, opts.Client)
+	if err != nil {
+		return nil, err
+	}
+	return &Locker{client: client, opts: opts}, nil
+}
+
+// Lock blocks until the mutex key is held or ctx is done. The returned election
+// holds the lock: Resign unlocks it and Leadership reports its loss.
+func (l *Locker) Lock(ctx context.Context, key string) (*Election, error) {
+	e := newElection(l.client, key, l.opts)
+	if err := e.Campaign(ctx); err != nil {
+		return nil, err
+	}
+	// the caller knows it holds the lock
+	<-e.changes
+	return e, nil
+}
@@ -0,0 +1,187 @@
+package consul_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rigoiot/pkg/consul"
+)
+
+var electionOptions = consul.ElectionOptions{TTL: 200 * time.Millisecond, LockDelay: 100 * time.Millisecond}
+
+func newElection(t *testing.T, f *fakeConsul, value string) *consul.Election {
+	t.Helper()
+	opts := electionOptions
+	opts.Value = []byte(value)
+	e, err := consul.NewElection(f.Addr(), "service/device/leader", opts)
+	if err != nil {
+		t.Fatalf("NewElection: %v", err)
+	}
+	return e
+}
+
+// leadership returns the next leadership change of e
+func leadership(t *testing.T, e *consul.Election) bool {
+	t.Helper()
+	select {
+	case leader := <-e.Leadership():
+		return leader
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for leadership change")
+	}
+	return false
+}
+
+func TestElection(t *testing.T) {
+	f := newFakeConsul(t)
+	a := newElection(t, f, "a")
+	b := newElection(t, f, "b")
+
+	if err := a.Campaign(context.Background()); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+	if !leadership(t, a) || !a.IsLeader() {
+		t.Fatal("a does not lead")
+	}
+	if err := a.Campaign(context.Background()); !errors.Is(err, consul.ErrAlreadyCampaigning) {
+		t.Errorf("second Campaign error = %v, want ErrAlreadyCampaigning", err)
+	}
+
+	elected := make(chan error, 1)
+	go func() { elected <- b.Campaign(context.Background()) }()
+	select {
+	case err := <-elected:
+		t.Fatalf("b elected while a leads: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// the session is renewed while leading
+	if f.renewals(f.holder("service/device/leader")) == 0 {
+		t.Error("session not renewed")
+	}
+
+	if err := a.Resign(); err != nil {
+		t.Fatalf("Resign: %v", err)
+	}
+	if leadership(t, a) || a.IsLeader() {
+		t.Error("a still leads after Resign")
+	}
+	select {
+	case err := <-elected:
+		if err != nil {
+			t.Fatalf("Campaign: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("b not elected after a resigned")
+	}
+	if !leadership(t, b) {
+		t.Error("b does not lead")
+	}
+	b.Resign()
+}
+
+func TestElectionSessionLost(t *testing.T) {
+	f := newFakeConsul(t)
+	a := newElection(t, f, "a")
+	b := newElection(t, f, "b")
+
+	if err := a.Campaign(context.Background()); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+	leadership(t, a)
+
+	elected := make(chan time.Time, 1)
+	go func() {
+		if err := b.Campaign(context.Background()); err == nil {
+			elected <- time.Now()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	expired := time.Now()
+	f.expireSession(f.holder("service/device/leader"))
+	if leadership(t, a) {
+		t.Error("a still leads after its session expired")
+	}
+
+	select {
+	case at := <-elected:
+		// the lock delay of the expired session is respected
+		if d := at.Sub(expired); d < electionOptions.LockDelay {
+			t.Errorf("b elected %v after the expiry, want at least the lock delay", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("b not elected after the session of a expired")
+	}
+	b.Resign()
+
+	// a can campaign again
+	if err := a.Campaign(context.Background()); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+	a.Resign()
+}
+
+func TestElectionCampaignCanceled(t *testing.T) {
+	f := newFakeConsul(t)
+	a := newElection(t, f, "a")
+	b := newElection(t, f, "b")
+
+	if err := a.Campaign(context.Background()); err != nil {
+		t.Fatalf("Campaign: %v", err)
+	}
+	defer a.Resign()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.Campaign(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Campaign error = %v, want context.DeadlineExceeded", err)
+	}
+	if b.IsLeader() {
+		t.Error("b leads after a canceled campaign")
+	}
+}
+
+func TestLocker(t *testing.T) {
+	f := newFakeConsul(t)
+	l, err := consul.NewLocker(f.Addr(), electionOptions)
+	if err != nil {
+		t.Fatalf("NewLocker: %v", err)
+	}
+
+	lock, err := l.Lock(context.Background(), "locks/firmware")
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	locked := make(chan *consul.Election, 1)
+	go func() {
+		if lock, err := l.Lock(context.Background(), "locks/firmware"); err == nil {
+			locked <- lock
+		}
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock held twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// other keys are independent
+	other, err := l.Lock(context.Background(), "locks/other")
+	if err != nil {
+		t.Fatalf("Lock other key: %v", err)
+	}
+	other.Resign()
+
+	if err := lock.Resign(); err != nil {
+		t.Fatalf("Resign: %v", err)
+	}
+	select {
+	case lock := <-locked:
+		lock.Resign()
+	case <-time.After(2 * time.Second):
+		t.Fatal("lock not acquired after unlock")
+	}
+}
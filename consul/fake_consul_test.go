@@ -0,0 +1,439 @@
+package consul_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// fakeConsul is a local consul HTTP agent keeping its state in memory
+type fakeConsul struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	services map[string]*consul.AgentServiceRegistration
+	tokens   map[string]string   // service id -> ACL token of the registration
+	checks   map[string][]string // check id -> statuses received by check/update
+	outputs  map[string]string   // check id -> last output received by check/update
+	status   map[string]string   // service id -> health status, passing by default
+
+	kv        map[string]*consul.KVPair
+	sessions  map[string]*fakeSession
+	lockUntil map[string]time.Time // key -> end of the lock delay
+	lastQuery url.Values           // query parameters of the last health query
+	failing   bool                 // health queries fail with 500
+
+	// index is the raft index of the catalog, changed is closed when it moves
+	index   uint64
+	changed chan struct{}
+}
+
+func newFakeConsul(t *testing.T) *fakeConsul {
+	t.Helper()
+
+	f := &fakeConsul{
+		services:  map[string]*consul.AgentServiceRegistration{},
+		tokens:    map[string]string{},
+		checks:    map[string][]string{},
+		outputs:   map[string]string{},
+		status:    map[string]string{},
+		kv:        map[string]*consul.KVPair{},
+		sessions:  map[string]*fakeSession{},
+		lockUntil: map[string]time.Time{},
+		index:     1,
+		changed:   make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/service/register", f.serviceRegister)
+	mux.HandleFunc("/v1/agent/service/deregister/", f.serviceDeregister)
+	mux.HandleFunc("/v1/agent/check/update/", f.checkUpdate)
+	mux.HandleFunc("/v1/health/service/", f.healthService)
+	mux.HandleFunc("/v1/kv/", f.kvHandler)
+	mux.HandleFunc("/v1/session/create", f.sessionCreate)
+	mux.HandleFunc("/v1/session/renew/", f.sessionRenew)
+	mux.HandleFunc("/v1/session/destroy/", f.sessionDestroy)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// Addr returns the dial address of the agent, e.g. "127.0.0.1:8500"
+func (f *fakeConsul) Addr() string {
+	return strings.TrimPrefix(f.URL, "http://")
+}
+
+func (f *fakeConsul) serviceRegister(w http.ResponseWriter, r *http.Request) {
+	var s consul.AgentServiceRegistration
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.services[s.ID] = &s
+	f.tokens[s.ID] = r.Header.Get("X-Consul-Token")
+	f.bump()
+}
+
+func (f *fakeConsul) serviceDeregister(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.services[id]; !ok {
+		http.Error(w, "Unknown service ID "+id, http.StatusNotFound)
+		return
+	}
+	delete(f.services, id)
+	f.bump()
+}
+
+func (f *fakeConsul) checkUpdate(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/update/")
+	var update struct{ Status, Output string }
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checks[id] = append(f.checks[id], update.Status)
+	f.outputs[id] = update.Output
+}
+
+// service returns the registration of id, nil if it is not registered
+func (f *fakeConsul) service(id string) *consul.AgentServiceRegistration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.services[id]
+}
+
+// ttlUpdates returns the number of TTL updates received for check id
+func (f *fakeConsul) ttlUpdates(id string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.checks[id])
+}
+
+// lastUpdate returns the status and output of the last update of check id
+func (f *fakeConsul) lastUpdate(id string) (string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	statuses := f.checks[id]
+	if len(statuses) == 0 {
+		return "", ""
+	}
+	return statuses[len(statuses)-1], f.outputs[id]
+}
+
+// token returns the ACL token used to register service id
+func (f *fakeConsul) token(id string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tokens[id]
+}
+
+// bump moves the index and wakes the blocking queries, f.mu must be held
+func (f *fakeConsul) bump() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// query returns the query parameters of the last health query
+func (f *fakeConsul) query() url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastQuery
+}
+
+// setFailing makes the health queries fail, blocking queries in progress return an error
+func (f *fakeConsul) setFailing(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+	f.bump()
+}
+
+// setStatus sets the health status of service id
+func (f *fakeConsul) setStatus(id, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status[id] = status
+	f.bump()
+}
+
+// healthService answers blocking health queries from the registered services
+func (f *fakeConsul) healthService(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	q := r.URL.Query()
+	waitIndex, _ := strconv.ParseUint(q.Get("index"), 10, 64)
+
+	f.mu.Lock()
+	f.lastQuery = q
+	if waitIndex >= f.index && !f.failing {
+		changed := f.changed
+		f.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+		f.mu.Lock()
+	}
+	defer f.mu.Unlock()
+	if f.failing {
+		http.Error(w, "No cluster leader", http.StatusInternalServerError)
+		return
+	}
+
+	entries := []*consul.ServiceEntry{}
+	for id, s := range f.services {
+		if s.Name != name || !hasTags(s.Tags, q["tag"]) {
+			continue
+		}
+		status := f.status[id]
+		if status == "" {
+			status = consul.HealthPassing
+		}
+		if q.Get("passing") != "" && status != consul.HealthPassing {
+			continue
+		}
+		weights := consul.AgentWeights{Passing: 1, Warning: 1}
+		if s.Weights != nil {
+			weights = *s.Weights
+		}
+		entries = append(entries, &consul.ServiceEntry{
+			Node: &consul.Node{Node: "node1", Address: "192.168.0.1", Datacenter: "dc1"},
+			Service: &consul.AgentService{
+				ID: id, Service: s.Name, Tags: s.Tags, Meta: s.Meta,
+				Address: s.Address, Port: s.Port, Weights: weights,
+			},
+			Checks: consul.HealthChecks{{CheckID: id, ServiceID: id, Status: status}},
+		})
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	json.NewEncoder(w).Encode(entries)
+}
+
+func hasTags(tags, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, t := range tags {
+			found = found || t == w
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// wait blocks until the index moves past waitIndex, a timeout or the end of r,
+// it returns with f.mu held unless r ended
+func (f *fakeConsul) wait(r *http.Request, waitIndex uint64) bool {
+	f.mu.Lock()
+	if waitIndex < f.index {
+		return true
+	}
+	changed := f.changed
+	f.mu.Unlock()
+	select {
+	case <-changed:
+	case <-r.Context().Done():
+		return false
+	case <-time.After(5 * time.Second):
+	}
+	f.mu.Lock()
+	return true
+}
+
+// kvHandler serves the KV store: GET with blocking queries, PUT and DELETE
+func (f *fakeConsul) kvHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	q := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		waitIndex, _ := strconv.ParseUint(q.Get("index"), 10, 64)
+		if !f.wait(r, waitIndex) {
+			return
+		}
+		defer f.mu.Unlock()
+
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		var pairs []*consul.KVPair
+		for k, pair := range f.kv {
+			if k == key || (q.Has("recurse") && strings.HasPrefix(k, key)) {
+				pairs = append(pairs, pair)
+			}
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+	case http.MethodPut:
+		value, _ := io.ReadAll(r.Body)
+		switch {
+		case q.Has("acquire"):
+			fmt.Fprint(w, f.acquireKV(key, value, q.Get("acquire")))
+		case q.Has("release"):
+			fmt.Fprint(w, f.releaseKV(key, value, q.Get("release")))
+		default:
+			f.putKV(key, value)
+			w.Write([]byte("true"))
+		}
+	case http.MethodDelete:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.kv, key)
+		f.bump()
+	}
+}
+
+// putKV sets the value of key
+func (f *fakeConsul) putKV(key string, value []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bump()
+	pair, ok := f.kv[key]
+	if !ok {
+		pair = &consul.KVPair{Key: key, CreateIndex: f.index}
+		f.kv[key] = pair
+	}
+	pair.Value, pair.ModifyIndex = value, f.index
+}
+
+// fakeSession is a session created on the agent
+type fakeSession struct {
+	ttl       time.Duration
+	lockDelay time.Duration
+	renewals  int
+}
+
+func (f *fakeConsul) sessionCreate(w http.ResponseWriter, r *http.Request) {
+	var body struct{ TTL, LockDelay string }
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := &fakeSession{lockDelay: 15 * time.Second}
+	s.ttl, _ = time.ParseDuration(body.TTL)
+	if body.LockDelay != "" {
+		s.lockDelay, _ = time.ParseDuration(body.LockDelay)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := fmt.Sprintf("session-%d", len(f.sessions)+1)
+	f.sessions[id] = s
+	json.NewEncoder(w).Encode(map[string]string{"ID": id})
+}
+
+func (f *fakeConsul) sessionRenew(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.sessions[id]
+	if !ok {
+		http.Error(w, "Session id '"+id+"' not found", http.StatusNotFound)
+		return
+	}
+	s.renewals++
+	json.NewEncoder(w).Encode([]*consul.SessionEntry{{ID: id, TTL: s.ttl.String(), LockDelay: s.lockDelay}})
+}
+
+func (f *fakeConsul) sessionDestroy(w http.ResponseWriter, r *http.Request) {
+	f.expireSession(strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+	w.Write([]byte("true"))
+}
+
+// expireSession invalidates session id: the keys it holds are released
+// and cannot be acquired during its lock delay
+func (f *fakeConsul) expireSession(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.sessions[id]
+	if !ok {
+		return
+	}
+	delete(f.sessions, id)
+	for key, pair := range f.kv {
+		if pair.Session == id {
+			pair.Session = ""
+			f.lockUntil[key] = time.Now().Add(s.lockDelay)
+		}
+	}
+	f.bump()
+}
+
+// renewals returns the number of renewals of session id
+func (f *fakeConsul) renewals(id string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.sessions[id]; ok {
+		return s.renewals
+	}
+	return 0
+}
+
+// holder returns the session holding key, empty if none
+func (f *fakeConsul) holder(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pair, ok := f.kv[key]; ok {
+		return pair.Session
+	}
+	return ""
+}
+
+// acquireKV locks key with session id unless it is held by another session
+// or within the lock delay of its previous holder
+func (f *fakeConsul) acquireKV(key string, value []byte, id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.sessions[id]; !ok {
+		return false
+	}
+	pair, ok := f.kv[key]
+	if ok && pair.Session != "" && pair.Session != id {
+		return false
+	}
+	if time.Now().Before(f.lockUntil[key]) {
+		return false
+	}
+	f.bump()
+	if !ok {
+		pair = &consul.KVPair{Key: key, CreateIndex: f.index}
+		f.kv[key] = pair
+	}
+	if pair.Session != id {
+		pair.LockIndex++
+	}
+	pair.Value, pair.Session, pair.ModifyIndex = value, id, f.index
+	return true
+}
+
+// releaseKV unlocks key if it is held by session id
+func (f *fakeConsul) releaseKV(key string, value []byte, id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pair, ok := f.kv[key]
+	if !ok || pair.Session != id {
+		return false
+	}
+	f.bump()
+	pair.Value, pair.Session, pair.ModifyIndex = value, "", f.index
+	return true
+}
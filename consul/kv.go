@@ -0,0 +1,141 @@
+package consul
+
+import (
+	"context"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/rigoiot/pkg/logger"
+)
+
+// KVWatcher calls its handler with the value of a consul key, or the pairs under
+// a prefix, each time it changes
+type KVWatcher struct {
+	client  *consul.Client
+	key     string
+	prefix  bool
+	handler func(pairs consul.KVPairs)
+	conf    WatchConfig
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// WatchKey watches key on the consul agent at target, for example: "127.0.0.1:8500",
+// until Close. handler is called from the watch goroutine with the current value and
+// then with each change, value is nil when the key does not exist.
+func WatchKey(target string, conf ClientConfig, key string, handler func(value []byte)) (*KVWatcher, error) {
+	return newKVWatcher(target, conf, key, false, func(pairs consul.KVPairs) {
+		var value []byte
+		if len(pairs) > 0 {
+			value = pairs[0].Value
+		}
+		handler(value)
+	})
+}
+
+// WatchPrefix watches the keys under prefix like WatchKey, handler is called with
+// all the pairs under prefix when any of them changes
+func WatchPrefix(target string, conf ClientConfig, prefix string, handler func(pairs consul.KVPairs)) (*KVWatcher, error) {
+	return newKVWatcher(target, conf, prefix, true, handler)
+}
+
+func newKVWatcher(target string, conf ClientConfig, key string, prefix bool, handler func(consul.KVPairs)) (*KVWatcher, error) {
+	client, err := newClient(target, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &KVWatcher{
+		client:  client,
+		key:     key,
+		prefix:  prefix,
+		handler: handler,
+		conf:    DefaultWatchConfig,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go w.watch()
+	return w, nil
+}
+
+// Close stops watching, it cancels the running blocking query and waits for the watch goroutine
+func (w *KVWatcher) Close() {
+	w.cancel()
+	<-w.done
+}
+
+// watch is the routine querying consul until the watcher is closed
+func (w *KVWatcher) watch() {
+	defer close(w.done)
+
+	var (
+		li       uint64 // LastIndex to watch consul
+		failures int    // consecutive errors
+		modified uint64 // index of the pairs handed to handler
+		handled  bool
+	)
+	for {
+		pairs, meta, err := w.query(li)
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			consulKVWatchErrorsTotal.WithLabelValues(w.key).Inc()
+			logger.Printf("consul: watch key '%s' error: %v", w.key, err)
+			w.sleep(w.conf.backoff(failures))
+			failures++
+			continue
+		}
+		failures = 0
+
+		// consul may reset the index, start over if it goes backwards
+		if meta.LastIndex < li {
+			li = 0
+		} else {
+			li = meta.LastIndex
+		}
+
+		// the index of a prefix moves with any change under it,
+		// a single key is compared by its ModifyIndex
+		index := meta.LastIndex
+		if !w.prefix {
+			index = 0
+			if len(pairs) > 0 {
+				index = pairs[0].ModifyIndex
+			}
+		}
+		if handled && index == modified {
+			// the blocking query timed out or another key changed
+			continue
+		}
+		handled, modified = true, index
+		w.handler(pairs)
+	}
+}
+
+// query reads the key or the prefix, blocking until the index moves past li
+func (w *KVWatcher) query(li uint64) (consul.KVPairs, *consul.QueryMeta, error) {
+	q := (&consul.QueryOptions{WaitIndex: li, WaitTime: w.conf.WaitTime}).WithContext(w.ctx)
+	if w.prefix {
+		return w.client.KV().List(w.key, q)
+	}
+	pair, meta, err := w.client.KV().Get(w.key, q)
+	if pair == nil {
+		return nil, meta, err
+	}
+	return consul.KVPairs{pair}, meta, err
+}
+
+// sleep waits for d or Close
+func (w *KVWatcher) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-w.ctx.Done():
+	}
+}
@@ -0,0 +1,43 @@
+package consul_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rigoiot/pkg/consul"
+)
+
+func TestWatchKey(t *testing.T) {
+	f := newFakeConsul(t)
+	f.putKV("config/device-service", []byte("v1"))
+
+	values := make(chan []byte, 10)
+	w, err := consul.WatchKey(f.Addr(), consul.ClientConfig{}, "config/device-service", func(value []byte) {
+		values <- value
+	})
+	if err != nil {
+		t.Fatalf("WatchKey: %v", err)
+	}
+	defer w.Close()
+
+	next := func() string {
+		t.Helper()
+		select {
+		case v := <-values:
+			return string(v)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for value")
+		}
+		return ""
+	}
+	if v := next(); v != "v1" {
+		t.Errorf("value = %q, want v1", v)
+	}
+
+	// changes of other keys are not reported
+	f.putKV("config/other", []byte("x"))
+	f.putKV("config/device-service", []byte("v2"))
+	if v := next(); v != "v2" {
+		t.Errorf("value = %q, want v2", v)
+	}
+}
@@ -0,0 +1,40 @@
+package consul
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	consulWatchErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "consul_watch_errors_total",
+			Help: "Total number of failed consul discovery queries",
+		},
+		[]string{"service"},
+	)
+
+	consulWatchLastSync = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "consul_watch_last_sync_timestamp_seconds",
+			Help: "Unix time of the last successful consul discovery query",
+		},
+		[]string{"service"},
+	)
+
+	consulKVWatchErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "consul_kv_watch_errors_total",
+			Help: "Total number of failed consul KV queries",
+		},
+		[]string{"key"},
+	)
+
+	consulConfigReloadsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "consul_config_reloads_total",
+			Help: "Total number of consul KV config reloads",
+		},
+		[]string{"key", "result"},
+	)
+)
@@ -1,15 +1,18 @@
 package consul
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
-	"os/signal"
+	"net"
 	"strconv"
-	"syscall"
+	"strings"
+	"sync"
 	"time"
 
 	consul "github.com/hashicorp/consul/api"
 	"github.com/rigoiot/pkg/logger"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 // Register is the helper function to self-register service into Etcd/Consul server
@@ -19,69 +22,353 @@ import (
 // target - consul dial address, for example: "127.0.0.1:8500"
 // interval - interval of self-register to etcd
 // ttl - ttl of the register information
+//
+// Deprecated: use NewRegistration, the service registered by Register is never deregistered
+// and only expires with its TTL check.
 func Register(name string, host string, port int, target string, interval time.Duration, ttl int) error {
-	conf := &consul.Config{Scheme: "http", Address: target}
-	client, err := consul.NewClient(conf)
+	r, err := NewRegistration(name, host, port, target, interval, ttl)
 	if err != nil {
-		return fmt.Errorf("consul: create consul client error: %v", err)
+		return err
 	}
+	return r.Start(context.Background())
+}
+
+// Registration is a service instance registered into consul with its health checks,
+// TTL checks are updated in the background: passing, or the status of the gRPC health
+// server and the probes when given. The library handles no signal, the owner typically
+// calls Start when serving and Deregister before grpc.Server.GracefulStop.
+type Registration struct {
+	client   *consul.Client
+	service  *consul.AgentServiceRegistration
+	interval time.Duration
+	ttlCheck string // id of the TTL check, empty if none
+
+	healthServer  healthpb.HealthServer
+	healthService string
+	probes        []namedProbe
+	drainDelay    time.Duration
 
-	serviceID := fmt.Sprintf("%s-%s-%d", name, host, port)
+	mu      sync.Mutex
+	started bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewRegistration returns the registration of service name at host:port
+// target - consul dial address, for example: "127.0.0.1:8500"
+// interval - interval of the TTL check updates
+// ttl - ttl of the check in seconds, the service turns critical when not updated in time
+// opts - tags, meta, weights, checks replacing the TTL check and client settings
+func NewRegistration(name string, host string, port int, target string, interval time.Duration, ttl int, opts ...RegisterOption) (*Registration, error) {
+	o := &registerOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if len(o.checks) == 0 {
+		o.checks = []Check{TTLCheck(time.Duration(ttl) * time.Second)}
+	}
 
-	//de-register if meet signhup
-	go func() {
-		ch := make(chan os.Signal, 1)
-		signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL, syscall.SIGHUP, syscall.SIGQUIT)
-		x := <-ch
-		logger.Println("consul: receive signal: ", x)
+	client, err := newClient(target, o.client)
+	if err != nil {
+		return nil, err
+	}
 
-		err := client.Agent().ServiceDeregister(serviceID)
+	r := &Registration{
+		client:        client,
+		interval:      interval,
+		healthServer:  o.healthServer,
+		healthService: o.healthService,
+		probes:        o.probes,
+		drainDelay:    o.drainDelay,
+		service: &consul.AgentServiceRegistration{
+			ID:      fmt.Sprintf("%s-%s-%d", name, host, port),
+			Name:    name,
+			Address: host,
+			Port:    port,
+			Tags:    o.tags,
+			Meta:    o.meta,
+			Weights: o.weights,
+		},
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	for i, c := range o.checks {
+		check, err := c.agentCheck(address)
 		if err != nil {
-			logger.Println("consul: deregister service error: ", err.Error())
-		} else {
-			logger.Println("consul: deregistered service from consul server.")
+			return nil, err
 		}
+		// the first check keeps the service id for compatibility with Register
+		check.CheckID = r.service.ID
+		if i > 0 {
+			check.CheckID = fmt.Sprintf("%s:%d", r.service.ID, i+1)
+		}
+		check.Name = fmt.Sprintf("%s %s", name, c.Type)
+		if o.deregisterAfter > 0 {
+			check.DeregisterCriticalServiceAfter = o.deregisterAfter.String()
+		}
+		if c.Type == CheckTTL {
+			if r.ttlCheck != "" {
+				return nil, errors.New("consul: only one TTL check is supported")
+			}
+			if interval <= 0 {
+				return nil, errors.New("consul: registration interval must be positive")
+			}
+			r.ttlCheck = check.CheckID
+		}
+		r.service.Checks = append(r.service.Checks, check)
+	}
+	if (r.healthServer != nil || len(r.probes) > 0) && r.ttlCheck == "" {
+		return nil, errors.New("consul: the health server and probes require a TTL check")
+	}
+	return r, nil
+}
 
-		err = client.Agent().CheckDeregister(serviceID)
-		if err != nil {
-			logger.Println("consul: deregister check error: ", err.Error())
+// ID returns the consul service id, "<name>-<host>-<port>"
+func (r *Registration) ID() string {
+	return r.service.ID
+}
+
+// Start registers the service and its checks, then updates the TTL check every interval
+// until ctx is done or Deregister is called
+func (r *Registration) Start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started {
+		return errors.New("consul: registration already started")
+	}
+
+	var status, output string
+	if r.ttlCheck != "" {
+		// register with the current status rather than passing
+		status, output = r.health(ctx)
+		r.service.Checks[r.ttlCheckIndex()].Status = status
+	}
+	err := r.client.Agent().ServiceRegisterOpts(r.service, consul.ServiceRegisterOpts{}.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("consul: initial register service '%s' host to consul error: %v", r.service.Name, err)
+	}
+
+	r.started = true
+	if r.ttlCheck != "" {
+		if output != "" {
+			r.updateTTL(ctx, status, output)
 		}
+		ctx, r.cancel = context.WithCancel(ctx)
+		r.done = make(chan struct{})
+		go r.keepTTL(ctx, r.done)
+	}
+	return nil
+}
 
-		s, _ := strconv.Atoi(fmt.Sprintf("%d", x))
+// ttlCheckIndex returns the index of the TTL check in the registration
+func (r *Registration) ttlCheckIndex() int {
+	for i, c := range r.service.Checks {
+		if c.CheckID == r.ttlCheck {
+			return i
+		}
+	}
+	return -1
+}
 
-		os.Exit(s)
-	}()
+// keepTTL is the routine to update ttl, it closes done when ctx is done
+func (r *Registration) keepTTL(ctx context.Context, done chan struct{}) {
+	defer close(done)
 
-	// routine to update ttl
-	go func() {
-		ticker := time.NewTicker(interval)
-		for {
-			<-ticker.C
-			err = client.Agent().UpdateTTL(serviceID, "", "passing")
-			if err != nil {
-				logger.Println("consul: update ttl of service error: ", err.Error())
-			}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-	}()
+		status, output := r.health(ctx)
+		r.updateTTL(ctx, status, output)
+	}
+}
 
-	// initial register service
-	regis := &consul.AgentServiceRegistration{
-		ID:      serviceID,
-		Name:    name,
-		Address: host,
-		Port:    port,
+// updateTTL sets the status and output of the TTL check
+func (r *Registration) updateTTL(ctx context.Context, status, output string) {
+	q := (&consul.QueryOptions{}).WithContext(ctx)
+	err := r.client.Agent().UpdateTTLOpts(r.ttlCheck, output, status, q)
+	if err != nil && ctx.Err() == nil {
+		logger.Println("consul: update ttl of service error: ", err.Error())
 	}
-	err = client.Agent().ServiceRegister(regis)
-	if err != nil {
-		return fmt.Errorf("consul: initial register service '%s' host to consul error: %s", name, err.Error())
+}
+
+// health returns the status of the TTL check and its output: the worst status
+// of the health server and the probes, passing without any
+func (r *Registration) health(ctx context.Context) (string, string) {
+	status := consul.HealthPassing
+	var lines []string
+	worse := func(s string) {
+		if healthRank[s] > healthRank[status] {
+			status = s
+		}
 	}
 
-	// initial register service check
-	check := consul.AgentServiceCheck{TTL: fmt.Sprintf("%ds", ttl), Status: "passing"}
-	err = client.Agent().CheckRegister(&consul.AgentCheckRegistration{ID: serviceID, Name: name, ServiceID: serviceID, AgentServiceCheck: check})
-	if err != nil {
-		return fmt.Errorf("consul: initial register service check to consul error: %s", err.Error())
+	if r.healthServer != nil {
+		resp, err := r.healthServer.Check(ctx, &healthpb.HealthCheckRequest{Service: r.healthService})
+		if err != nil {
+			worse(consul.HealthCritical)
+			lines = append(lines, fmt.Sprintf("grpc health: %v", err))
+		} else {
+			worse(servingStatus(resp.Status))
+			lines = append(lines, "grpc health: "+resp.Status.String())
+		}
 	}
+	for _, p := range r.probes {
+		pctx, cancel := context.WithTimeout(ctx, r.interval)
+		err := p.probe(pctx)
+		cancel()
+		var w *warningError
+		switch {
+		case err == nil:
+			lines = append(lines, p.name+": ok")
+		case errors.As(err, &w):
+			worse(consul.HealthWarning)
+			lines = append(lines, fmt.Sprintf("%s: warning: %v", p.name, w.err))
+		default:
+			worse(consul.HealthCritical)
+			lines = append(lines, fmt.Sprintf("%s: %v", p.name, err))
+		}
+	}
+	return status, strings.Join(lines, "\n")
+}
+
+// healthRank orders the check statuses from the best
+var healthRank = map[string]int{
+	consul.HealthPassing:  0,
+	consul.HealthWarning:  1,
+	consul.HealthCritical: 2,
+}
+
+// servingStatus converts a gRPC serving status to a check status
+func servingStatus(s healthpb.HealthCheckResponse_ServingStatus) string {
+	switch s {
+	case healthpb.HealthCheckResponse_SERVING:
+		return consul.HealthPassing
+	case healthpb.HealthCheckResponse_NOT_SERVING:
+		return consul.HealthCritical
+	default:
+		return consul.HealthWarning
+	}
+}
 
+// Deregister stops the TTL updates and removes the service and its checks from consul,
+// the registration can be started again afterwards. The TTL check turns critical first,
+// then the drain delay lets the clients stop picking the instance.
+func (r *Registration) Deregister(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+		<-r.done
+		r.cancel, r.done = nil, nil
+	}
+	if r.started && r.ttlCheck != "" {
+		r.updateTTL(ctx, consul.HealthCritical, "service is shutting down")
+		if r.drainDelay > 0 {
+			t := time.NewTimer(r.drainDelay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+			}
+		}
+	}
+	r.started = false
+
+	err := r.client.Agent().ServiceDeregisterOpts(r.service.ID, (&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("consul: deregister service '%s' error: %v", r.service.ID, err)
+	}
 	return nil
 }
+
+// RegisterOption customizes a Registration
+type RegisterOption func(*registerOptions)
+
+type registerOptions struct {
+	tags            []string
+	meta            map[string]string
+	weights         *consul.AgentWeights
+	checks          []Check
+	deregisterAfter time.Duration
+	client          ClientConfig
+
+	healthServer  healthpb.HealthServer
+	healthService string
+	probes        []namedProbe
+	drainDelay    time.Duration
+}
+
+// WithTags sets the service tags, for example the version, zone or protocol
+func WithTags(tags ...string) RegisterOption {
+	return func(o *registerOptions) { o.tags = append(o.tags, tags...) }
+}
+
+// WithMeta sets the service metadata
+func WithMeta(meta map[string]string) RegisterOption {
+	return func(o *registerOptions) { o.meta = meta }
+}
+
+// WithWeights sets the DNS SRV and load balancing weights of the instance when passing and warning
+func WithWeights(passing, warning int) RegisterOption {
+	return func(o *registerOptions) { o.weights = &consul.AgentWeights{Passing: passing, Warning: warning} }
+}
+
+// WithCheck adds a health check, the checks given replace the default TTL check
+func WithCheck(check Check) RegisterOption {
+	return func(o *registerOptions) { o.checks = append(o.checks, check) }
+}
+
+// WithDeregisterCriticalAfter makes consul deregister the service once a check is critical for d
+func WithDeregisterCriticalAfter(d time.Duration) RegisterOption {
+	return func(o *registerOptions) { o.deregisterAfter = d }
+}
+
+// WithClientConfig sets the ACL token, TLS and datacenter of the consul client
+func WithClientConfig(conf ClientConfig) RegisterOption {
+	return func(o *registerOptions) { o.client = conf }
+}
+
+// WithHealthServer makes the TTL check follow the serving status of service on hs, typically
+// a *health.Server, "" for the whole server: SERVING is passing, NOT_SERVING critical and
+// the other statuses warning
+func WithHealthServer(hs healthpb.HealthServer, service string) RegisterOption {
+	return func(o *registerOptions) { o.healthServer, o.healthService = hs, service }
+}
+
+// Probe checks a dependency of the service before each TTL update, for example the database.
+// An error turns the TTL check critical, or warning when wrapped by Warning.
+type Probe func(ctx context.Context) error
+
+type namedProbe struct {
+	name  string
+	probe Probe
+}
+
+// WithProbe adds a readiness probe, its name and error appear in the check output.
+// The probe must return within the registration interval.
+func WithProbe(name string, probe Probe) RegisterOption {
+	return func(o *registerOptions) { o.probes = append(o.probes, namedProbe{name, probe}) }
+}
+
+// WithDrainDelay sets how long Deregister waits between turning the TTL check critical
+// and removing the service
+func WithDrainDelay(d time.Duration) RegisterOption {
+	return func(o *registerOptions) { o.drainDelay = d }
+}
+
+// Warning marks the error of a probe as degraded rather than failed
+func Warning(err error) error {
+	return &warningError{err}
+}
+
+type warningError struct {
+	err error
+}
+
+func (e *warningError) Error() string { return "warning: " + e.err.Error() }
+
+func (e *warningError) Unwrap() error { return e.err }
@@ -0,0 +1,245 @@
+package consul_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/rigoiot/pkg/consul"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func newRegistration(t *testing.T, f *fakeConsul) *consul.Registration {
+	t.Helper()
+
+	r, err := consul.NewRegistration("device-service", "10.0.0.1", 9000, f.Addr(), 10*time.Millisecond, 1)
+	if err != nil {
+		t.Fatalf("NewRegistration: %v", err)
+	}
+	return r
+}
+
+// waitFor polls cond until it holds or a second elapsed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRegistrationLifecycle(t *testing.T) {
+	f := newFakeConsul(t)
+	r := newRegistration(t, f)
+
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	s := f.service(r.ID())
+	if s == nil {
+		t.Fatalf("service %s not registered", r.ID())
+	}
+	if s.Name != "device-service" || s.Address != "10.0.0.1" || s.Port != 9000 {
+		t.Errorf("registered %+v", s)
+	}
+	if len(s.Checks) != 1 || s.Checks[0].TTL != "1s" || s.Checks[0].CheckID != r.ID() {
+		t.Errorf("checks = %+v, want a TTL check of 1s", s.Checks)
+	}
+	waitFor(t, "ttl updates", func() bool { return f.ttlUpdates(r.ID()) >= 2 })
+
+	if err := r.Start(context.Background()); err == nil {
+		t.Error("second Start succeeded")
+	}
+
+	if err := r.Deregister(context.Background()); err != nil {
+		t.Fatalf("Deregister: %v", err)
+	}
+	if f.service(r.ID()) != nil {
+		t.Error("service still registered after Deregister")
+	}
+	n := f.ttlUpdates(r.ID())
+	time.Sleep(50 * time.Millisecond)
+	if got := f.ttlUpdates(r.ID()); got != n {
+		t.Errorf("ttl updated %d times after Deregister", got-n)
+	}
+}
+
+func TestRegistrationStopsWithContext(t *testing.T) {
+	f := newFakeConsul(t)
+	r := newRegistration(t, f)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := r.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	waitFor(t, "ttl update", func() bool { return f.ttlUpdates(r.ID()) >= 1 })
+	cancel()
+
+	time.Sleep(20 * time.Millisecond)
+	n := f.ttlUpdates(r.ID())
+	time.Sleep(50 * time.Millisecond)
+	if got := f.ttlUpdates(r.ID()); got != n {
+		t.Errorf("ttl updated %d times after the context was canceled", got-n)
+	}
+	// the service stays registered until Deregister
+	if f.service(r.ID()) == nil {
+		t.Error("service deregistered by context cancellation")
+	}
+	if err := r.Deregister(context.Background()); err != nil {
+		t.Fatalf("Deregister: %v", err)
+	}
+}
+
+func TestRegistrationOptions(t *testing.T) {
+	f := newFakeConsul(t)
+	r, err := consul.NewRegistration("device-service", "10.0.0.1", 9000, f.Addr(), 10*time.Millisecond, 1,
+		consul.WithTags("v2", "zone-a"),
+		consul.WithMeta(map[string]string{"protocol": "grpc"}),
+		consul.WithWeights(10, 1),
+		consul.WithCheck(consul.GRPCCheck(5*time.Second)),
+		consul.WithCheck(consul.HTTPCheck("http://10.0.0.1:8080/healthz", 10*time.Second)),
+		consul.WithCheck(consul.TCPCheck(15*time.Second)),
+		consul.WithDeregisterCriticalAfter(time.Minute),
+		consul.WithClientConfig(consul.ClientConfig{Token: "secret-token"}),
+	)
+	if err != nil {
+		t.Fatalf("NewRegistration: %v", err)
+	}
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer r.Deregister(context.Background())
+
+	s := f.service(r.ID())
+	if len(s.Tags) != 2 || s.Tags[0] != "v2" || s.Tags[1] != "zone-a" {
+		t.Errorf("tags = %v", s.Tags)
+	}
+	if s.Meta["protocol"] != "grpc" {
+		t.Errorf("meta = %v", s.Meta)
+	}
+	if s.Weights == nil || s.Weights.Passing != 10 || s.Weights.Warning != 1 {
+		t.Errorf("weights = %+v", s.Weights)
+	}
+	if len(s.Checks) != 3 {
+		t.Fatalf("checks = %+v, want 3", s.Checks)
+	}
+	grpcCheck, httpCheck, tcpCheck := s.Checks[0], s.Checks[1], s.Checks[2]
+	if grpcCheck.GRPC != "10.0.0.1:9000" || grpcCheck.Interval != "5s" || grpcCheck.TTL != "" {
+		t.Errorf("grpc check = %+v", grpcCheck)
+	}
+	if httpCheck.HTTP != "http://10.0.0.1:8080/healthz" || httpCheck.Interval != "10s" {
+		t.Errorf("http check = %+v", httpCheck)
+	}
+	if tcpCheck.TCP != "10.0.0.1:9000" || tcpCheck.Interval != "15s" {
+		t.Errorf("tcp check = %+v", tcpCheck)
+	}
+	for _, c := range s.Checks {
+		if c.DeregisterCriticalServiceAfter != "1m0s" {
+			t.Errorf("check %s deregister critical after %q", c.CheckID, c.DeregisterCriticalServiceAfter)
+		}
+	}
+	if tok := f.token(r.ID()); tok != "secret-token" {
+		t.Errorf("ACL token = %q", tok)
+	}
+
+	// consul runs the checks itself, nothing to update
+	time.Sleep(30 * time.Millisecond)
+	for _, c := range s.Checks {
+		if n := f.ttlUpdates(c.CheckID); n != 0 {
+			t.Errorf("check %s updated %d times", c.CheckID, n)
+		}
+	}
+}
+
+func TestRegistrationInvalidCheck(t *testing.T) {
+	_, err := consul.NewRegistration("device-service", "10.0.0.1", 9000, "127.0.0.1:8500", time.Second, 1,
+		consul.WithCheck(consul.Check{Type: consul.CheckHTTP, Interval: time.Second}))
+	if err == nil {
+		t.Error("HTTP check without URL accepted")
+	}
+}
+
+func TestRegistrationStartError(t *testing.T) {
+	f := newFakeConsul(t)
+	r := newRegistration(t, f)
+	f.Close()
+
+	if err := r.Start(context.Background()); err == nil {
+		t.Fatal("Start succeeded without consul")
+	}
+	// nothing to stop, the consul error is reported
+	if err := r.Deregister(context.Background()); err == nil {
+		t.Error("Deregister succeeded without consul")
+	}
+}
+
+func TestRegistrationFollowsHealth(t *testing.T) {
+	f := newFakeConsul(t)
+	hs := health.NewServer()
+	hs.SetServingStatus("device.Service", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	var dbErr atomic.Value
+	dbErr.Store(errorBox{})
+	r, err := consul.NewRegistration("device-service", "10.0.0.1", 9000, f.Addr(), 10*time.Millisecond, 1,
+		consul.WithHealthServer(hs, "device.Service"),
+		consul.WithProbe("db", func(context.Context) error { return dbErr.Load().(errorBox).err }),
+		consul.WithDrainDelay(20*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("NewRegistration: %v", err)
+	}
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	// registered with the current status
+	if s := f.service(r.ID()); s.Checks[0].Status != consulapi.HealthCritical {
+		t.Errorf("registered status = %s, want critical", s.Checks[0].Status)
+	}
+	waitStatus := func(status, output string) {
+		t.Helper()
+		waitFor(t, status+" "+output, func() bool {
+			s, o := f.lastUpdate(r.ID())
+			return s == status && o == output
+		})
+	}
+	waitStatus(consulapi.HealthCritical, "grpc health: NOT_SERVING\ndb: ok")
+
+	hs.SetServingStatus("device.Service", healthpb.HealthCheckResponse_SERVING)
+	waitStatus(consulapi.HealthPassing, "grpc health: SERVING\ndb: ok")
+
+	dbErr.Store(errorBox{consul.Warning(errors.New("replica lag 30s"))})
+	waitStatus(consulapi.HealthWarning, "grpc health: SERVING\ndb: warning: replica lag 30s")
+
+	dbErr.Store(errorBox{errors.New("connection refused")})
+	waitStatus(consulapi.HealthCritical, "grpc health: SERVING\ndb: connection refused")
+	dbErr.Store(errorBox{})
+
+	// critical before the service goes away
+	if err := r.Deregister(context.Background()); err != nil {
+		t.Fatalf("Deregister: %v", err)
+	}
+	if s, o := f.lastUpdate(r.ID()); s != consulapi.HealthCritical || o != "service is shutting down" {
+		t.Errorf("last update = %s %q, want critical before deregistering", s, o)
+	}
+}
+
+// errorBox stores a possibly nil error in an atomic.Value
+type errorBox struct{ err error }
+
+func TestRegistrationHealthRequiresTTL(t *testing.T) {
+	_, err := consul.NewRegistration("device-service", "10.0.0.1", 9000, "127.0.0.1:8500", time.Second, 1,
+		consul.WithCheck(consul.GRPCCheck(time.Second)),
+		consul.WithHealthServer(health.NewServer(), ""))
+	if err == nil {
+		t.Error("health server accepted without a TTL check")
+	}
+}
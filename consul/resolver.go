@@ -1,43 +1,92 @@
 package consul
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
 
-	consul "github.com/hashicorp/consul/api"
-	"google.golang.org/grpc/naming"
+	"google.golang.org/grpc/resolver"
 )
 
-// Resolver is the implementaion of grpc.naming.Resolver
-type Resolver struct {
-	ServiceName string //service name
+// Scheme is the scheme of consul dial targets
+const Scheme = "consul"
+
+func init() {
+	resolver.Register(NewBuilder(ClientConfig{}))
 }
 
-// NewResolver return Resolver with service name
-func NewResolver(serviceName string) *Resolver {
-	return &Resolver{ServiceName: serviceName}
+// Builder builds the resolvers of consul dial targets:
+//
+//	consul://<agent address>/<service name>?tag=<tag>&dc=<datacenter>
+//
+// for example "consul://127.0.0.1:8500/device-service?tag=v2&dc=dc1", see Discovery
+// for all the query parameters and Target to build them. The agent address
+// defaults to the consul environment (CONSUL_HTTP_ADDR) or 127.0.0.1:8500 when empty.
+// A builder for the default client settings is registered with gRPC, use NewBuilder and
+// grpc.WithResolvers for an ACL token or TLS. The WeightedRoundRobin and LeastRequest
+// balancers use the weights and zones of the resolved instances.
+type Builder struct {
+	conf  ClientConfig
+	watch WatchConfig
 }
 
-// Resolve to resolve the service from consul, target is the dial address of consul
-func (cr *Resolver) Resolve(target string) (naming.Watcher, error) {
-	if cr.ServiceName == "" {
-		return nil, errors.New("consul: no service name provided")
+// NewBuilder returns a builder creating its consul clients with conf, the zero
+// fields of watch are taken from DefaultWatchConfig
+func NewBuilder(conf ClientConfig, watch ...WatchConfig) *Builder {
+	b := &Builder{conf: conf, watch: DefaultWatchConfig}
+	if len(watch) > 0 {
+		b.watch = watch[0].withDefaults(DefaultWatchConfig)
 	}
+	return b
+}
+
+// Scheme returns "consul"
+func (b *Builder) Scheme() string {
+	return Scheme
+}
 
-	// generate consul client, return if error
-	conf := &consul.Config{
-		Scheme:  "http",
-		Address: target,
+// Build starts watching the healthy instances of the target service
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	service, query, err := parseEndpoint(target.Endpoint)
+	if err != nil {
+		return nil, err
 	}
-	client, err := consul.NewClient(conf)
+
+	d, err := parseDiscovery(query)
 	if err != nil {
-		return nil, fmt.Errorf("consul: creat consul error: %v", err)
+		return nil, err
 	}
+	client, err := newClient(target.Authority, b.conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{
+		cc:        cc,
+		client:    client,
+		service:   service,
+		discovery: d,
+		conf:      b.watch,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	go w.watch()
+	return w, nil
+}
 
-	// return ConsulWatcher
-	watcher := &Watcher{
-		cr: cr,
-		cc: client,
+// parseEndpoint splits the endpoint of a target into the service name and the query parameters
+func parseEndpoint(endpoint string) (string, url.Values, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", nil, fmt.Errorf("consul: invalid target endpoint %q: %v", endpoint, err)
+	}
+	service := strings.Trim(u.Path, "/")
+	if service == "" {
+		return "", nil, errors.New("consul: no service name provided")
 	}
-	return watcher, nil
+	return service, u.Query(), nil
 }
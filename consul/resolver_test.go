@@ -0,0 +1,295 @@
+package consul_test
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rigoiot/pkg/consul"
+	"google.golang.org/grpc/resolver"
+)
+
+// fakeClientConn records the states pushed by a resolver
+type fakeClientConn struct {
+	resolver.ClientConn
+	states chan resolver.State
+	errs   chan error
+}
+
+func newFakeClientConn() *fakeClientConn {
+	return &fakeClientConn{states: make(chan resolver.State, 10), errs: make(chan error, 10)}
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) { cc.states <- s }
+
+func (cc *fakeClientConn) ReportError(err error) { cc.errs <- err }
+
+// next returns the next state pushed by the resolver
+func (cc *fakeClientConn) next(t *testing.T) resolver.State {
+	t.Helper()
+
+	select {
+	case s := <-cc.states:
+		return s
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for resolver state")
+	}
+	return resolver.State{}
+}
+
+func addrs(s resolver.State) []string {
+	var addrs []string
+	for _, a := range s.Addresses {
+		addrs = append(addrs, a.Addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func register(t *testing.T, f *fakeConsul, host string, port int, opts ...consul.RegisterOption) *consul.Registration {
+	t.Helper()
+
+	r, err := consul.NewRegistration("device-service", host, port, f.Addr(), time.Hour, 60, opts...)
+	if err != nil {
+		t.Fatalf("NewRegistration: %v", err)
+	}
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return r
+}
+
+func buildResolver(t *testing.T, f *fakeConsul, endpoint string) (resolver.Resolver, *fakeClientConn) {
+	t.Helper()
+
+	cc := newFakeClientConn()
+	target := resolver.Target{Scheme: consul.Scheme, Authority: f.Addr(), Endpoint: endpoint}
+	r, err := consul.NewBuilder(consul.ClientConfig{}).Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	return r, cc
+}
+
+func TestResolverWatchesHealthyInstances(t *testing.T) {
+	f := newFakeConsul(t)
+	register(t, f, "10.0.0.1", 9000, consul.WithTags("v2"),
+		consul.WithMeta(map[string]string{"zone": "a"}), consul.WithWeights(10, 1))
+	register(t, f, "10.0.0.2", 9000, consul.WithTags("v1"))
+
+	r, cc := buildResolver(t, f, "device-service?tag=v2")
+	defer r.Close()
+
+	s := cc.next(t)
+	if got := addrs(s); len(got) != 1 || got[0] != "10.0.0.1:9000" {
+		t.Fatalf("addresses = %v, want [10.0.0.1:9000]", got)
+	}
+	inst, ok := consul.InstanceFromAddress(s.Addresses[0])
+	if !ok {
+		t.Fatal("address without instance")
+	}
+	if inst.Meta["zone"] != "a" || inst.Weight != 10 || inst.Datacenter != "dc1" {
+		t.Errorf("instance = %+v", inst)
+	}
+
+	// a new instance is pushed by the blocking query
+	third := register(t, f, "10.0.0.3", 9000, consul.WithTags("v2"))
+	if got := addrs(cc.next(t)); len(got) != 2 || got[1] != "10.0.0.3:9000" {
+		t.Errorf("addresses = %v, want 10.0.0.1 and 10.0.0.3", got)
+	}
+
+	// an unhealthy instance is removed
+	f.setStatus(third.ID(), consulapi.HealthCritical)
+	if got := addrs(cc.next(t)); len(got) != 1 {
+		t.Errorf("addresses = %v, want only 10.0.0.1", got)
+	}
+}
+
+func TestResolverResolveNowAndClose(t *testing.T) {
+	f := newFakeConsul(t)
+	register(t, f, "10.0.0.1", 9000)
+
+	r, cc := buildResolver(t, f, "device-service")
+	cc.next(t)
+
+	// the blocking query is canceled and consul queried again
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	if got := addrs(cc.next(t)); len(got) != 1 {
+		t.Errorf("addresses = %v after ResolveNow", got)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked on the running query")
+	}
+}
+
+func TestBuilderRequiresService(t *testing.T) {
+	target := resolver.Target{Scheme: consul.Scheme, Authority: "127.0.0.1:8500", Endpoint: "?tag=v2"}
+	if _, err := consul.NewBuilder(consul.ClientConfig{}).Build(target, newFakeClientConn(), resolver.BuildOptions{}); err == nil {
+		t.Error("Build succeeded without service name")
+	}
+}
+
+func TestResolverDiscoveryOptions(t *testing.T) {
+	f := newFakeConsul(t)
+	register(t, f, "10.0.0.1", 9000, consul.WithTags("v2", "zone-a"))
+	register(t, f, "10.0.0.2", 9000, consul.WithTags("v2"))
+
+	target := consul.Target(f.Addr(), "device-service", consul.Discovery{
+		Tags:        []string{"v2", "zone-a"},
+		Datacenter:  "dc2",
+		NodeMeta:    map[string]string{"rack": "r1"},
+		Filter:      `Service.Meta.protocol == "grpc"`,
+		Consistency: consul.ConsistencyStale,
+	})
+	r, cc := buildResolver(t, f, strings.TrimPrefix(target, "consul://"+f.Addr()+"/"))
+	defer r.Close()
+
+	if got := addrs(cc.next(t)); len(got) != 1 || got[0] != "10.0.0.1:9000" {
+		t.Errorf("addresses = %v, want [10.0.0.1:9000]", got)
+	}
+	q := f.query()
+	if len(q["tag"]) != 2 || q.Get("dc") != "dc2" || q.Get("node-meta") != "rack:r1" ||
+		q.Get("filter") != `Service.Meta.protocol == "grpc"` || q.Get("passing") == "" {
+		t.Errorf("health query = %v", q)
+	}
+	if _, ok := q["stale"]; !ok {
+		t.Errorf("health query = %v, want stale", q)
+	}
+}
+
+func TestResolverFallbackToWarning(t *testing.T) {
+	f := newFakeConsul(t)
+	a := register(t, f, "10.0.0.1", 9000)
+	b := register(t, f, "10.0.0.2", 9000)
+	f.setStatus(b.ID(), consulapi.HealthWarning)
+
+	r, cc := buildResolver(t, f, "device-service?fallback=warning")
+	defer r.Close()
+
+	// passing instances win
+	if got := addrs(cc.next(t)); len(got) != 1 || got[0] != "10.0.0.1:9000" {
+		t.Errorf("addresses = %v, want [10.0.0.1:9000]", got)
+	}
+	// then the instances in warning state are used
+	f.setStatus(a.ID(), consulapi.HealthCritical)
+	if got := addrs(cc.next(t)); len(got) != 1 || got[0] != "10.0.0.2:9000" {
+		t.Errorf("addresses = %v, want [10.0.0.2:9000]", got)
+	}
+}
+
+func TestBuilderRejectsInvalidDiscovery(t *testing.T) {
+	for _, endpoint := range []string{
+		"device-service?consistency=eventual",
+		"device-service?fallback=critical",
+		"device-service?node-meta=rack",
+	} {
+		target := resolver.Target{Scheme: consul.Scheme, Authority: "127.0.0.1:8500", Endpoint: endpoint}
+		if _, err := consul.NewBuilder(consul.ClientConfig{}).Build(target, newFakeClientConn(), resolver.BuildOptions{}); err == nil {
+			t.Errorf("Build(%q) succeeded", endpoint)
+		}
+	}
+}
+
+func TestResolverStaleCache(t *testing.T) {
+	f := newFakeConsul(t)
+	register(t, f, "10.0.0.1", 9000)
+
+	before := watchErrors("device-service")
+	cc := newFakeClientConn()
+	target := resolver.Target{Scheme: consul.Scheme, Authority: f.Addr(), Endpoint: "device-service"}
+	watch := consul.WatchConfig{MinBackoff: 5 * time.Millisecond, MaxBackoff: 10 * time.Millisecond, StaleCache: time.Hour}
+	r, err := consul.NewBuilder(consul.ClientConfig{}, watch).Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	defer r.Close()
+	cc.next(t)
+
+	// the outage is not reported while the cache is fresh
+	f.setFailing(true)
+	waitFor(t, "watch errors", func() bool { return watchErrors("device-service") >= before+3 })
+	select {
+	case err := <-cc.errs:
+		t.Errorf("error reported during stale cache: %v", err)
+	default:
+	}
+
+	// and the watch recovers with consul
+	f.setFailing(false)
+	if got := addrs(cc.next(t)); len(got) != 1 {
+		t.Errorf("addresses = %v after recovery", got)
+	}
+}
+
+func TestResolverReportsErrors(t *testing.T) {
+	f := newFakeConsul(t)
+	f.setFailing(true)
+
+	cc := newFakeClientConn()
+	target := resolver.Target{Scheme: consul.Scheme, Authority: f.Addr(), Endpoint: "device-service"}
+	watch := consul.WatchConfig{MinBackoff: 5 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	r, err := consul.NewBuilder(consul.ClientConfig{}, watch).Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	defer r.Close()
+
+	select {
+	case err := <-cc.errs:
+		if !strings.Contains(err.Error(), "device-service") {
+			t.Errorf("error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("initial query error not reported")
+	}
+}
+
+func TestResolverPartialWatchConfig(t *testing.T) {
+	f := newFakeConsul(t)
+	f.setFailing(true)
+
+	before := watchErrors("partial-service")
+	cc := newFakeClientConn()
+	target := resolver.Target{Scheme: consul.Scheme, Authority: f.Addr(), Endpoint: "partial-service"}
+	// the backoff is left to DefaultWatchConfig, at least half a second after the first error
+	watch := consul.WatchConfig{StaleCache: time.Hour}
+	r, err := consul.NewBuilder(consul.ClientConfig{}, watch).Build(target, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	defer r.Close()
+
+	waitFor(t, "watch errors", func() bool { return watchErrors("partial-service") >= before+1 })
+	time.Sleep(200 * time.Millisecond)
+	if n := watchErrors("partial-service") - before; n > 1 {
+		t.Errorf("%v queries failed in 200ms, want the default backoff between them", n)
+	}
+}
+
+// watchErrors returns the consul_watch_errors_total counter of service
+func watchErrors(service string) float64 {
+	mfs, _ := prometheus.DefaultGatherer.Gather()
+	for _, mf := range mfs {
+		if mf.GetName() != "consul_watch_errors_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() == service {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
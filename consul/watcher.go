@@ -1,87 +1,243 @@
 package consul
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	consul "github.com/hashicorp/consul/api"
-	"google.golang.org/grpc/naming"
+	"github.com/rigoiot/pkg/logger"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
 )
 
-// Watcher is the implementation of grpc.naming.Watcher
-type Watcher struct {
-	// cr: ConsulResolver
-	cr *Resolver
-	// cc: Consul Client
-	cc *consul.Client
-
-	// LastIndex to watch consul
-	li uint64
-
-	// addrs is the service address cache
-	// before check: every value shoud be 1
-	// after check: 1 - deleted  2 - nothing  3 - new added
-	addrs []string
+// WatchConfig tunes the consul watchers
+type WatchConfig struct {
+	// MinBackoff and MaxBackoff bound the exponential backoff with jitter
+	// between queries after consul errors
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// WaitTime is the longest duration of a blocking query, 5 minutes by default in consul
+	WaitTime time.Duration
+
+	// StaleCache is how long the last known addresses keep being served silently
+	// while consul is unreachable, the errors are reported to gRPC afterwards.
+	// Zero reports every error.
+	StaleCache time.Duration
 }
 
-// Close do nonthing
-func (cw *Watcher) Close() {
+// DefaultWatchConfig is the WatchConfig of the registered builder
+var DefaultWatchConfig = WatchConfig{
+	MinBackoff: time.Second,
+	MaxBackoff: 30 * time.Second,
 }
 
-// Next to return the updates
-func (cw *Watcher) Next() ([]*naming.Update, error) {
-	// Nil cw.addrs means it is initial called
-	// If get addrs, return to balancer
-	// If no addrs, need to watch consul
-	if cw.addrs == nil {
-		// must return addrs to balancer, use ticker to query consul till data gotten
-		addrs, li, _ := cw.queryConsul(nil)
-
-		// got addrs, return
-		if len(addrs) != 0 {
-			cw.addrs = addrs
-			cw.li = li
-			return genUpdates([]string{}, addrs), nil
-		}
+// withDefaults returns c with its zero fields taken from def
+func (c WatchConfig) withDefaults(def WatchConfig) WatchConfig {
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = def.MinBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = def.MaxBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = c.MinBackoff
 	}
+	if c.WaitTime <= 0 {
+		c.WaitTime = def.WaitTime
+	}
+	if c.StaleCache <= 0 {
+		c.StaleCache = def.StaleCache
+	}
+	return c
+}
 
+// backoff returns the wait after the n-th consecutive error (from 0): an exponential
+// duration between MinBackoff and MaxBackoff with half of it randomized
+func (c WatchConfig) backoff(n int) time.Duration {
+	d := c.MinBackoff
+	for i := 0; i < n && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Instance is the consul service instance behind a resolved address,
+// see InstanceFromAddress
+type Instance struct {
+	ID         string
+	Node       string
+	Datacenter string
+	Tags       []string
+	Meta       map[string]string
+	// Weight is the passing or warning weight of the instance depending on its health
+	Weight int
+}
+
+// instanceKey is the address attribute key of the Instance
+type instanceKey struct{}
+
+// NewAddress returns the resolver address of addr carrying inst, for example
+// to describe static instances to the consul balancers
+func NewAddress(addr string, inst *Instance) resolver.Address {
+	return resolver.Address{Addr: addr, Attributes: attributes.New(instanceKey{}, inst)}
+}
+
+// InstanceFromAddress returns the consul instance of an address resolved by the consul resolver
+func InstanceFromAddress(addr resolver.Address) (*Instance, bool) {
+	if addr.Attributes == nil {
+		return nil, false
+	}
+	inst, ok := addr.Attributes.Value(instanceKey{}).(*Instance)
+	return inst, ok
+}
+
+// Watcher is the resolver of a consul target, it pushes the healthy instances
+// of the service to gRPC from blocking health queries
+type Watcher struct {
+	cc        resolver.ClientConn
+	client    *consul.Client
+	service   string
+	discovery Discovery
+	conf      WatchConfig
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu          sync.Mutex
+	now         bool // ResolveNow was called, query without waiting
+	cancelQuery context.CancelFunc
+}
+
+// ResolveNow cancels the running blocking query and queries consul again immediately,
+// it does not shorten the backoff after errors
+func (w *Watcher) ResolveNow(resolver.ResolveNowOptions) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.now = true
+	if w.cancelQuery != nil {
+		w.cancelQuery()
+	}
+}
+
+// Close stops watching, it cancels the running blocking query and waits for the watch goroutine
+func (w *Watcher) Close() {
+	w.cancel()
+	<-w.done
+}
+
+// watch is the routine querying consul until the watcher is closed
+func (w *Watcher) watch() {
+	defer close(w.done)
+
+	var (
+		li       uint64 // LastIndex to watch consul
+		failures int    // consecutive errors
+		lastSync time.Time
+	)
 	for {
-		// watch consul
-		addrs, li, err := cw.queryConsul(&consul.QueryOptions{WaitIndex: cw.li})
+		entries, meta, err := w.queryConsul(li)
+		if w.ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, context.Canceled) {
+			// canceled by ResolveNow
+			continue
+		}
 		if err != nil {
-			time.Sleep(1 * time.Second)
+			consulWatchErrorsTotal.WithLabelValues(w.service).Inc()
+			if !lastSync.IsZero() && time.Since(lastSync) < w.conf.StaleCache {
+				logger.Printf("consul: watch service '%s' error, serving cached addresses: %v", w.service, err)
+			} else {
+				w.cc.ReportError(fmt.Errorf("consul: watch service '%s' error: %v", w.service, err))
+			}
+			w.sleep(w.conf.backoff(failures))
+			failures++
 			continue
 		}
-
-		// generate updates
-		updates := genUpdates(cw.addrs, addrs)
-
-		// update addrs & last index
-		cw.addrs = addrs
-		cw.li = li
-
-		if len(updates) != 0 {
-			return updates, nil
+		failures = 0
+		lastSync = time.Now()
+		consulWatchLastSync.WithLabelValues(w.service).Set(float64(lastSync.Unix()))
+
+		// consul may reset the index, start over if it goes backwards
+		if meta.LastIndex < li {
+			li = 0
+		} else {
+			li = meta.LastIndex
 		}
+		w.cc.UpdateState(resolver.State{Addresses: addresses(w.discovery.selectHealthy(entries))})
 	}
+}
 
-	// should never come here
-	return []*naming.Update{}, nil
+// sleep waits for d or Close
+func (w *Watcher) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-w.ctx.Done():
+	}
 }
 
-// queryConsul is helper function to query consul
-func (cw *Watcher) queryConsul(q *consul.QueryOptions) ([]string, uint64, error) {
-	// query consul
-	cs, meta, err := cw.cc.Health().Service(cw.cr.ServiceName, "", true, q)
-	if err != nil {
-		return nil, 0, err
+// queryConsul is helper function to query consul, blocking until the
+// index moves past li unless ResolveNow was called
+func (w *Watcher) queryConsul(li uint64) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	ctx, cancel := context.WithCancel(w.ctx)
+	defer cancel()
+
+	w.mu.Lock()
+	if w.now {
+		w.now, li = false, 0
 	}
+	w.cancelQuery = cancel
+	w.mu.Unlock()
+
+	q := w.discovery.queryOptions(li)
+	q.WaitTime = w.conf.WaitTime
+	q = q.WithContext(ctx)
+	passingOnly := !w.discovery.FallbackToWarning
+	entries, meta, err := w.client.Health().ServiceMultipleTags(w.service, w.discovery.Tags, passingOnly, q)
+
+	w.mu.Lock()
+	w.cancelQuery = nil
+	w.mu.Unlock()
+	return entries, meta, err
+}
 
-	addrs := make([]string, 0)
-	for _, s := range cs {
+// addresses converts the service entries to resolver addresses carrying their Instance
+func addresses(entries []*consul.ServiceEntry) []resolver.Address {
+	addrs := make([]resolver.Address, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		inst := &Instance{
+			ID:         e.Service.ID,
+			Node:       e.Node.Node,
+			Datacenter: e.Node.Datacenter,
+			Tags:       e.Service.Tags,
+			Meta:       e.Service.Meta,
+			Weight:     e.Service.Weights.Passing,
+		}
+		if e.Checks.AggregatedStatus() == consul.HealthWarning {
+			inst.Weight = e.Service.Weights.Warning
+		}
 		// addr should like: 127.0.0.1:8001
-		addrs = append(addrs, fmt.Sprintf("%s:%d", s.Service.Address, s.Service.Port))
+		addrs = append(addrs, NewAddress(net.JoinHostPort(host, strconv.Itoa(e.Service.Port)), inst))
 	}
-
-	return addrs, meta.LastIndex, nil
+	return addrs
 }
@@ -0,0 +1,194 @@
+// Package discovery resolves the gRPC dial targets of our services with
+// interchangeable backends selected by the scheme of the target:
+//
+//	consul://127.0.0.1:8500/device-service?tag=v2    consul health queries, see the consul package
+//	static:///10.0.0.1:8001,10.0.0.2:8001             fixed address list
+//	srv:///_grpc._tcp.device.example.com             DNS SRV records, srv://<dns server>/<name> for a given server
+//	file:///etc/rigoiot/services.json?service=device  JSON address list, reloaded when the file changes
+//
+// Importing the package registers all the schemes with gRPC so that the same client
+// code dials in every environment, only the target string changes. The addresses carry
+// a consul.Instance, so the consul balancers use the weights and zones of every backend.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"time"
+
+	// registers the consul scheme
+	_ "github.com/rigoiot/pkg/consul"
+	"google.golang.org/grpc/resolver"
+)
+
+func init() {
+	resolver.Register(NewBuilder("static", newStaticBackend))
+	resolver.Register(NewBuilder("srv", newSRVBackend))
+	resolver.Register(NewBuilder("file", newFileBackend))
+}
+
+// Backend finds the addresses of one dial target
+type Backend interface {
+	// Resolve returns the current addresses
+	Resolve(ctx context.Context) ([]resolver.Address, error)
+
+	// Wait blocks until the addresses may have changed or ctx is done
+	Wait(ctx context.Context)
+}
+
+// Target is a parsed dial target: "<scheme>://<authority>/<path>?<query>"
+type Target struct {
+	Authority string
+	Path      string
+	Query     url.Values
+}
+
+// Factory creates the backend of a target
+type Factory func(target Target) (Backend, error)
+
+// NewBuilder returns the resolver builder of scheme, the resolvers push the addresses
+// of the backends created by factory to gRPC. Register it with resolver.Register or
+// grpc.WithResolvers.
+func NewBuilder(scheme string, factory Factory) resolver.Builder {
+	return &builder{scheme: scheme, factory: factory}
+}
+
+type builder struct {
+	scheme  string
+	factory Factory
+}
+
+func (b *builder) Scheme() string {
+	return b.scheme
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	path, query, _ := strings.Cut(target.Endpoint, "?")
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: invalid target query %q: %v", query, err)
+	}
+	backend, err := b.factory(Target{Authority: target.Authority, Path: path, Query: q})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &backendResolver{
+		cc:      cc,
+		backend: backend,
+		target:  fmt.Sprintf("%s://%s/%s", b.scheme, target.Authority, target.Endpoint),
+		cancel:  cancel,
+		now:     make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go r.watch(ctx)
+	return r, nil
+}
+
+// backendResolver pushes the addresses of a backend to gRPC until closed
+type backendResolver struct {
+	cc      resolver.ClientConn
+	backend Backend
+	target  string
+
+	cancel context.CancelFunc
+	now    chan struct{} // ResolveNow was called
+	done   chan struct{}
+}
+
+// ResolveNow interrupts the wait of the backend and resolves again
+func (r *backendResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.now <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops resolving and waits for the watch goroutine
+func (r *backendResolver) Close() {
+	r.cancel()
+	<-r.done
+}
+
+// watch is the routine resolving the target until ctx is done
+func (r *backendResolver) watch(ctx context.Context) {
+	defer close(r.done)
+
+	failures := 0 // consecutive errors
+	for {
+		addrs, err := r.backend.Resolve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			r.cc.ReportError(fmt.Errorf("discovery: resolve %s error: %v", r.target, err))
+			r.sleep(ctx, backoff(failures))
+			failures++
+			continue
+		}
+		failures = 0
+		r.cc.UpdateState(resolver.State{Addresses: addrs})
+
+		wctx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-r.now:
+				cancel()
+			case <-wctx.Done():
+			}
+		}()
+		r.backend.Wait(wctx)
+		cancel()
+	}
+}
+
+// sleep waits for d, ResolveNow or the end of ctx
+func (r *backendResolver) sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.now:
+	case <-ctx.Done():
+	}
+}
+
+// backoff returns the wait after the n-th consecutive error (from 0): from 1s
+// doubling up to 30s, with half of it randomized
+func backoff(n int) time.Duration {
+	d := time.Second
+	for i := 0; i < n && d < 30*time.Second; i++ {
+		d *= 2
+	}
+	if d > 30*time.Second {
+		d = 30 * time.Second
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// refresh returns the duration of the refresh query parameter, def when absent
+func refresh(target Target, def time.Duration) (time.Duration, error) {
+	v := target.Query.Get("refresh")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("discovery: invalid refresh %q", v)
+	}
+	return d, nil
+}
+
+// sleep waits for d or the end of ctx
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,201 @@
+package discovery_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rigoiot/pkg/consul"
+	_ "github.com/rigoiot/pkg/discovery"
+	"golang.org/x/net/dns/dnsmessage"
+	"google.golang.org/grpc/resolver"
+)
+
+// fakeClientConn records the states and errors pushed by a resolver
+type fakeClientConn struct {
+	resolver.ClientConn
+	states chan resolver.State
+	errs   chan error
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) { cc.states <- s }
+
+func (cc *fakeClientConn) ReportError(err error) { cc.errs <- err }
+
+// build builds the resolver of target with the registered builder of its scheme
+func build(t *testing.T, target string) (*fakeClientConn, resolver.Resolver) {
+	t.Helper()
+	scheme, rest, _ := strings.Cut(target, "://")
+	authority, endpoint, _ := strings.Cut(rest, "/")
+	builder := resolver.Get(scheme)
+	if builder == nil {
+		t.Fatalf("scheme %s not registered", scheme)
+	}
+	cc := &fakeClientConn{states: make(chan resolver.State, 10), errs: make(chan error, 10)}
+	r, err := builder.Build(resolver.Target{Scheme: scheme, Authority: authority, Endpoint: endpoint}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("Build %s: %v", target, err)
+	}
+	t.Cleanup(r.Close)
+	return cc, r
+}
+
+// next returns the addresses of the next state with their weights and zones
+func (cc *fakeClientConn) next(t *testing.T) []string {
+	t.Helper()
+	select {
+	case s := <-cc.states:
+		var addrs []string
+		for _, a := range s.Addresses {
+			inst, ok := consul.InstanceFromAddress(a)
+			if !ok {
+				t.Fatalf("address %s without instance", a.Addr)
+			}
+			addrs = append(addrs, fmt.Sprintf("%s %s %d", a.Addr, inst.Meta[consul.ZoneMetaKey], inst.Weight))
+		}
+		sort.Strings(addrs)
+		return addrs
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for resolver state")
+	}
+	return nil
+}
+
+func equal(got []string, want ...string) bool {
+	return strings.Join(got, ",") == strings.Join(want, ",")
+}
+
+func TestStatic(t *testing.T) {
+	cc, r := build(t, "static:///10.0.0.1:8001, 10.0.0.2:8001?zone=zone-a")
+	if got := cc.next(t); !equal(got, "10.0.0.1:8001 zone-a 1", "10.0.0.2:8001 zone-a 1") {
+		t.Errorf("addresses = %v", got)
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	cc.next(t)
+
+	for _, target := range []string{"static:///", "static:///10.0.0.1"} {
+		if _, err := resolver.Get("static").Build(resolver.Target{Scheme: "static", Endpoint: strings.TrimPrefix(target, "static:///")}, &fakeClientConn{}, resolver.BuildOptions{}); err == nil {
+			t.Errorf("Build %s: want an error", target)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"device-service": [{"addr": "10.0.0.1:8001", "weight": 2, "zone": "zone-a"}, {"addr": "10.0.0.2:8001"}],
+		"other": [{"addr": "10.0.1.1:8001"}]}`)
+
+	cc, _ := build(t, "file://"+path+"?service=device-service&refresh=10ms")
+	if got := cc.next(t); !equal(got, "10.0.0.1:8001 zone-a 2", "10.0.0.2:8001  1") {
+		t.Errorf("addresses = %v", got)
+	}
+
+	write(`{"device-service": [{"addr": "10.0.0.3:8001"}]}`)
+	if got := cc.next(t); !equal(got, "10.0.0.3:8001  1") {
+		t.Errorf("addresses after change = %v", got)
+	}
+
+	// a broken file is reported and the last addresses are kept by gRPC
+	write(`{"device-service": [`)
+	select {
+	case err := <-cc.errs:
+		if !strings.Contains(err.Error(), "services.json") {
+			t.Errorf("error = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for error")
+	}
+}
+
+func TestFileList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	if err := os.WriteFile(path, []byte(`[{"addr": "127.0.0.1:8001"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cc, _ := build(t, "file://"+path)
+	if got := cc.next(t); !equal(got, "127.0.0.1:8001  1") {
+		t.Errorf("addresses = %v", got)
+	}
+}
+
+// fakeDNS answers the SRV records of device.example.com and the A records of their targets
+func fakeDNS(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	srvs := []dnsmessage.SRVResource{
+		{Priority: 10, Weight: 1, Port: 8001, Target: dnsmessage.MustNewName("a.example.com.")},
+		{Priority: 10, Weight: 3, Port: 8001, Target: dnsmessage.MustNewName("b.example.com.")},
+		{Priority: 20, Weight: 1, Port: 8001, Target: dnsmessage.MustNewName("c.example.com.")},
+	}
+	hosts := map[string][4]byte{
+		"a.example.com.": {10, 0, 0, 1},
+		"b.example.com.": {10, 0, 0, 2},
+		"c.example.com.": {10, 0, 0, 3},
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req dnsmessage.Message
+			if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) == 0 {
+				continue
+			}
+			q := req.Questions[0]
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.ID, Response: true, Authoritative: true},
+				Questions: req.Questions,
+			}
+			hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 30}
+			ip, isHost := hosts[q.Name.String()]
+			switch {
+			case q.Type == dnsmessage.TypeSRV && q.Name.String() == "device.example.com.":
+				for i := range srvs {
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &srvs[i]})
+				}
+			case q.Type == dnsmessage.TypeA && isHost:
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: ip}})
+			case isHost:
+			default:
+				resp.RCode = dnsmessage.RCodeNameError
+			}
+			out, _ := resp.Pack()
+			conn.WriteTo(out, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestSRV(t *testing.T) {
+	server := fakeDNS(t)
+	cc, _ := build(t, "srv://"+server+"/device.example.com.?zone=zone-b")
+	// only the lowest priority is used
+	if got := cc.next(t); !equal(got, "10.0.0.1:8001 zone-b 1", "10.0.0.2:8001 zone-b 3") {
+		t.Errorf("addresses = %v", got)
+	}
+
+	cc, _ = build(t, "srv://"+server+"/unknown.example.com.")
+	select {
+	case <-cc.errs:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for error")
+	}
+}
@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// FileInstance is an instance listed in a discovery file
+type FileInstance struct {
+	Addr   string            `json:"addr"`
+	Weight int               `json:"weight,omitempty"` // 1 when omitted
+	Zone   string            `json:"zone,omitempty"`
+	Meta   map[string]string `json:"meta,omitempty"`
+}
+
+// fileBackend reads the instances from a JSON file, checked for changes every
+// refresh interval:
+//
+//	file:///etc/rigoiot/services.json?service=device-service&refresh=2s
+//	file://./services.json
+//
+// The file holds a list of FileInstance, or an object of such lists by service
+// name when the service parameter is given:
+//
+//	{"device-service": [{"addr": "10.0.0.1:8001", "weight": 2, "zone": "zone-a"}]}
+type fileBackend struct {
+	path    string
+	service string
+	refresh time.Duration
+
+	modTime time.Time // of the file read by the last Resolve
+	size    int64
+}
+
+func newFileBackend(target Target) (Backend, error) {
+	b := &fileBackend{
+		// file:///etc/x.json is absolute, file://./x.json relative
+		path:    target.Authority + "/" + target.Path,
+		service: target.Query.Get("service"),
+	}
+	if target.Path == "" {
+		return nil, errors.New("discovery: no file provided")
+	}
+	var err error
+	if b.refresh, err = refresh(target, 2*time.Second); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *fileBackend) Resolve(context.Context) ([]resolver.Address, error) {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return nil, err
+	}
+	b.modTime, b.size = info.ModTime(), info.Size()
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []FileInstance
+	if b.service == "" {
+		err = json.Unmarshal(data, &instances)
+	} else {
+		var services map[string][]FileInstance
+		err = json.Unmarshal(data, &services)
+		instances = services[b.service]
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %v", b.path, err)
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no instance in %s", b.path)
+	}
+
+	addrs := make([]resolver.Address, 0, len(instances))
+	for _, inst := range instances {
+		if inst.Addr == "" {
+			return nil, fmt.Errorf("instance without addr in %s", b.path)
+		}
+		weight := inst.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		addrs = append(addrs, newAddress(inst.Addr, weight, inst.Zone, inst.Meta))
+	}
+	return addrs, nil
+}
+
+// Wait polls the file until its modification time or size changes
+func (b *fileBackend) Wait(ctx context.Context) {
+	for ctx.Err() == nil {
+		sleep(ctx, b.refresh)
+		info, err := os.Stat(b.path)
+		if err != nil || !info.ModTime().Equal(b.modTime) || info.Size() != b.size {
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// srvBackend queries the DNS SRV records of a name every refresh interval:
+//
+//	srv:///_grpc._tcp.device.example.com?refresh=30s
+//	srv://10.0.0.53:53/device-service.service.consul
+//
+// Only the records of the lowest priority are used, their weights become the
+// instance weights. The targets are resolved with the same DNS server.
+type srvBackend struct {
+	name     string
+	zone     string
+	resolver *net.Resolver
+	refresh  time.Duration
+}
+
+func newSRVBackend(target Target) (Backend, error) {
+	b := &srvBackend{
+		name:     strings.Trim(target.Path, "/"),
+		zone:     target.Query.Get("zone"),
+		resolver: net.DefaultResolver,
+	}
+	if b.name == "" {
+		return nil, errors.New("discovery: no SRV name provided")
+	}
+	var err error
+	if b.refresh, err = refresh(target, 30*time.Second); err != nil {
+		return nil, err
+	}
+
+	if server := target.Authority; server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		b.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return b, nil
+}
+
+func (b *srvBackend) Resolve(ctx context.Context) ([]resolver.Address, error) {
+	_, srvs, err := b.resolver.LookupSRV(ctx, "", "", b.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []resolver.Address
+	for _, srv := range srvs {
+		// sorted by priority
+		if srv.Priority != srvs[0].Priority {
+			break
+		}
+		hosts, err := b.resolver.LookupHost(ctx, strings.TrimSuffix(srv.Target, "."))
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			addr := net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+			addrs = append(addrs, newAddress(addr, int(srv.Weight), b.zone, nil))
+		}
+	}
+	return addrs, nil
+}
+
+// Wait sleeps the refresh interval
+func (b *srvBackend) Wait(ctx context.Context) {
+	sleep(ctx, b.refresh)
+}
@@ -0,0 +1,60 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/rigoiot/pkg/consul"
+	"google.golang.org/grpc/resolver"
+)
+
+// staticBackend is a fixed list of addresses:
+//
+//	static:///10.0.0.1:8001,10.0.0.2:8001?zone=zone-a
+//
+// the optional zone applies to all of them
+type staticBackend struct {
+	addrs []resolver.Address
+}
+
+func newStaticBackend(target Target) (Backend, error) {
+	zone := target.Query.Get("zone")
+	b := &staticBackend{}
+	for _, addr := range strings.Split(target.Path, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, errors.New("discovery: invalid static address " + addr)
+		}
+		b.addrs = append(b.addrs, newAddress(addr, 1, zone, nil))
+	}
+	if len(b.addrs) == 0 {
+		return nil, errors.New("discovery: no static address provided")
+	}
+	return b, nil
+}
+
+func (b *staticBackend) Resolve(context.Context) ([]resolver.Address, error) {
+	return b.addrs, nil
+}
+
+// Wait blocks until ctx is done, the addresses never change
+func (b *staticBackend) Wait(ctx context.Context) {
+	<-ctx.Done()
+}
+
+// newAddress returns the address carrying the consul instance of addr
+func newAddress(addr string, weight int, zone string, meta map[string]string) resolver.Address {
+	if zone != "" {
+		m := map[string]string{consul.ZoneMetaKey: zone}
+		for k, v := range meta {
+			m[k] = v
+		}
+		meta = m
+	}
+	return consul.NewAddress(addr, &consul.Instance{ID: addr, Meta: meta, Weight: weight})
+}
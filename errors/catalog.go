@@ -0,0 +1,146 @@
+package errors
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rigoiot/pkg/auth"
+	"golang.org/x/text/language"
+)
+
+// Message IDs of the built-in error mappings
+const (
+	MsgResourceNotExist        = "resource_not_exist"
+	MsgObjectNotFound          = "object_not_found"
+	MsgInvalidCollectionParam  = "invalid_collection_param"
+	MsgAlreadyExists           = "already_exists"
+	MsgAlreadyExistsField      = "already_exists_field"
+	MsgRecordNotFound          = "record_not_found"
+	MsgInternalError           = "internal_error"
+	MsgInternalErrorWithDetail = "internal_error_with_detail"
+)
+
+// Catalog maps message IDs to per-locale fmt templates
+type Catalog struct {
+	mu       sync.RWMutex
+	messages map[string]map[language.Tag]string
+}
+
+// NewCatalog returns an empty catalog
+func NewCatalog() *Catalog {
+	return &Catalog{messages: map[string]map[language.Tag]string{}}
+}
+
+// DefaultCatalog holds the messages of ErrorMappings, services register their own message IDs in it
+var DefaultCatalog = NewCatalog()
+
+func init() {
+	RegisterMessages(map[string]map[language.Tag]string{
+		MsgResourceNotExist: {
+			language.English:            "The resource does not exist.",
+			language.Chinese:            "资源不存在。",
+			language.TraditionalChinese: "資源不存在。",
+		},
+		MsgObjectNotFound: {
+			language.English:            "the specified object was not found.",
+			language.Chinese:            "未找到指定的对象。",
+			language.TraditionalChinese: "未找到指定的物件。",
+		},
+		MsgInvalidCollectionParam: {
+			language.English:            "Invalid collection operator parameter %q.",
+			language.Chinese:            "无效的集合操作参数 %q。",
+			language.TraditionalChinese: "無效的集合操作參數 %q。",
+		},
+		MsgAlreadyExists: {
+			language.English:            "There is already an existing '%s' object with the same '%s'.",
+			language.Chinese:            "已存在具有相同 '%[2]s' 的 '%[1]s' 对象。",
+			language.TraditionalChinese: "已存在具有相同 '%[2]s' 的 '%[1]s' 物件。",
+		},
+		MsgAlreadyExistsField: {
+			language.English:            "already exists",
+			language.Chinese:            "已存在",
+			language.TraditionalChinese: "已存在",
+		},
+		MsgRecordNotFound: {
+			language.English:            "record not found",
+			language.Chinese:            "记录不存在",
+			language.TraditionalChinese: "記錄不存在",
+		},
+		MsgInternalError: {
+			language.English:            "Internal error occured.",
+			language.Chinese:            "发生内部错误。",
+			language.TraditionalChinese: "發生內部錯誤。",
+		},
+		MsgInternalErrorWithDetail: {
+			language.English:            "Internal error occured. For more details see log for request %s",
+			language.Chinese:            "发生内部错误，详情请查看请求 %s 的日志",
+			language.TraditionalChinese: "發生內部錯誤，詳情請查看請求 %s 的日誌",
+		},
+	})
+}
+
+// Register adds or replaces the templates of a message ID
+func (c *Catalog) Register(id string, templates map[language.Tag]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.messages[id] == nil {
+		c.messages[id] = map[language.Tag]string{}
+	}
+	for tag, tmpl := range templates {
+		c.messages[id][tag] = tmpl
+	}
+}
+
+// Template returns the template of id for tag, falling back along the locale chain
+// of tag and then to English. The id itself is returned for unknown messages.
+func (c *Catalog) Template(tag language.Tag, id string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	templates, ok := c.messages[id]
+	if !ok {
+		return id
+	}
+	for _, t := range append(auth.FallbackChain(tag), language.English) {
+		if tmpl, ok := templates[t]; ok {
+			return tmpl
+		}
+	}
+	return id
+}
+
+// Sprintf formats the message id in the locale of the request
+func (c *Catalog) Sprintf(ctx context.Context, id string, args ...interface{}) string {
+	tmpl := c.Template(RequestLocale(ctx), id)
+	if len(args) == 0 {
+		return tmpl
+	}
+	return fmt.Sprintf(tmpl, args...)
+}
+
+// RegisterMessages adds message IDs to DefaultCatalog
+func RegisterMessages(messages map[string]map[language.Tag]string) {
+	for id, templates := range messages {
+		DefaultCatalog.Register(id, templates)
+	}
+}
+
+// Message formats the message id of DefaultCatalog in the locale of the request
+func Message(ctx context.Context, id string, args ...interface{}) string {
+	return DefaultCatalog.Sprintf(ctx, id, args...)
+}
+
+// RequestLocale returns the locale negotiated by auth.LocaleUnaryServerInterceptor,
+// else the Locale metadata read by auth.GetLocale, else English
+func RequestLocale(ctx context.Context) language.Tag {
+	if tag, ok := auth.LocaleFromContext(ctx); ok {
+		return tag
+	}
+	if val, err := auth.GetLocale(ctx, nil); err == nil {
+		if tag, err := language.Parse(strings.Replace(val, "_", "-", -1)); err == nil {
+			return tag
+		}
+	}
+	return language.English
+}
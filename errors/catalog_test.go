@@ -0,0 +1,161 @@
+package errors_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	toolkit "github.com/rigoiot/atlas-app-toolkit/errors"
+	"github.com/rigoiot/atlas-app-toolkit/requestid"
+	"github.com/rigoiot/atlas-app-toolkit/rpc/errfields"
+	"github.com/rigoiot/pkg/auth"
+	pkgerrors "github.com/rigoiot/pkg/errors"
+	"golang.org/x/text/language"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCatalogFallback(t *testing.T) {
+	c := pkgerrors.NewCatalog()
+	c.Register("greeting", map[language.Tag]string{
+		language.English:            "hello %s",
+		language.Chinese:            "你好 %s",
+		language.TraditionalChinese: "妳好 %s",
+	})
+	tests := map[string]string{
+		"zh-TW":   "妳好 %s",
+		"zh-HK":   "妳好 %s",
+		"zh-Hant": "妳好 %s",
+		"zh-CN":   "你好 %s",
+		"zh":      "你好 %s",
+		"en-GB":   "hello %s",
+		"fr":      "hello %s",
+	}
+	for tag, want := range tests {
+		if got := c.Template(language.Make(tag), "greeting"); got != want {
+			t.Errorf("Template(%s) = %q, want %q", tag, got, want)
+		}
+	}
+	if got := c.Template(language.English, "unknown"); got != "unknown" {
+		t.Errorf("Template of an unknown message = %q, want its id", got)
+	}
+
+	c.Register("chinese only", map[language.Tag]string{language.Chinese: "仅中文"})
+	if got := c.Template(language.French, "chinese only"); got != "chinese only" {
+		t.Errorf("Template without English = %q, want the id", got)
+	}
+}
+
+func TestMessageInRequestLocale(t *testing.T) {
+	ctx := auth.NewLocaleContext(context.Background(), language.TraditionalChinese)
+	if got := pkgerrors.Message(ctx, pkgerrors.MsgInvalidCollectionParam, "name"); got != `無效的集合操作參數 "name"。` {
+		t.Errorf("Message = %q", got)
+	}
+	if got := pkgerrors.Message(ctx, pkgerrors.MsgAlreadyExists, "device", "name"); got != "已存在具有相同 'name' 的 'device' 物件。" {
+		t.Errorf("Message with indexed verbs = %q", got)
+	}
+	if got := pkgerrors.Message(context.Background(), pkgerrors.MsgRecordNotFound); got != "record not found" {
+		t.Errorf("Message without locale = %q", got)
+	}
+}
+
+func TestRegisterMessagesOverrides(t *testing.T) {
+	const id = "test_register_messages"
+	pkgerrors.RegisterMessages(map[string]map[language.Tag]string{
+		id: {language.English: "first", language.Chinese: "第一"},
+	})
+	pkgerrors.RegisterMessages(map[string]map[language.Tag]string{
+		id: {language.English: "second"},
+	})
+	if got := pkgerrors.DefaultCatalog.Template(language.English, id); got != "second" {
+		t.Errorf("overridden template = %q, want second", got)
+	}
+	// other locales of the message are kept
+	if got := pkgerrors.DefaultCatalog.Template(language.Chinese, id); got != "第一" {
+		t.Errorf("kept template = %q, want 第一", got)
+	}
+}
+
+func TestRequestLocale(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want language.Tag
+	}{
+		{"empty", context.Background(), language.English},
+		{"negotiated", auth.NewLocaleContext(context.Background(), language.Chinese), language.Chinese},
+		{"locale metadata", metadata.NewIncomingContext(context.Background(), metadata.Pairs("Locale", "zh_TW")), language.Make("zh-TW")},
+		{"malformed metadata", metadata.NewIncomingContext(context.Background(), metadata.Pairs("Locale", "???")), language.English},
+		{"negotiated wins", auth.NewLocaleContext(
+			metadata.NewIncomingContext(context.Background(), metadata.Pairs("Locale", "zh-TW")), language.English), language.English},
+	}
+	for _, tt := range tests {
+		if got := pkgerrors.RequestLocale(tt.ctx); got != tt.want {
+			t.Errorf("%s: RequestLocale = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// mapError maps err with ErrorMappings and returns its status and field errors
+func mapError(ctx context.Context, err error) (*status.Status, map[string][]string) {
+	mapper := (&toolkit.Mapper{}).AddMapping(pkgerrors.ErrorMappings...)
+	st := status.Convert(mapper.Map(ctx, err))
+	fields := map[string][]string{}
+	for _, d := range st.Details() {
+		if fi, ok := d.(*errfields.FieldInfo); ok {
+			for target, v := range fi.Fields {
+				fields[target] = v.Values
+			}
+		}
+	}
+	return st, fields
+}
+
+// TestErrorMappingsEnglish pins the messages of the mappings before localization
+func TestErrorMappingsEnglish(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		err    error
+		code   codes.Code
+		msg    string
+		fields map[string]string
+	}{
+		{"not exists", ctx, errors.New("NOT_EXISTS"), codes.InvalidArgument,
+			"The resource does not exist.", map[string]string{"path/id": "the specified object was not found."}},
+		{"unknown column", ctx, errors.New(`pq: column "colour" does not exist`), codes.InvalidArgument,
+			`Invalid collection operator parameter "colour".`, nil},
+		{"unique violation", ctx, &pq.Error{Code: "23505", Message: "duplicate key", Detail: "Key (name)=(gateway) already exists."},
+			codes.AlreadyExists, "There is already an existing 'name' object with the same 'gateway'.", map[string]string{"name": "already exists"}},
+		{"record not found", ctx, gorm.ErrRecordNotFound, codes.NotFound, "record not found", nil},
+		{"internal", ctx, errors.New("boom"), codes.Internal, "Internal error occured.", nil},
+		{"internal with request id", requestid.NewContext(ctx, "req-42"), errors.New("boom"), codes.Internal,
+			"Internal error occured. For more details see log for request req-42", nil},
+	}
+	for _, tt := range tests {
+		st, fields := mapError(tt.ctx, tt.err)
+		if st.Code() != tt.code || st.Message() != tt.msg {
+			t.Errorf("%s: mapped to %s %q, want %s %q", tt.name, st.Code(), st.Message(), tt.code, tt.msg)
+		}
+		for target, msg := range tt.fields {
+			if got := fields[target]; len(got) != 1 || got[0] != msg {
+				t.Errorf("%s: field %s = %v, want [%s]", tt.name, target, got, msg)
+			}
+		}
+	}
+}
+
+func TestErrorMappingsLocalized(t *testing.T) {
+	ctx := auth.NewLocaleContext(context.Background(), language.Chinese)
+	st, fields := mapError(ctx, errors.New("NOT_EXISTS"))
+	if st.Message() != "资源不存在。" {
+		t.Errorf("message = %q", st.Message())
+	}
+	if got := fields["path/id"]; len(got) != 1 || got[0] != "未找到指定的对象。" {
+		t.Errorf("field = %v", got)
+	}
+}
@@ -17,6 +17,7 @@ import (
 )
 
 // ErrorMappings ...
+// Messages are taken from DefaultCatalog in the locale of the request.
 var ErrorMappings = []errors.MapFunc{
 
 	// Default Validation Mapping
@@ -24,23 +25,25 @@ var ErrorMappings = []errors.MapFunc{
 
 	errors.NewMapping(
 		errors.CondEq("NOT_EXISTS"),
-		errors.NewContainer(
-			codes.InvalidArgument, "The resource does not exist.",
-		).WithField(
-			"path/id", "the specified object was not found."),
+		errors.MapFunc(func(ctx context.Context, err error) (error, bool) {
+			return errors.NewContainer(
+				codes.InvalidArgument, "%s", Message(ctx, MsgResourceNotExist),
+			).WithField(
+				"path/id", "%s", Message(ctx, MsgObjectNotFound)), true
+		}),
 	),
 
 	errors.NewMapping(
 		errors.CondHasPrefix("pq:"),
 		errors.MapFunc(func(ctx context.Context, err error) (error, bool) {
 			if res := regexp.MustCompile(`column "(\w+)" does not exist`).FindStringSubmatch(err.Error()); len(res) > 0 {
-				return errors.NewContainer(codes.InvalidArgument, "Invalid collection operator parameter %q.", res[1]), true
+				return errors.NewContainer(codes.InvalidArgument, "%s", Message(ctx, MsgInvalidCollectionParam, res[1])), true
 			}
 			if pqErr, ok := err.(*pq.Error); ok && string(pqErr.Code) == "23505" {
 				res := regexp.MustCompile(`\((.*?)\)`).FindAllStringSubmatch(pqErr.Detail, -1)
 				if len(res) > 1 {
-					return errors.NewContainer(codes.AlreadyExists, "There is already an existing '%s' object with the same '%s'.", res[0][1], res[1][1]).WithField(
-						res[0][1], "already exists"), true
+					return errors.NewContainer(codes.AlreadyExists, "%s", Message(ctx, MsgAlreadyExists, res[0][1], res[1][1])).WithField(
+						res[0][1], "%s", Message(ctx, MsgAlreadyExistsField)), true
 				}
 			}
 
@@ -50,7 +53,9 @@ var ErrorMappings = []errors.MapFunc{
 
 	errors.NewMapping(
 		gorm.ErrRecordNotFound,
-		errors.NewContainer(codes.NotFound, "record not found"),
+		errors.MapFunc(func(ctx context.Context, err error) (error, bool) {
+			return errors.NewContainer(codes.NotFound, "%s", Message(ctx, MsgRecordNotFound)), true
+		}),
 	),
 
 	errors.NewMapping(
@@ -60,9 +65,9 @@ var ErrorMappings = []errors.MapFunc{
 			ctxlogrus.AddFields(ctx, logrus.Fields{"internal-error": err})
 			reqID, exist := requestid.FromContext(ctx)
 			if exist {
-				return errors.NewContainer(codes.Internal, "Internal error occured. For more details see log for request %s", reqID), true
+				return errors.NewContainer(codes.Internal, "%s", Message(ctx, MsgInternalErrorWithDetail, reqID)), true
 			}
-			return errors.NewContainer(codes.Internal, "Internal error occured."), true
+			return errors.NewContainer(codes.Internal, "%s", Message(ctx, MsgInternalError)), true
 		}),
 	),
 }
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rigoiot/pkg/auth"
+	"github.com/rigoiot/pkg/logger"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+//
+// ============================================================
+// Audit Record
+// ============================================================
+//
+
+// AuditRecord
+// 一条审计记录：谁（租户 / 用户）在什么时候调用了什么方法，结果如何
+type AuditRecord struct {
+	Timestamp string                 `json:"timestamp"`
+	Method    string                 `json:"method"`
+	Kind      string                 `json:"kind"` // read / write
+	AccountID string                 `json:"account_id,omitempty"`
+	UserID    string                 `json:"user_id,omitempty"`
+	ProjectID string                 `json:"project_id,omitempty"`
+	AppCode   string                 `json:"app_code,omitempty"`
+	Chain     []string               `json:"chain,omitempty"` // 实际操作者（代操作 / 服务委托），从最初到最近
+	ClientIP  string                 `json:"client_ip"`
+	Code      string                 `json:"code"`
+	LatencyMs float64                `json:"latency_ms"`
+	Request   map[string]interface{} `json:"request,omitempty"` // 已脱敏的请求内容（仅 unary）
+}
+
+//
+// ============================================================
+// Audit Sinks
+// ============================================================
+//
+
+// AuditSink
+// 审计记录的输出目标
+type AuditSink interface {
+	WriteAudit(record *AuditRecord) error
+}
+
+// FileAuditSink
+// 以 JSON Lines 格式写入按天 / 按大小滚动的文件（基于 logger 包）
+type FileAuditSink struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// NewFileAuditSink 创建文件审计输出
+//   - file: 审计文件路径，例如 ./log/audit.log
+//   - maxArchives: 保留的归档数量
+//   - rotateSize: 滚动大小，例如 "100MB"
+func NewFileAuditSink(file string, maxArchives int, rotateSize string) (*FileAuditSink, error) {
+	w, err := logger.NewRotateWriter(file, maxArchives, rotateSize)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{w: w}, nil
+}
+
+// WriteAudit 写入一条记录
+func (s *FileAuditSink) WriteAudit(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close 关闭文件
+func (s *FileAuditSink) Close() error {
+	return s.w.Close()
+}
+
+// NatsAuditSink
+// 通过 NatsPublisher 发布审计记录
+type NatsAuditSink struct {
+	Conn  NatsPublisher
+	Topic string
+}
+
+// WriteAudit 发布一条记录
+func (s *NatsAuditSink) WriteAudit(record *AuditRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.Conn.Publish(s.Topic, payload)
+}
+
+//
+// ============================================================
+// Audit Config
+// ============================================================
+//
+
+// AuditConfig 审计配置
+type AuditConfig struct {
+	Sink AuditSink // 审计输出，必填
+
+	// WritePatterns 判定为写操作的方法，支持精确匹配、前缀匹配（以 * 结尾）和 path.Match 通配
+	WritePatterns []string
+	// RecordReads 是否同时记录读操作，默认只记录写操作
+	RecordReads bool
+	// RedactFields 请求中需要脱敏的字段名（任意层级，不区分大小写）
+	RedactFields []string
+}
+
+// DefaultAuditWritePatterns 默认写操作方法
+var DefaultAuditWritePatterns = []string{
+	"/*/Create*",
+	"/*/Update*",
+	"/*/Delete*",
+	"/*/Set*",
+	"/*/Add*",
+	"/*/Remove*",
+	"/*/Patch*",
+}
+
+// DefaultAuditRedactFields 默认脱敏字段
+var DefaultAuditRedactFields = []string{"password", "secret", "token"}
+
+//
+// ============================================================
+// Audit Logic
+// ============================================================
+//
+
+// auditor 根据配置生成和输出审计记录
+type auditor struct {
+	conf   AuditConfig
+	redact map[string]bool
+}
+
+func newAuditor(conf AuditConfig) (*auditor, error) {
+	if conf.Sink == nil {
+		return nil, errors.New("server: AuditConfig.Sink is required")
+	}
+	if len(conf.WritePatterns) == 0 {
+		conf.WritePatterns = DefaultAuditWritePatterns
+	}
+	if conf.RedactFields == nil {
+		conf.RedactFields = DefaultAuditRedactFields
+	}
+	redact := make(map[string]bool, len(conf.RedactFields))
+	for _, f := range conf.RedactFields {
+		redact[strings.ToLower(f)] = true
+	}
+	return &auditor{conf: conf, redact: redact}, nil
+}
+
+// kind
+// 判断方法是读还是写
+func (a *auditor) kind(method string) string {
+	for _, pattern := range a.conf.WritePatterns {
+		if matchMethodPattern(pattern, method) {
+			return "write"
+		}
+	}
+	return "read"
+}
+
+// record
+// 生成并输出审计记录，输出失败只记日志，不影响请求
+func (a *auditor) record(ctx context.Context, method, kind string, req interface{}, start time.Time, err error) {
+	id, ok := auth.FromContext(ctx)
+	if !ok {
+		id = auth.ParseIdentity(ctx)
+	}
+
+	record := &AuditRecord{
+		Timestamp: start.Format(time.RFC3339Nano),
+		Method:    method,
+		Kind:      kind,
+		AccountID: uuidString(id.AccountID),
+		UserID:    uuidString(id.UserID),
+		ProjectID: uuidString(id.ProjectID),
+		AppCode:   id.AppCode,
+		ClientIP:  getClientIP(ctx),
+		Code:      status.Code(err).String(),
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	for _, actor := range id.Chain() {
+		record.Chain = append(record.Chain, actor.String())
+	}
+	if req != nil {
+		record.Request = a.redactRequest(req)
+	}
+
+	if err := a.conf.Sink.WriteAudit(record); err != nil {
+		logger.Errorf("[AUDIT] write record of %s error: %v", method, err)
+	}
+}
+
+// redactRequest
+// 将请求转换为 map 并替换需要脱敏的字段
+func (a *auditor) redactRequest(req interface{}) map[string]interface{} {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	a.redactValue(m)
+	return m
+}
+
+func (a *auditor) redactValue(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if a.redact[strings.ToLower(k)] {
+				v[k] = "***"
+				continue
+			}
+			a.redactValue(item)
+		}
+	case []interface{}:
+		for _, item := range v {
+			a.redactValue(item)
+		}
+	}
+}
+
+func uuidString(id uuid.UUID) string {
+	if id == uuid.Nil {
+		return ""
+	}
+	return id.String()
+}
+
+// matchMethodPattern
+// 方法匹配：精确匹配、前缀匹配（以 * 结尾）、path.Match 通配
+func matchMethodPattern(pattern, method string) bool {
+	if pattern == method {
+		return true
+	}
+	if strings.HasSuffix(pattern, "*") && strings.HasPrefix(method, strings.TrimSuffix(pattern, "*")) {
+		return true
+	}
+	ok, _ := path.Match(pattern, method)
+	return ok
+}
+
+//
+// ============================================================
+// Audit Interceptors
+// ============================================================
+//
+
+// UnaryAuditInterceptor
+// 记录写操作（以及可选的读操作）的审计日志
+// 应放在 auth 拦截器之后，以便读取已验证的身份，conf 无效时返回错误
+func UnaryAuditInterceptor(conf AuditConfig) (grpc.UnaryServerInterceptor, error) {
+	a, err := newAuditor(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+
+		kind := a.kind(info.FullMethod)
+		if kind == "read" && !a.conf.RecordReads {
+			return handler(ctx, req)
+		}
+
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		a.record(ctx, info.FullMethod, kind, req, start, err)
+		return resp, err
+	}, nil
+}
+
+// StreamAuditInterceptor
+// 记录 stream 调用的审计日志（不包含请求内容），conf 无效时返回错误
+func StreamAuditInterceptor(conf AuditConfig) (grpc.StreamServerInterceptor, error) {
+	a, err := newAuditor(conf)
+	if err != nil {
+		return nil, err
+	}
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+
+		kind := a.kind(info.FullMethod)
+		if kind == "read" && !a.conf.RecordReads {
+			return handler(srv, ss)
+		}
+
+		start := time.Now()
+		err := handler(srv, ss)
+		a.record(ss.Context(), info.FullMethod, kind, nil, start, err)
+		return err
+	}, nil
+}
@@ -0,0 +1,293 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/rigoiot/pkg/auth"
+	server "github.com/rigoiot/pkg/grpc"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// memorySink 在内存中保存审计记录
+type memorySink struct {
+	mu      sync.Mutex
+	records []*server.AuditRecord
+	err     error
+}
+
+func (s *memorySink) WriteAudit(record *server.AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return s.err
+}
+
+func (s *memorySink) all() []*server.AuditRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*server.AuditRecord{}, s.records...)
+}
+
+type credential struct {
+	Kind  string `json:"kind"`
+	Token string `json:"Token"`
+}
+
+type createUserRequest struct {
+	Name        string       `json:"name"`
+	Password    string       `json:"password"`
+	Credentials []credential `json:"credentials"`
+	Profile     struct {
+		Secret string `json:"secret"`
+		Email  string `json:"email"`
+	} `json:"profile"`
+}
+
+var (
+	auditAccountID = uuid.FromStringOrNil("5f3c9b6e-2a41-4c1f-9d55-8a7f0e2b1c34")
+	auditUserID    = uuid.FromStringOrNil("0e8d7c6b-5a49-4382-9170-6f5e4d3c2b1a")
+)
+
+// auditContext 返回带有身份和客户端地址的请求上下文
+func auditContext() context.Context {
+	id := &auth.Identity{AccountID: auditAccountID, UserID: auditUserID, AppCode: "gateway"}
+	ctx := auth.NewContext(context.Background(), id)
+	return peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 50123}})
+}
+
+func callUnary(interceptor grpc.UnaryServerInterceptor, ctx context.Context, method string, req interface{}, err error) error {
+	_, got := interceptor(ctx, req, &grpc.UnaryServerInfo{FullMethod: method},
+		func(context.Context, interface{}) (interface{}, error) { return nil, err })
+	return got
+}
+
+// unaryAudit returns the unary audit interceptor of conf
+func unaryAudit(t *testing.T, conf server.AuditConfig) grpc.UnaryServerInterceptor {
+	t.Helper()
+	interceptor, err := server.UnaryAuditInterceptor(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return interceptor
+}
+
+func TestAuditConfigRequiresSink(t *testing.T) {
+	if _, err := server.UnaryAuditInterceptor(server.AuditConfig{}); err == nil {
+		t.Error("UnaryAuditInterceptor without sink: want an error")
+	}
+	if _, err := server.StreamAuditInterceptor(server.AuditConfig{}); err == nil {
+		t.Error("StreamAuditInterceptor without sink: want an error")
+	}
+}
+
+func TestUnaryAuditInterceptorClassification(t *testing.T) {
+	sink := &memorySink{}
+	interceptor := unaryAudit(t, server.AuditConfig{Sink: sink})
+	for _, method := range []string{
+		"/user.UserService/CreateUser",
+		"/user.UserService/UpdateUser",
+		"/user.UserService/DeleteUser",
+		"/device.DeviceService/SetConfig",
+		"/user.UserService/GetUser",
+		"/user.UserService/ListUsers",
+	} {
+		callUnary(interceptor, auditContext(), method, nil, nil)
+	}
+	records := sink.all()
+	if len(records) != 4 {
+		t.Fatalf("%d records, want the 4 writes", len(records))
+	}
+	for _, r := range records {
+		if r.Kind != "write" {
+			t.Errorf("%s kind = %s, want write", r.Method, r.Kind)
+		}
+	}
+}
+
+func TestUnaryAuditInterceptorRecordReads(t *testing.T) {
+	sink := &memorySink{}
+	interceptor := unaryAudit(t, server.AuditConfig{
+		Sink:          sink,
+		RecordReads:   true,
+		WritePatterns: []string{"/device.DeviceService/Reboot"},
+	})
+	callUnary(interceptor, auditContext(), "/device.DeviceService/Reboot", nil, nil)
+	callUnary(interceptor, auditContext(), "/device.DeviceService/CreateDevice", nil, nil)
+
+	records := sink.all()
+	if len(records) != 2 || records[0].Kind != "write" || records[1].Kind != "read" {
+		t.Fatalf("records = %+v, want a write then a read", records)
+	}
+}
+
+func TestUnaryAuditInterceptorRecord(t *testing.T) {
+	sink := &memorySink{}
+	interceptor := unaryAudit(t, server.AuditConfig{Sink: sink})
+
+	req := &createUserRequest{Name: "alice", Password: "p4ss", Credentials: []credential{{Kind: "api", Token: "t0k3n"}}}
+	req.Profile.Secret, req.Profile.Email = "s3cr3t", "alice@example.com"
+	err := callUnary(interceptor, auditContext(), "/user.UserService/CreateUser", req, status.Error(codes.AlreadyExists, "exists"))
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("handler error = %v, want it returned as is", err)
+	}
+
+	records := sink.all()
+	if len(records) != 1 {
+		t.Fatalf("%d records, want 1", len(records))
+	}
+	r := records[0]
+	if r.Method != "/user.UserService/CreateUser" || r.Code != "AlreadyExists" || r.ClientIP != "10.0.0.7" ||
+		r.AccountID != auditAccountID.String() || r.UserID != auditUserID.String() || r.ProjectID != "" || r.AppCode != "gateway" {
+		t.Errorf("record = %+v", r)
+	}
+
+	data, _ := json.Marshal(r.Request)
+	var got createUserRequest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("request %s: %v", data, err)
+	}
+	if got.Name != "alice" || got.Profile.Email != "alice@example.com" || got.Credentials[0].Kind != "api" {
+		t.Errorf("request fields lost: %s", data)
+	}
+	if got.Password != "***" || got.Profile.Secret != "***" || got.Credentials[0].Token != "***" {
+		t.Errorf("request not redacted: %s", data)
+	}
+}
+
+func TestUnaryAuditInterceptorCustomRedaction(t *testing.T) {
+	sink := &memorySink{}
+	interceptor := unaryAudit(t, server.AuditConfig{Sink: sink, RedactFields: []string{"EMAIL"}})
+	req := &createUserRequest{Name: "alice", Password: "p4ss"}
+	req.Profile.Email = "alice@example.com"
+	callUnary(interceptor, auditContext(), "/user.UserService/CreateUser", req, nil)
+
+	r := sink.all()[0]
+	profile, _ := r.Request["profile"].(map[string]interface{})
+	if profile["email"] != "***" || r.Request["password"] != "p4ss" {
+		t.Errorf("request = %v, want only email redacted", r.Request)
+	}
+}
+
+func TestUnaryAuditInterceptorChain(t *testing.T) {
+	sink := &memorySink{}
+	interceptor := unaryAudit(t, server.AuditConfig{Sink: sink})
+	ctx := auth.WithServiceActor(auditContext(), "gateway")
+	callUnary(interceptor, ctx, "/user.UserService/DeleteUser", nil, nil)
+
+	if r := sink.all()[0]; len(r.Chain) != 1 || r.Chain[0] != "service:gateway" {
+		t.Errorf("chain = %v, want [service:gateway]", r.Chain)
+	}
+}
+
+func TestUnaryAuditInterceptorSinkError(t *testing.T) {
+	sink := &memorySink{err: errors.New("sink down")}
+	interceptor := unaryAudit(t, server.AuditConfig{Sink: sink})
+	if err := callUnary(interceptor, auditContext(), "/user.UserService/CreateUser", nil, nil); err != nil {
+		t.Errorf("request failed with the sink: %v", err)
+	}
+}
+
+// fakeServerStream 只提供上下文
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeServerStream) Context() context.Context { return s.ctx }
+
+func TestStreamAuditInterceptor(t *testing.T) {
+	sink := &memorySink{}
+	interceptor, err := server.StreamAuditInterceptor(server.AuditConfig{Sink: sink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := &fakeServerStream{ctx: auditContext()}
+	handlerErr := status.Error(codes.PermissionDenied, "denied")
+	call := func(method string) error {
+		return interceptor(nil, ss, &grpc.StreamServerInfo{FullMethod: method},
+			func(interface{}, grpc.ServerStream) error { return handlerErr })
+	}
+
+	if err := call("/device.DeviceService/UpdateFirmware"); err != handlerErr {
+		t.Errorf("handler error = %v, want it returned as is", err)
+	}
+	call("/device.DeviceService/WatchDevices")
+
+	records := sink.all()
+	if len(records) != 1 {
+		t.Fatalf("%d records, want only the write", len(records))
+	}
+	r := records[0]
+	if r.Kind != "write" || r.Code != "PermissionDenied" || r.UserID != auditUserID.String() || r.Request != nil {
+		t.Errorf("record = %+v", r)
+	}
+}
+
+// fakePublisher 记录发布的消息
+type fakePublisher struct {
+	subject string
+	data    []byte
+}
+
+func (p *fakePublisher) Publish(subject string, data []byte) error {
+	p.subject, p.data = subject, data
+	return nil
+}
+
+func TestNatsAuditSink(t *testing.T) {
+	pub := &fakePublisher{}
+	sink := &server.NatsAuditSink{Conn: pub, Topic: "audit.records"}
+	if err := sink.WriteAudit(&server.AuditRecord{Method: "/a.A/CreateA", Kind: "write"}); err != nil {
+		t.Fatal(err)
+	}
+	var r server.AuditRecord
+	if err := json.Unmarshal(pub.data, &r); err != nil || pub.subject != "audit.records" || r.Method != "/a.A/CreateA" {
+		t.Errorf("published %s on %s: %v", pub.data, pub.subject, err)
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := server.NewFileAuditSink(file, 3, "10MB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"/a.A/CreateA", "/a.A/DeleteA"} {
+		if err := sink.WriteAudit(&server.AuditRecord{Method: method, Kind: "write"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var methods []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r server.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		methods = append(methods, r.Method)
+	}
+	if len(methods) != 2 || methods[0] != "/a.A/CreateA" || methods[1] != "/a.A/DeleteA" {
+		t.Errorf("lines = %v", methods)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import "time"
+
+// 供 server_test 测试的内部实现
+
+var (
+	ParseRateLimiterConfig         = parseRateLimiterConfig
+	ReloadRateLimiterConfig        = reloadRateLimiterConfig
+	ReloadDefaultRateLimiterConfig = reloadDefaultRateLimiterConfig
+)
+
+// Reload 与 WatchConsul 的一次变更相同
+func (l *RateLimiter) Reload(base RateLimiterConfig, key string, value []byte) {
+	l.reload(base, key, value)
+}
+
+// MethodLimit 返回 method 生效的限流参数
+func (c RateLimiterConfig) MethodLimit(method string) MethodLimit {
+	return c.methodLimit(method)
+}
+
+// ConfigPointer 返回当前生效配置的指针，用于模拟在配置变更前开始的请求
+func (l *RateLimiter) ConfigPointer() *RateLimiterConfig {
+	return l.conf.Load()
+}
+
+// RefLimiter 以请求开始时读取的 conf 获取并占用 ip|method 的限流器
+// 返回限流器当前的并发上限和释放函数
+func (l *RateLimiter) RefLimiter(conf *RateLimiterConfig, ip, method string) (int, func()) {
+	b := l.getLimiter(conf, ip, method)
+	b.conc.mu.Lock()
+	defer b.conc.mu.Unlock()
+	return b.conc.limit, b.unref
+}
+
+// Evict 以 now 为当前时间立即清理一次
+func (l *RateLimiter) Evict(now time.Time) {
+	l.evict(now)
+}
+
+// Keys 返回 ip|method 限流器的数量
+func (l *RateLimiter) Keys() int64 {
+	return l.keys.Load()
+}
@@ -3,8 +3,13 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -36,6 +41,31 @@ var grpcRateLimitedTotal = promauto.NewCounterVec(
 	[]string{"key", "direction"},
 )
 
+// grpcRateLimiterKeys
+// 当前存在的 ip|method 限流器数量
+// label:
+//   - instance: RateLimiter 的名称，默认实例为 default
+var grpcRateLimiterKeys = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "grpc_rate_limiter_keys",
+		Help: "Live per ip and method rate limiters",
+	},
+	[]string{"instance"},
+)
+
+// grpcRateLimiterEvictionsTotal
+// 统计被清理的限流器数量
+// label:
+//   - instance: RateLimiter 的名称，默认实例为 default
+//   - reason: idle / capacity
+var grpcRateLimiterEvictionsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "grpc_rate_limiter_evictions_total",
+		Help: "Evicted per ip and method rate limiters",
+	},
+	[]string{"instance", "reason"},
+)
+
 //
 // ============================================================
 // NATS Interface
@@ -54,19 +84,85 @@ type NatsPublisher interface {
 //
 
 // RateLimiterConfig
-// 所有限流相关配置集中在这里，方便未来做动态配置（Consul / etcd）
+// 所有限流相关配置集中在这里，可以通过 WatchRateLimiterConfig 从 Consul KV 动态加载
 type RateLimiterConfig struct {
-	Rate             float64 // QPS：每秒允许通过的请求数
-	Burst            int     // 突发容量：允许短时间内瞬间放行的请求数
-	Concurrent       int     // 每个 IP + Method 的最大并发数
-	GlobalConcurrent int     // 整个 gRPC Server 的最大并发数（保命）
+	Rate             float64 `json:"rate" yaml:"rate"`                           // QPS：每秒允许通过的请求数
+	Burst            int     `json:"burst" yaml:"burst"`                         // 突发容量：允许短时间内瞬间放行的请求数
+	Concurrent       int     `json:"concurrent" yaml:"concurrent"`               // 每个 IP + Method 的最大并发数
+	GlobalConcurrent int     `json:"global_concurrent" yaml:"global_concurrent"` // 整个 gRPC Server 的最大并发数（保命）
+
+	NatsConn       NatsPublisher `json:"-" yaml:"-"`                             // NATS 发布器实例，由调用方初始化和管理
+	NatsTopic      string        `json:"nats_topic" yaml:"nats_topic"`           // NATS 限流通知主题
+	BypassPatterns []string      `json:"bypass_patterns" yaml:"bypass_patterns"` // 不进行限流的 gRPC 方法
+
+	// Methods 按方法覆盖的限流参数，key 支持精确匹配和前缀匹配（以 * 结尾），精确匹配优先
+	Methods map[string]MethodLimit `json:"methods" yaml:"methods"`
+
+	// IdleTTL 超过该时长未使用的 ip|method 限流器会被清理，0 表示不按空闲时间清理
+	// YAML 中写作 10m，JSON 中为纳秒数
+	IdleTTL time.Duration `json:"idle_ttl" yaml:"idle_ttl"`
+	// MaxKeys ip|method 限流器的数量上限，超过时清理最久未使用的，0 表示不限制
+	MaxKeys int `json:"max_keys" yaml:"max_keys"`
+}
 
-	NatsConn       NatsPublisher // NATS 发布器实例，由调用方初始化和管理
-	NatsTopic      string        // NATS 限流通知主题
-	BypassPatterns []string      // 不进行限流的 gRPC 方法
+// MethodLimit
+// 单个方法的限流参数，为 0 的字段沿用全局配置
+type MethodLimit struct {
+	Rate       float64 `json:"rate" yaml:"rate"`
+	Burst      int     `json:"burst" yaml:"burst"`
+	Concurrent int     `json:"concurrent" yaml:"concurrent"`
 }
 
-// 默认配置（生产可直接用，偏保守）
+// Validate 校验配置，动态加载的配置校验失败时不会生效
+func (c RateLimiterConfig) Validate() error {
+	if c.Rate <= 0 || c.Burst <= 0 || c.Concurrent <= 0 || c.GlobalConcurrent <= 0 {
+		return fmt.Errorf("rate, burst, concurrent and global_concurrent must be positive")
+	}
+	for pattern, limit := range c.Methods {
+		if pattern == "" {
+			return fmt.Errorf("empty method pattern")
+		}
+		if limit.Rate < 0 || limit.Burst < 0 || limit.Concurrent < 0 {
+			return fmt.Errorf("negative limit for method %s", pattern)
+		}
+	}
+	if c.IdleTTL < 0 || c.MaxKeys < 0 {
+		return fmt.Errorf("idle_ttl and max_keys must not be negative")
+	}
+	return nil
+}
+
+// methodLimit
+// 返回 method 生效的限流参数
+func (c RateLimiterConfig) methodLimit(method string) MethodLimit {
+	limit := MethodLimit{Rate: c.Rate, Burst: c.Burst, Concurrent: c.Concurrent}
+
+	override, ok := c.Methods[method]
+	if !ok {
+		// 前缀匹配取最长的前缀
+		longest := -1
+		for pattern, l := range c.Methods {
+			if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern &&
+				strings.HasPrefix(method, prefix) && len(prefix) > longest {
+				override, longest = l, len(prefix)
+			}
+		}
+	}
+	if override.Rate > 0 {
+		limit.Rate = override.Rate
+	}
+	if override.Burst > 0 {
+		limit.Burst = override.Burst
+	}
+	if override.Concurrent > 0 {
+		limit.Concurrent = override.Concurrent
+	}
+	return limit
+}
+
+// 默认配置（生产可直接用，偏保守），也是默认限流器当前的配置
+// 直接修改（例如启动时赋值 BypassPatterns）在创建包级拦截器时生效，
+// 之后的直接修改会被忽略，运行时请使用 ApplyRateLimiterConfig 或 InitRateLimiterConfig
 var DefaultRateLimiterConfig = RateLimiterConfig{
 	Rate:             50,
 	Burst:            100,
@@ -79,39 +175,368 @@ var DefaultRateLimiterConfig = RateLimiterConfig{
 		"/grpc.health.v1.Health/Check",
 		"/grpc.health.v1.Health/Watch",
 	},
+
+	IdleTTL: 10 * time.Minute,
+	MaxKeys: 100000,
 }
 
 //
 // ============================================================
-// Limiter Storage（QPS + 并发）
+// Rate Limiter（限流器实例）
 // ============================================================
 //
 
+// RateLimiter
+// 一个独立的限流器实例，拥有自己的配置、按 ip|method 的限流器和全局信号量
+// 同一进程内的多个 gRPC Server 可以各自使用不同的实例
+// 配置可以在运行时修改：已有的限流器和信号量原地调整容量，进行中的请求不受影响
+// 后台 janitor 按 IdleTTL / MaxKeys 清理空闲的限流器，在创建第一个限流器时启动，不再使用时调用 Close 停止
+type RateLimiter struct {
+	// name 指标中的 instance label
+	name string
+
+	// keysGauge 本实例的 grpcRateLimiterKeys
+	keysGauge prometheus.Gauge
+
+	// mu 串行化配置修改
+	mu sync.Mutex
+
+	// conf 当前生效的 *RateLimiterConfig，每个请求只读取一次
+	conf atomic.Pointer[RateLimiterConfig]
+
+	// limiters
+	// key = ip|method
+	// value = *limiterBundle
+	limiters sync.Map
+
+	// keys limiters 中的数量
+	keys atomic.Int64
+
+	// global
+	// 控制整个 gRPC Server 同时在处理的请求数
+	// 防止：
+	//   - goroutine 无限增长
+	//   - DB / 下游 RPC 被拖死
+	global *semaphore
+
+	// janitor 的控制
+	overflow    chan struct{} // 数量超过 MaxKeys 时通知 janitor 立即清理
+	stop        chan struct{}
+	done        chan struct{}
+	janitorOnce sync.Once // 启动 janitor，或在未启动时由 Close 占用
+	closeOnce   sync.Once
+}
+
+// rateLimiterSeq 未命名的 RateLimiter 的序号
+var rateLimiterSeq atomic.Int64
+
+// NewRateLimiter 以 config 创建限流器，config 需通过 Validate 校验
+// name 作为指标的 instance label，用于区分同一进程内的多个实例，默认为 limiter-<序号>
+func NewRateLimiter(config RateLimiterConfig, name ...string) (*RateLimiter, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	l := &RateLimiter{
+		global:   newSemaphore(config.GlobalConcurrent),
+		overflow: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if len(name) > 0 && name[0] != "" {
+		l.name = name[0]
+	} else {
+		l.name = fmt.Sprintf("limiter-%d", rateLimiterSeq.Add(1))
+	}
+	l.keysGauge = grpcRateLimiterKeys.WithLabelValues(l.name)
+	l.conf.Store(&config)
+	return l, nil
+}
+
+// Name 返回指标中的 instance label
+func (l *RateLimiter) Name() string {
+	return l.name
+}
+
+// Config 返回当前生效的配置
+func (l *RateLimiter) Config() RateLimiterConfig {
+	return *l.conf.Load()
+}
+
+// ApplyConfig 校验并整体替换配置（不做默认值合并）
+// 校验失败时返回错误，当前配置保持不变
+// 全局信号量立即调整容量，各 ip|method 的限流器在下一次请求时调整
+func (l *RateLimiter) ApplyConfig(config RateLimiterConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conf.Store(&config)
+	l.global.setLimit(config.GlobalConcurrent)
+	return nil
+}
+
+// Close 停止 janitor，拦截器仍可使用但不再清理限流器
+func (l *RateLimiter) Close() {
+	l.closeOnce.Do(func() {
+		// 未启动的 janitor 不再启动
+		l.janitorOnce.Do(func() { close(l.done) })
+		close(l.stop)
+		<-l.done
+	})
+}
+
 // limiterBundle
 // 每一个 key（ip|method）对应一套完整的限流器
 //   - qps  : 令牌桶（限制速率）
 //   - conc : 信号量（限制并发）
 type limiterBundle struct {
 	qps  *rate.Limiter
-	conc chan struct{}
-}
+	conc *semaphore
 
-// limiterMap
-// key = ip|method
-// value = *limiterBundle
-var limiterMap sync.Map
+	mu       sync.Mutex
+	conf     *RateLimiterConfig // 限流参数所依据的配置，配置变更后由 ref 更新
+	refs     int                // 正在使用的请求 / stream 数，不为 0 时不会被清理
+	lastUsed time.Time          // 最近一次使用的时间
+	evicted  bool               // 已从 limiters 中清理
+}
 
 // getLimiter
-// 获取或创建某个 key 对应的 limiter
-func getLimiter(key string) *limiterBundle {
-	v, _ := limiterMap.LoadOrStore(key, &limiterBundle{
-		qps: rate.NewLimiter(
-			rate.Limit(DefaultRateLimiterConfig.Rate),
-			DefaultRateLimiterConfig.Burst,
-		),
-		conc: make(chan struct{}, DefaultRateLimiterConfig.Concurrent),
+// 获取或创建某个 ip + method 对应的 limiter 并占用，使用完后必须调用 unref
+func (l *RateLimiter) getLimiter(conf *RateLimiterConfig, ip, method string) *limiterBundle {
+	key := ip + "|" + method
+	for {
+		v, ok := l.limiters.Load(key)
+		if !ok {
+			limit := conf.methodLimit(method)
+			v, ok = l.limiters.LoadOrStore(key, &limiterBundle{
+				qps:  rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst),
+				conc: newSemaphore(limit.Concurrent),
+				conf: conf,
+			})
+			if !ok {
+				l.addKey(conf)
+			}
+		}
+		if b := v.(*limiterBundle); b.ref(&l.conf, method) {
+			return b
+		}
+		// 刚被 janitor 清理，重新创建
+	}
+}
+
+// addKey
+// 记录新建的限流器，超过 MaxKeys 时通知 janitor
+func (l *RateLimiter) addKey(conf *RateLimiterConfig) {
+	l.janitorOnce.Do(func() { go l.janitor() })
+	l.keysGauge.Inc()
+	if n := l.keys.Add(1); conf.MaxKeys > 0 && n > int64(conf.MaxKeys) {
+		select {
+		case l.overflow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ref
+// 占用 limiter，并按 current 中当前生效的配置原地调整限流参数（保留令牌桶中的令牌和已占用的并发名额）
+// 在持有 b.mu 时读取 current，配置变更前开始的请求不会把 limiter 调回旧配置
+// 已被清理时返回 false
+func (b *limiterBundle) ref(current *atomic.Pointer[RateLimiterConfig], method string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.evicted {
+		return false
+	}
+	if conf := current.Load(); b.conf != conf {
+		limit := conf.methodLimit(method)
+		b.qps.SetLimit(rate.Limit(limit.Rate))
+		b.qps.SetBurst(limit.Burst)
+		b.conc.setLimit(limit.Concurrent)
+		b.conf = conf
+	}
+	b.refs++
+	b.lastUsed = time.Now()
+	return true
+}
+
+// unref
+// 释放 ref 的占用
+func (b *limiterBundle) unref() {
+	b.mu.Lock()
+	b.refs--
+	b.lastUsed = time.Now()
+	b.mu.Unlock()
+}
+
+//
+// ============================================================
+// Janitor（清理空闲限流器）
+// ============================================================
+//
+
+// janitor
+// 定期清理空闲的限流器，直到 Close
+// 由第一次 addKey 启动，未处理过请求的实例（例如未使用的默认实例）不会启动 goroutine
+func (l *RateLimiter) janitor() {
+	defer close(l.done)
+
+	t := time.NewTimer(l.conf.Load().janitorInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+		case <-l.overflow:
+			if !t.Stop() {
+				<-t.C
+			}
+		}
+		l.evict(time.Now())
+		t.Reset(l.conf.Load().janitorInterval())
+	}
+}
+
+// janitorInterval
+// 清理间隔：IdleTTL 的 1/4，限制在 1s ~ 1m 之间
+func (c *RateLimiterConfig) janitorInterval() time.Duration {
+	if c.IdleTTL <= 0 {
+		return time.Minute
+	}
+	d := c.IdleTTL / 4
+	if d < time.Second {
+		d = time.Second
+	}
+	if d > time.Minute {
+		d = time.Minute
+	}
+	return d
+}
+
+// evict
+// 清理空闲超过 IdleTTL 的限流器；数量超过 MaxKeys 时按最近使用时间清理到 MaxKeys 的 90%
+// 正在使用（占用并发名额）的限流器不会被清理
+func (l *RateLimiter) evict(now time.Time) {
+	conf := l.conf.Load()
+
+	type candidate struct {
+		key      interface{}
+		bundle   *limiterBundle
+		lastUsed time.Time
+	}
+	var idle []candidate
+	l.limiters.Range(func(key, v interface{}) bool {
+		b := v.(*limiterBundle)
+		b.mu.Lock()
+		refs, lastUsed := b.refs, b.lastUsed
+		b.mu.Unlock()
+		if refs > 0 {
+			return true
+		}
+		if conf.IdleTTL > 0 && now.Sub(lastUsed) >= conf.IdleTTL {
+			l.remove(key, b, lastUsed, "idle")
+			return true
+		}
+		idle = append(idle, candidate{key, b, lastUsed})
+		return true
 	})
-	return v.(*limiterBundle)
+
+	if conf.MaxKeys <= 0 || l.keys.Load() <= int64(conf.MaxKeys) {
+		return
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].lastUsed.Before(idle[j].lastUsed) })
+	target := int64(conf.MaxKeys) * 9 / 10
+	for _, c := range idle {
+		if l.keys.Load() <= target {
+			break
+		}
+		l.remove(c.key, c.bundle, c.lastUsed, "capacity")
+	}
+}
+
+// remove
+// 在 b 仍未被使用且 lastUsed 未变化时清理 b
+func (l *RateLimiter) remove(key interface{}, b *limiterBundle, lastUsed time.Time, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.evicted || b.refs > 0 || !b.lastUsed.Equal(lastUsed) {
+		return
+	}
+	b.evicted = true
+	l.limiters.CompareAndDelete(key, b)
+	l.keys.Add(-1)
+	l.keysGauge.Dec()
+	grpcRateLimiterEvictionsTotal.WithLabelValues(l.name, reason).Inc()
+}
+
+//
+// ============================================================
+// Semaphore（可调整容量的信号量）
+// ============================================================
+//
+
+// semaphore
+// 非阻塞信号量，容量可以在运行时调整
+// 缩容时已占用的名额继续有效，释放后才会低于新容量
+type semaphore struct {
+	mu    sync.Mutex
+	limit int
+	used  int
+}
+
+func newSemaphore(limit int) *semaphore {
+	return &semaphore{limit: limit}
+}
+
+// tryAcquire
+// 尝试获取一个名额
+func (s *semaphore) tryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used >= s.limit {
+		return false
+	}
+	s.used++
+	return true
+}
+
+// release
+// 释放一个名额
+func (s *semaphore) release() {
+	s.mu.Lock()
+	s.used--
+	s.mu.Unlock()
+}
+
+// setLimit
+// 调整容量
+func (s *semaphore) setLimit(limit int) {
+	s.mu.Lock()
+	s.limit = limit
+	s.mu.Unlock()
+}
+
+//
+// ============================================================
+// Default Rate Limiter（包级函数使用的默认实例）
+// ============================================================
+//
+
+var (
+	// defaultRateLimiter 包级拦截器使用的实例
+	defaultRateLimiter *RateLimiter
+
+	// rateLimiterConfigMu 保护 DefaultRateLimiterConfig 的修改
+	rateLimiterConfigMu sync.Mutex
+)
+
+func init() {
+	var err error
+	if defaultRateLimiter, err = NewRateLimiter(DefaultRateLimiterConfig, "default"); err != nil {
+		panic("server: invalid DefaultRateLimiterConfig: " + err.Error())
+	}
 }
 
 //
@@ -120,7 +545,7 @@ func getLimiter(key string) *limiterBundle {
 // ============================================================
 //
 
-// InitRateLimiterConfig 统一配置限流器参数
+// InitRateLimiterConfig 统一配置默认限流器的参数
 // 参数说明：
 //   - config: 限流器配置结构体
 //   - Rate: 每秒允许的请求数（QPS），必须 > 0，无效时使用默认值
@@ -130,7 +555,13 @@ func getLimiter(key string) *limiterBundle {
 //   - NatsConn: NATS 连接实例，由调用方初始化，为 nil 则不发送通知
 //   - NatsTopic: NATS 限流通知主题
 //   - BypassPatterns: 跳过限流的路径模式列表，支持精确匹配和前缀匹配（以 * 结尾）
+//   - Methods: 按方法覆盖的限流参数，为 nil 时沿用原有设置
+//   - IdleTTL: 空闲限流器的清理时间，必须 > 0，无效时使用默认值
+//   - MaxKeys: 限流器数量上限，必须 > 0，无效时使用默认值
 func InitRateLimiterConfig(config RateLimiterConfig) {
+	rateLimiterConfigMu.Lock()
+	defer rateLimiterConfigMu.Unlock()
+
 	// 验证和设置 rate
 	if config.Rate > 0 {
 		DefaultRateLimiterConfig.Rate = config.Rate
@@ -149,8 +580,6 @@ func InitRateLimiterConfig(config RateLimiterConfig) {
 	// 验证和设置 globalConcurrent
 	if config.GlobalConcurrent > 0 {
 		DefaultRateLimiterConfig.GlobalConcurrent = config.GlobalConcurrent
-		// 重新创建全局信号量
-		globalSem = make(chan struct{}, config.GlobalConcurrent)
 	}
 
 	// 设置 NATS 配置
@@ -164,8 +593,24 @@ func InitRateLimiterConfig(config RateLimiterConfig) {
 		DefaultRateLimiterConfig.BypassPatterns = config.BypassPatterns
 	}
 
-	// 清空现有的限流器，使新配置生效
-	limiterMap = sync.Map{}
+	// 设置按方法覆盖
+	if config.Methods != nil {
+		DefaultRateLimiterConfig.Methods = config.Methods
+	}
+
+	// 设置空闲限流器的清理
+	if config.IdleTTL > 0 {
+		DefaultRateLimiterConfig.IdleTTL = config.IdleTTL
+	}
+	if config.MaxKeys > 0 {
+		DefaultRateLimiterConfig.MaxKeys = config.MaxKeys
+	}
+
+	// 使新配置在默认实例上生效
+	if err := defaultRateLimiter.ApplyConfig(DefaultRateLimiterConfig); err != nil {
+		logger.Errorf("[RATE_LIMIT][CONFIG] invalid config, keep the current one: %v", err)
+		return
+	}
 
 	natsStatus := "disabled"
 	if DefaultRateLimiterConfig.NatsConn != nil {
@@ -173,7 +618,7 @@ func InitRateLimiterConfig(config RateLimiterConfig) {
 	}
 
 	logger.Infof(
-		"[RATE_LIMIT][CONFIG] Initialized: rate=%.2f, burst=%d, concurrent=%d, global=%d, nats=%s, topic=%s, bypass=%v",
+		"[RATE_LIMIT][CONFIG] Initialized: rate=%.2f, burst=%d, concurrent=%d, global=%d, nats=%s, topic=%s, bypass=%v, methods=%d, idle_ttl=%s, max_keys=%d",
 		DefaultRateLimiterConfig.Rate,
 		DefaultRateLimiterConfig.Burst,
 		DefaultRateLimiterConfig.Concurrent,
@@ -181,37 +626,35 @@ func InitRateLimiterConfig(config RateLimiterConfig) {
 		natsStatus,
 		DefaultRateLimiterConfig.NatsTopic,
 		DefaultRateLimiterConfig.BypassPatterns,
+		len(DefaultRateLimiterConfig.Methods),
+		DefaultRateLimiterConfig.IdleTTL,
+		DefaultRateLimiterConfig.MaxKeys,
 	)
 }
 
-//
-// ============================================================
-// Global Concurrency Limiter（全局保命）
-// ============================================================
-//
-
-// globalSem
-// 控制整个 gRPC Server 同时在处理的请求数
-// 防止：
-//   - goroutine 无限增长
-//   - DB / 下游 RPC 被拖死
-var globalSem = make(chan struct{}, DefaultRateLimiterConfig.GlobalConcurrent)
-
-// acquireGlobal
-// 尝试获取一个全局并发名额
-func acquireGlobal() bool {
-	select {
-	case globalSem <- struct{}{}:
-		return true
-	default:
-		return false
+// syncDefaultRateLimiter
+// 使直接修改的 DefaultRateLimiterConfig 在默认限流器上生效，无效时记录日志并保留当前配置
+func syncDefaultRateLimiter() {
+	rateLimiterConfigMu.Lock()
+	defer rateLimiterConfigMu.Unlock()
+	if reflect.DeepEqual(DefaultRateLimiterConfig, defaultRateLimiter.Config()) {
+		return
+	}
+	if err := defaultRateLimiter.ApplyConfig(DefaultRateLimiterConfig); err != nil {
+		logger.Errorf("[RATE_LIMIT][CONFIG] invalid DefaultRateLimiterConfig, keep the current config: %v", err)
 	}
 }
 
-// releaseGlobal
-// 释放全局并发名额
-func releaseGlobal() {
-	<-globalSem
+// ApplyRateLimiterConfig 校验并整体替换默认限流器的配置（不做默认值合并）
+// 校验失败时返回错误，当前配置保持不变
+func ApplyRateLimiterConfig(config RateLimiterConfig) error {
+	rateLimiterConfigMu.Lock()
+	defer rateLimiterConfigMu.Unlock()
+	if err := defaultRateLimiter.ApplyConfig(config); err != nil {
+		return err
+	}
+	DefaultRateLimiterConfig = config
+	return nil
 }
 
 //
@@ -246,8 +689,8 @@ func getClientIP(ctx context.Context) string {
 // 支持：
 //   - 精确匹配
 //   - 前缀匹配（以 * 结尾）
-func isBypassMethod(method string) bool {
-	for _, pattern := range DefaultRateLimiterConfig.BypassPatterns {
+func (c *RateLimiterConfig) isBypassMethod(method string) bool {
+	for _, pattern := range c.BypassPatterns {
 		if pattern == method {
 			return true
 		}
@@ -279,9 +722,10 @@ type RateLimitEvent struct {
 
 // sendNatsNotification
 // 异步发送 NATS 消息，避免阻塞主流程
-func sendNatsNotification(ip, method, direction string) {
+func (c *RateLimiterConfig) sendNatsNotification(ip, method, direction string) {
 	// 如果未配置 NATS 连接，直接返回
-	if DefaultRateLimiterConfig.NatsConn == nil {
+	conn, topic := c.NatsConn, c.NatsTopic
+	if conn == nil {
 		return
 	}
 
@@ -300,7 +744,7 @@ func sendNatsNotification(ip, method, direction string) {
 			return
 		}
 
-		err = DefaultRateLimiterConfig.NatsConn.Publish(DefaultRateLimiterConfig.NatsTopic, payload)
+		err = conn.Publish(topic, payload)
 		if err != nil {
 			logger.Errorf("[RATE_LIMIT][NATS] publish error: %v", err)
 		}
@@ -313,7 +757,15 @@ func sendNatsNotification(ip, method, direction string) {
 // ============================================================
 //
 
+// UnaryRateLimitInterceptor 使用默认限流器的 unary 拦截器
+// 创建时应用对 DefaultRateLimiterConfig 的直接修改
 func UnaryRateLimitInterceptor() grpc.UnaryServerInterceptor {
+	syncDefaultRateLimiter()
+	return defaultRateLimiter.UnaryServerInterceptor()
+}
+
+// UnaryServerInterceptor 返回使用 l 的 unary 拦截器
+func (l *RateLimiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
 	return func(
 		ctx context.Context,
 		req interface{},
@@ -323,8 +775,11 @@ func UnaryRateLimitInterceptor() grpc.UnaryServerInterceptor {
 
 		method := info.FullMethod
 
+		// 整个请求使用同一份配置
+		conf := l.conf.Load()
+
 		// 健康检查等接口直接放行
-		if isBypassMethod(method) {
+		if conf.isBypassMethod(method) {
 			return handler(ctx, req)
 		}
 
@@ -332,32 +787,31 @@ func UnaryRateLimitInterceptor() grpc.UnaryServerInterceptor {
 		ip := getClientIP(ctx)
 
 		// ① 全局并发限制（最先做，防止 goroutine 堆积）
-		if !acquireGlobal() {
+		if !l.global.tryAcquire() {
 			grpcRateLimitedTotal.WithLabelValues("global", "unary").Inc()
-			sendNatsNotification(ip, method, "unary_global_concurrent")
+			conf.sendNatsNotification(ip, method, "unary_global_concurrent")
 			return nil, status.Error(codes.Internal, "server busy")
 		}
-		defer releaseGlobal()
+		defer l.global.release()
 
 		key := ip + "|" + method
-		limiter := getLimiter(key)
+		limiter := l.getLimiter(conf, ip, method)
+		defer limiter.unref()
 
 		// ② QPS 限流（削峰）
 		if !limiter.qps.Allow() {
 			grpcRateLimitedTotal.WithLabelValues(key, "unary").Inc()
-			sendNatsNotification(ip, method, "unary_qps")
+			conf.sendNatsNotification(ip, method, "unary_qps")
 			return nil, status.Error(codes.Internal, "rate limit exceeded")
 		}
 
 		// ③ 并发限制（防慢接口拖垮）
-		select {
-		case limiter.conc <- struct{}{}:
-			defer func() { <-limiter.conc }()
-		default:
+		if !limiter.conc.tryAcquire() {
 			grpcRateLimitedTotal.WithLabelValues(key, "unary").Inc()
-			sendNatsNotification(ip, method, "unary_concurrent")
+			conf.sendNatsNotification(ip, method, "unary_concurrent")
 			return nil, status.Error(codes.Internal, "too many concurrent requests")
 		}
+		defer limiter.conc.release()
 
 		return handler(ctx, req)
 	}
@@ -375,6 +829,7 @@ type rateLimitServerStream struct {
 	grpc.ServerStream
 	method  string
 	ip      string
+	conf    *RateLimiterConfig
 	limiter *limiterBundle
 }
 
@@ -386,7 +841,7 @@ func (s *rateLimitServerStream) RecvMsg(m interface{}) error {
 			s.ip+"|"+s.method,
 			"stream_recv",
 		).Inc()
-		sendNatsNotification(s.ip, s.method, "stream_recv_qps")
+		s.conf.sendNatsNotification(s.ip, s.method, "stream_recv_qps")
 		return status.Error(codes.Internal, "stream recv rate limit exceeded")
 	}
 	return s.ServerStream.RecvMsg(m)
@@ -400,7 +855,7 @@ func (s *rateLimitServerStream) SendMsg(m interface{}) error {
 			s.ip+"|"+s.method,
 			"stream_send",
 		).Inc()
-		sendNatsNotification(s.ip, s.method, "stream_send_qps")
+		s.conf.sendNatsNotification(s.ip, s.method, "stream_send_qps")
 		return status.Error(codes.Internal, "stream send rate limit exceeded")
 	}
 	return s.ServerStream.SendMsg(m)
@@ -412,7 +867,15 @@ func (s *rateLimitServerStream) SendMsg(m interface{}) error {
 // ============================================================
 //
 
+// StreamRateLimitInterceptor 使用默认限流器的 stream 拦截器
+// 创建时应用对 DefaultRateLimiterConfig 的直接修改
 func StreamRateLimitInterceptor() grpc.StreamServerInterceptor {
+	syncDefaultRateLimiter()
+	return defaultRateLimiter.StreamServerInterceptor()
+}
+
+// StreamServerInterceptor 返回使用 l 的 stream 拦截器
+func (l *RateLimiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
 	return func(
 		srv interface{},
 		ss grpc.ServerStream,
@@ -422,7 +885,10 @@ func StreamRateLimitInterceptor() grpc.StreamServerInterceptor {
 
 		method := info.FullMethod
 
-		if isBypassMethod(method) {
+		// 整个 stream 使用同一份配置
+		conf := l.conf.Load()
+
+		if conf.isBypassMethod(method) {
 			return handler(srv, ss)
 		}
 
@@ -430,31 +896,31 @@ func StreamRateLimitInterceptor() grpc.StreamServerInterceptor {
 		ip := getClientIP(ss.Context())
 
 		// ① 全局并发限制
-		if !acquireGlobal() {
+		if !l.global.tryAcquire() {
 			grpcRateLimitedTotal.WithLabelValues("global", "stream").Inc()
-			sendNatsNotification(ip, method, "stream_global_concurrent")
+			conf.sendNatsNotification(ip, method, "stream_global_concurrent")
 			return status.Error(codes.Internal, "server busy")
 		}
-		defer releaseGlobal()
+		defer l.global.release()
 
 		key := ip + "|" + method
-		limiter := getLimiter(key)
+		limiter := l.getLimiter(conf, ip, method)
+		defer limiter.unref()
 
 		// ② stream 级并发限制
-		select {
-		case limiter.conc <- struct{}{}:
-			defer func() { <-limiter.conc }()
-		default:
+		if !limiter.conc.tryAcquire() {
 			grpcRateLimitedTotal.WithLabelValues(key, "stream").Inc()
-			sendNatsNotification(ip, method, "stream_concurrent")
+			conf.sendNatsNotification(ip, method, "stream_concurrent")
 			return status.Error(codes.Internal, "too many concurrent streams")
 		}
+		defer limiter.conc.release()
 
 		// ③ 包装 stream，实现消息级限流
 		wrapped := &rateLimitServerStream{
 			ServerStream: ss,
 			method:       method,
 			ip:           ip,
+			conf:         conf,
 			limiter:      limiter,
 		}
 
@@ -0,0 +1,270 @@
+package server_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	server "github.com/rigoiot/pkg/grpc"
+)
+
+// metricValue 返回默认 registry 中 name 在 labels（name, value 成对）下的计数或数值
+func metricValue(name string, labels ...string) float64 {
+	mfs, _ := prometheus.DefaultGatherer.Gather()
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			values := map[string]string{}
+			for _, l := range m.GetLabel() {
+				values[l.GetName()] = l.GetValue()
+			}
+			for i := 0; i+1 < len(labels); i += 2 {
+				if values[labels[i]] != labels[i+1] {
+					continue metrics
+				}
+			}
+			if m.GetGauge() != nil {
+				return m.GetGauge().GetValue()
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+// baseConfig 返回一份合法的限流配置
+func baseConfig() server.RateLimiterConfig {
+	return server.RateLimiterConfig{
+		Rate:             10,
+		Burst:            20,
+		Concurrent:       5,
+		GlobalConcurrent: 50,
+		NatsTopic:        "rate_limit",
+		BypassPatterns:   []string{"/grpc.health.v1.Health/*"},
+		Methods:          map[string]server.MethodLimit{"/a.A/Old": {Rate: 1}},
+		IdleTTL:          time.Minute,
+		MaxKeys:          1000,
+	}
+}
+
+func TestParseRateLimiterConfigYAML(t *testing.T) {
+	config, err := server.ParseRateLimiterConfig(baseConfig(), []byte(`
+rate: 50
+idle_ttl: 10m
+methods:
+  /device.DeviceService/Upload*:
+    rate: 5
+    concurrent: 2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Rate != 50 || config.IdleTTL != 10*time.Minute {
+		t.Errorf("rate = %v, idle_ttl = %s", config.Rate, config.IdleTTL)
+	}
+	// 未出现的字段沿用 base
+	if config.Burst != 20 || config.Concurrent != 5 || config.GlobalConcurrent != 50 || config.MaxKeys != 1000 ||
+		config.NatsTopic != "rate_limit" || len(config.BypassPatterns) != 1 {
+		t.Errorf("base fields lost: %+v", config)
+	}
+	// methods 整体替换
+	if len(config.Methods) != 1 || config.Methods["/device.DeviceService/Upload*"] != (server.MethodLimit{Rate: 5, Concurrent: 2}) {
+		t.Errorf("methods = %v", config.Methods)
+	}
+}
+
+func TestParseRateLimiterConfigJSON(t *testing.T) {
+	config, err := server.ParseRateLimiterConfig(baseConfig(), []byte(`{"burst": 7, "max_keys": 10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Burst != 7 || config.MaxKeys != 10 || config.Rate != 10 {
+		t.Errorf("config = %+v", config)
+	}
+	if config.Methods != nil {
+		t.Errorf("methods = %v, want none without methods in the value", config.Methods)
+	}
+}
+
+func TestParseRateLimiterConfigEmpty(t *testing.T) {
+	config, err := server.ParseRateLimiterConfig(baseConfig(), []byte(" \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Methods) != 1 || config.Rate != 10 {
+		t.Errorf("config = %+v, want the base config", config)
+	}
+}
+
+func TestParseRateLimiterConfigUnknownFields(t *testing.T) {
+	for _, value := range []string{
+		"rate: 50\nburts: 100\n",
+		`{"rate": 50, "burts": 100}`,
+		"methods:\n  /a.A/B:\n    qps: 5\n",
+		"rate: fast\n",
+	} {
+		if _, err := server.ParseRateLimiterConfig(baseConfig(), []byte(value)); err == nil {
+			t.Errorf("%q: want an error", value)
+		}
+	}
+}
+
+func TestRateLimiterConfigValidate(t *testing.T) {
+	for name, modify := range map[string]func(*server.RateLimiterConfig){
+		"zero rate":      func(c *server.RateLimiterConfig) { c.Rate = 0 },
+		"negative burst": func(c *server.RateLimiterConfig) { c.Burst = -1 },
+		"zero global":    func(c *server.RateLimiterConfig) { c.GlobalConcurrent = 0 },
+		"empty pattern":  func(c *server.RateLimiterConfig) { c.Methods = map[string]server.MethodLimit{"": {}} },
+		"negative method": func(c *server.RateLimiterConfig) {
+			c.Methods = map[string]server.MethodLimit{"/a.A/B": {Concurrent: -1}}
+		},
+		"negative ttl":  func(c *server.RateLimiterConfig) { c.IdleTTL = -time.Second },
+		"negative keys": func(c *server.RateLimiterConfig) { c.MaxKeys = -1 },
+	} {
+		config := baseConfig()
+		modify(&config)
+		if config.Validate() == nil {
+			t.Errorf("%s: Validate succeeded", name)
+		}
+	}
+	if err := baseConfig().Validate(); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+}
+
+func TestReloadRateLimiterConfigKeepsLastGood(t *testing.T) {
+	l, err := server.NewRateLimiter(baseConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	failed := metricValue("grpc_rate_limit_config_reloads_total", "result", "error")
+	success := metricValue("grpc_rate_limit_config_reloads_total", "result", "success")
+
+	server.ReloadRateLimiterConfig(l.Config(), "ratelimit", []byte("rate: 80\n"), l.ApplyConfig)
+	if got := l.Config().Rate; got != 80 {
+		t.Fatalf("rate = %v after a valid reload, want 80", got)
+	}
+	for _, value := range []string{"rate: -1\n", "rate: 90\nunknown: 1\n", "{not json"} {
+		server.ReloadRateLimiterConfig(baseConfig(), "ratelimit", []byte(value), l.ApplyConfig)
+		if got := l.Config().Rate; got != 80 {
+			t.Errorf("%q: rate = %v, want the last good 80", value, got)
+		}
+	}
+
+	if got := metricValue("grpc_rate_limit_config_reloads_total", "result", "success") - success; got != 1 {
+		t.Errorf("%v successful reloads, want 1", got)
+	}
+	if got := metricValue("grpc_rate_limit_config_reloads_total", "result", "error") - failed; got != 3 {
+		t.Errorf("%v failed reloads, want 3", got)
+	}
+}
+
+func TestReloadRateLimiterConfigApplyError(t *testing.T) {
+	failed := metricValue("grpc_rate_limit_config_reloads_total", "result", "error")
+	var applied server.RateLimiterConfig
+	server.ReloadRateLimiterConfig(baseConfig(), "ratelimit", []byte("rate: 5\n"), func(config server.RateLimiterConfig) error {
+		applied = config
+		return errors.New("rejected")
+	})
+	if applied.Rate != 5 {
+		t.Errorf("applied rate = %v, want 5", applied.Rate)
+	}
+	if got := metricValue("grpc_rate_limit_config_reloads_total", "result", "error") - failed; got != 1 {
+		t.Errorf("%v failed reloads, want the rejected one", got)
+	}
+}
+
+func TestMethodLimit(t *testing.T) {
+	config := baseConfig()
+	config.Methods = map[string]server.MethodLimit{
+		"/device.DeviceService/*":           {Rate: 3},
+		"/device.DeviceService/Upload*":     {Rate: 5, Concurrent: 2},
+		"/device.DeviceService/UploadLarge": {Burst: 1},
+	}
+	tests := map[string]server.MethodLimit{
+		// 精确匹配优先，为 0 的字段沿用全局配置
+		"/device.DeviceService/UploadLarge": {Rate: 10, Burst: 1, Concurrent: 5},
+		// 最长的前缀
+		"/device.DeviceService/UploadSmall": {Rate: 5, Burst: 20, Concurrent: 2},
+		"/device.DeviceService/GetDevice":   {Rate: 3, Burst: 20, Concurrent: 5},
+		// 无覆盖
+		"/user.UserService/GetUser": {Rate: 10, Burst: 20, Concurrent: 5},
+	}
+	for method, want := range tests {
+		if got := config.MethodLimit(method); got != want {
+			t.Errorf("MethodLimit(%s) = %+v, want %+v", method, got, want)
+		}
+	}
+}
+
+func TestReloadedMethodOverride(t *testing.T) {
+	l, err := server.NewRateLimiter(baseConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server.ReloadRateLimiterConfig(l.Config(), "ratelimit", []byte(`
+methods:
+  /a.A/Upload*:
+    rate: 0.001
+    burst: 1
+`), l.ApplyConfig)
+
+	interceptor := l.UnaryServerInterceptor()
+	ctx := auditContext()
+	if err := callUnary(interceptor, ctx, "/a.A/UploadFile", nil, nil); err != nil {
+		t.Fatalf("first upload: %v", err)
+	}
+	if err := callUnary(interceptor, ctx, "/a.A/UploadFile", nil, nil); err == nil {
+		t.Error("second upload passed the overridden burst of 1")
+	}
+	for i := 0; i < 3; i++ {
+		if err := callUnary(interceptor, ctx, "/a.A/GetFile", nil, nil); err != nil {
+			t.Errorf("GetFile %d: %v, want the global limits", i, err)
+		}
+	}
+}
+
+func TestReloadKeepsCallerFields(t *testing.T) {
+	l, err := server.NewRateLimiter(baseConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// WatchConsul 之后调用方才设置 NATS
+	base := l.Config()
+	pub := &fakePublisher{}
+	config := l.Config()
+	config.NatsConn, config.NatsTopic = pub, "alerts"
+	if err := l.ApplyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Reload(base, "ratelimit", []byte("rate: 80\n"))
+	if got := l.Config(); got.Rate != 80 || got.NatsConn != pub || got.NatsTopic != "alerts" {
+		t.Errorf("rate = %v, nats = %v, topic = %q, want 80 with the NATS set after watching", got.Rate, got.NatsConn, got.NatsTopic)
+	}
+	l.Reload(base, "ratelimit", []byte("nats_topic: reloaded\n"))
+	if got := l.Config(); got.NatsConn != pub || got.NatsTopic != "reloaded" {
+		t.Errorf("nats = %v, topic = %q, want the topic of the value", got.NatsConn, got.NatsTopic)
+	}
+}
+
+func TestReloadDefaultKeepsCallerFields(t *testing.T) {
+	saved := server.DefaultRateLimiterConfig
+	defer server.ApplyRateLimiterConfig(saved)
+
+	pub := &fakePublisher{}
+	server.InitRateLimiterConfig(server.RateLimiterConfig{NatsConn: pub, NatsTopic: "alerts"})
+	server.ReloadDefaultRateLimiterConfig(saved, "ratelimit", []byte("rate: 80\n"))
+	if got := server.DefaultRateLimiterConfig; got.Rate != 80 || got.NatsConn != pub || got.NatsTopic != "alerts" {
+		t.Errorf("rate = %v, nats = %v, topic = %q, want 80 with the NATS set by InitRateLimiterConfig", got.Rate, got.NatsConn, got.NatsTopic)
+	}
+}
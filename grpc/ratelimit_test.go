@@ -0,0 +1,404 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	server "github.com/rigoiot/pkg/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+// peerContext 返回来自 ip 的请求上下文
+func peerContext(ip string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50123}})
+}
+
+// newRateLimiter 创建 config 的限流器，测试结束时关闭
+func newRateLimiter(t *testing.T, config server.RateLimiterConfig) *server.RateLimiter {
+	t.Helper()
+	l, err := server.NewRateLimiter(config)
+	if err != nil {
+		t.Fatalf("NewRateLimiter: %v", err)
+	}
+	t.Cleanup(l.Close)
+	return l
+}
+
+// holdUnary 发起一个阻塞在 handler 中的请求，占用名额直到调用返回的函数
+func holdUnary(t *testing.T, interceptor grpc.UnaryServerInterceptor, ctx context.Context, method string) func() {
+	t.Helper()
+	entered, release, done := make(chan struct{}), make(chan struct{}), make(chan error, 1)
+	go func() {
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method},
+			func(context.Context, interface{}) (interface{}, error) {
+				close(entered)
+				<-release
+				return nil, nil
+			})
+		done <- err
+	}()
+	select {
+	case <-entered:
+	case err := <-done:
+		t.Fatalf("held %s rejected: %v", method, err)
+	}
+	return func() {
+		close(release)
+		<-done
+	}
+}
+
+func TestRateLimiterInstancesIsolated(t *testing.T) {
+	config := baseConfig()
+	config.GlobalConcurrent = 1
+	config.Methods = map[string]server.MethodLimit{"/a.A/Limited": {Rate: 0.001, Burst: 1}}
+	l1, l2 := newRateLimiter(t, config), newRateLimiter(t, config)
+	i1, i2 := l1.UnaryServerInterceptor(), l2.UnaryServerInterceptor()
+	ctx := peerContext("10.0.1.1")
+
+	// 令牌桶
+	if err := callUnary(i1, ctx, "/a.A/Limited", nil, nil); err != nil {
+		t.Fatalf("first request on l1: %v", err)
+	}
+	if err := callUnary(i1, ctx, "/a.A/Limited", nil, nil); err == nil {
+		t.Error("second request on l1 passed the burst of 1")
+	}
+	if err := callUnary(i2, ctx, "/a.A/Limited", nil, nil); err != nil {
+		t.Errorf("first request on l2: %v, want its own limiter", err)
+	}
+
+	// 全局信号量
+	release := holdUnary(t, i1, ctx, "/a.A/Slow")
+	defer release()
+	if err := callUnary(i1, ctx, "/a.A/Other", nil, nil); err == nil {
+		t.Error("l1 passed a second request with a global concurrency of 1")
+	}
+	if err := callUnary(i2, ctx, "/a.A/Other", nil, nil); err != nil {
+		t.Errorf("l2 request: %v, want its own global semaphore", err)
+	}
+}
+
+func TestApplyConfigResizesGlobalSemaphore(t *testing.T) {
+	config := baseConfig()
+	config.GlobalConcurrent = 2
+	l := newRateLimiter(t, config)
+	interceptor := l.UnaryServerInterceptor()
+	ctx := peerContext("10.0.1.2")
+
+	release1 := holdUnary(t, interceptor, ctx, "/a.A/Slow1")
+	release2 := holdUnary(t, interceptor, ctx, "/a.A/Slow2")
+	if err := callUnary(interceptor, ctx, "/a.A/Other", nil, nil); err == nil {
+		t.Fatal("third request passed a global concurrency of 2")
+	}
+
+	// 缩容时已占用的名额继续有效，释放后才低于新容量
+	config.GlobalConcurrent = 1
+	if err := l.ApplyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	release1()
+	if err := callUnary(interceptor, ctx, "/a.A/Other", nil, nil); err == nil {
+		t.Error("request passed with 1 held slot and a global concurrency of 1")
+	}
+	release2()
+	if err := callUnary(interceptor, ctx, "/a.A/Other", nil, nil); err != nil {
+		t.Errorf("request on a free semaphore: %v", err)
+	}
+
+	// 扩容立即生效
+	release1 = holdUnary(t, interceptor, ctx, "/a.A/Slow1")
+	defer release1()
+	config.GlobalConcurrent = 2
+	if err := l.ApplyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := callUnary(interceptor, ctx, "/a.A/Other", nil, nil); err != nil {
+		t.Errorf("request after growing the semaphore: %v", err)
+	}
+
+	// 无效配置不生效
+	config.GlobalConcurrent = 0
+	if err := l.ApplyConfig(config); err == nil {
+		t.Error("ApplyConfig of an invalid config succeeded")
+	}
+	if got := l.Config().GlobalConcurrent; got != 2 {
+		t.Errorf("global concurrency = %d, want the last valid 2", got)
+	}
+}
+
+func TestApplyConfigAdjustsLimitersInPlace(t *testing.T) {
+	config := baseConfig()
+	config.Concurrent = 1
+	config.Methods = map[string]server.MethodLimit{"/a.A/Limited": {Rate: 0.001, Burst: 2}}
+	l := newRateLimiter(t, config)
+	interceptor := l.UnaryServerInterceptor()
+	ctx := peerContext("10.0.1.3")
+
+	// 已占用的并发名额保留，新的上限在下一次请求时生效
+	release := holdUnary(t, interceptor, ctx, "/a.A/Slow")
+	defer release()
+	if err := callUnary(interceptor, ctx, "/a.A/Slow", nil, nil); err == nil {
+		t.Fatal("second request passed a concurrency of 1")
+	}
+	config.Concurrent = 2
+	if err := l.ApplyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := callUnary(interceptor, ctx, "/a.A/Slow", nil, nil); err != nil {
+		t.Errorf("second request after raising the concurrency: %v", err)
+	}
+
+	// 令牌桶中剩余的令牌保留，不会重建出完整的 burst
+	if err := callUnary(interceptor, ctx, "/a.A/Limited", nil, nil); err != nil {
+		t.Fatalf("first limited request: %v", err)
+	}
+	config.Methods = map[string]server.MethodLimit{"/a.A/Limited": {Rate: 0.002, Burst: 2}}
+	if err := l.ApplyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := callUnary(interceptor, ctx, "/a.A/Limited", nil, nil); err != nil {
+		t.Errorf("request on the last token: %v", err)
+	}
+	if err := callUnary(interceptor, ctx, "/a.A/Limited", nil, nil); err == nil {
+		t.Error("request passed an empty bucket, the limiter was recreated")
+	}
+}
+
+func TestStaleRequestKeepsCurrentLimits(t *testing.T) {
+	config := baseConfig()
+	config.Concurrent = 1
+	l := newRateLimiter(t, config)
+	stale := l.ConfigPointer()
+
+	config.Concurrent = 5
+	if err := l.ApplyConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	limit, unref := l.RefLimiter(l.ConfigPointer(), "10.0.1.4", "/a.A/B")
+	unref()
+	if limit != 5 {
+		t.Fatalf("concurrency = %d, want 5", limit)
+	}
+
+	// 配置变更前开始的请求不会把限流器调回旧配置
+	limit, unref = l.RefLimiter(stale, "10.0.1.4", "/a.A/B")
+	unref()
+	if limit != 5 {
+		t.Errorf("concurrency after a stale request = %d, want the current 5", limit)
+	}
+}
+
+// defaultRuns 区分每次运行在默认实例中使用的客户端 IP
+var defaultRuns atomic.Int32
+
+func TestDefaultRateLimiter(t *testing.T) {
+	saved := server.DefaultRateLimiterConfig
+	defer server.ApplyRateLimiterConfig(saved)
+
+	config := saved
+	config.Methods = map[string]server.MethodLimit{
+		"/test.Default/Limited": {Rate: 0.001, Burst: 1},
+		"/test.Default/Watch":   {Concurrent: 1},
+	}
+	if err := server.ApplyRateLimiterConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.DefaultRateLimiterConfig.Methods) != 2 {
+		t.Errorf("DefaultRateLimiterConfig.Methods = %v", server.DefaultRateLimiterConfig.Methods)
+	}
+
+	unary := server.UnaryRateLimitInterceptor()
+	ctx := peerContext(fmt.Sprintf("10.0.2.%d", defaultRuns.Add(1)))
+	if err := callUnary(unary, ctx, "/test.Default/Limited", nil, nil); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := callUnary(unary, ctx, "/test.Default/Limited", nil, nil); err == nil {
+		t.Error("second request passed the burst of 1")
+	}
+
+	stream := server.StreamRateLimitInterceptor()
+	entered, release, done := make(chan struct{}), make(chan struct{}), make(chan error, 1)
+	ss := &fakeServerStream{ctx: ctx}
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Default/Watch"}
+	go func() {
+		done <- stream(nil, ss, info, func(interface{}, grpc.ServerStream) error {
+			close(entered)
+			<-release
+			return nil
+		})
+	}()
+	<-entered
+	if err := stream(nil, ss, info, func(interface{}, grpc.ServerStream) error { return nil }); err == nil {
+		t.Error("second stream passed the concurrency of 1")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("held stream: %v", err)
+	}
+
+	// 无效配置不生效
+	invalid := config
+	invalid.Rate = -1
+	if err := server.ApplyRateLimiterConfig(invalid); err == nil {
+		t.Error("ApplyRateLimiterConfig of an invalid config succeeded")
+	}
+	if server.DefaultRateLimiterConfig.Rate != config.Rate {
+		t.Errorf("rate = %v, want the last valid %v", server.DefaultRateLimiterConfig.Rate, config.Rate)
+	}
+
+	// InitRateLimiterConfig 只合并有效的字段
+	server.InitRateLimiterConfig(server.RateLimiterConfig{Concurrent: 7, Rate: -1})
+	if got := server.DefaultRateLimiterConfig; got.Concurrent != 7 || got.Rate != config.Rate {
+		t.Errorf("merged config: concurrent = %d, rate = %v", got.Concurrent, got.Rate)
+	}
+}
+
+func TestDefaultRateLimiterDirectAssignment(t *testing.T) {
+	saved := server.DefaultRateLimiterConfig
+	defer server.ApplyRateLimiterConfig(saved)
+
+	// 启动时直接修改默认配置
+	server.DefaultRateLimiterConfig.Methods = map[string]server.MethodLimit{"/test.Direct/*": {Rate: 0.001, Burst: 1}}
+	server.DefaultRateLimiterConfig.BypassPatterns = []string{"/test.Direct/Bypass*"}
+	unary := server.UnaryRateLimitInterceptor()
+
+	ctx := peerContext(fmt.Sprintf("10.0.5.%d", defaultRuns.Add(1)))
+	if err := callUnary(unary, ctx, "/test.Direct/Limited", nil, nil); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := callUnary(unary, ctx, "/test.Direct/Limited", nil, nil); err == nil {
+		t.Error("second request passed the assigned burst of 1")
+	}
+
+	// 无效的直接修改不生效
+	server.DefaultRateLimiterConfig.Rate = -1
+	server.StreamRateLimitInterceptor()
+	for i := 0; i < 3; i++ {
+		if err := callUnary(unary, ctx, "/test.Direct/Bypass", nil, nil); err != nil {
+			t.Errorf("bypassed request %d: %v", i, err)
+		}
+	}
+	if err := callUnary(unary, ctx, "/test.Direct/Limited", nil, nil); err == nil {
+		t.Error("limited request passed after an invalid assignment")
+	}
+}
+
+func TestRateLimiterIdleEviction(t *testing.T) {
+	config := baseConfig()
+	config.IdleTTL = time.Minute
+	l := newRateLimiter(t, config)
+	interceptor := l.UnaryServerInterceptor()
+	ctx := peerContext("10.0.3.1")
+	for _, method := range []string{"/a.A/B", "/a.A/C", "/a.A/D"} {
+		if err := callUnary(interceptor, ctx, method, nil, nil); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+	}
+	keys := func() float64 { return metricValue("grpc_rate_limiter_keys", "instance", l.Name()) }
+	if l.Keys() != 3 || keys() != 3 {
+		t.Fatalf("%d limiters, gauge %v, want 3", l.Keys(), keys())
+	}
+
+	l.Evict(time.Now().Add(30 * time.Second))
+	if l.Keys() != 3 {
+		t.Errorf("%d limiters before IdleTTL, want 3", l.Keys())
+	}
+	l.Evict(time.Now().Add(2 * time.Minute))
+	if l.Keys() != 0 || keys() != 0 {
+		t.Errorf("%d limiters, gauge %v after IdleTTL, want 0", l.Keys(), keys())
+	}
+	if got := metricValue("grpc_rate_limiter_evictions_total", "instance", l.Name(), "reason", "idle"); got != 3 {
+		t.Errorf("%v idle evictions, want 3", got)
+	}
+
+	// 被清理的 key 在下一次请求时重新创建
+	if err := callUnary(interceptor, ctx, "/a.A/B", nil, nil); err != nil || l.Keys() != 1 {
+		t.Errorf("request after eviction: %v, %d limiters", err, l.Keys())
+	}
+}
+
+func TestRateLimiterMaxKeys(t *testing.T) {
+	config := baseConfig()
+	config.Rate, config.Burst = 0.001, 1
+	config.IdleTTL = 0
+	config.MaxKeys = 10
+	l := newRateLimiter(t, config)
+	interceptor := l.UnaryServerInterceptor()
+	ip := func(i int) context.Context { return peerContext(fmt.Sprintf("10.0.4.%d", i)) }
+	for i := 1; i <= 20; i++ {
+		if err := callUnary(interceptor, ip(i), "/a.A/B", nil, nil); err != nil {
+			t.Fatalf("request from %d: %v", i, err)
+		}
+	}
+
+	// 超过 MaxKeys 时 janitor 立即清理到 MaxKeys 的 90%
+	deadline := time.Now().Add(2 * time.Second)
+	for l.Keys() > 10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.Evict(time.Now())
+	if n := l.Keys(); n > 9 || n == 0 {
+		t.Errorf("%d limiters, want at most 90%% of MaxKeys", n)
+	}
+	if got := metricValue("grpc_rate_limiter_evictions_total", "instance", l.Name(), "reason", "capacity"); got < 11 {
+		t.Errorf("%v capacity evictions, want at least 11", got)
+	}
+
+	// 最久未使用的被清理，令牌桶重新装满；最近使用的保留
+	if err := callUnary(interceptor, ip(1), "/a.A/B", nil, nil); err != nil {
+		t.Errorf("oldest key: %v, want a new limiter", err)
+	}
+	if err := callUnary(interceptor, ip(20), "/a.A/B", nil, nil); err == nil {
+		t.Error("newest key passed an empty bucket, want its limiter kept")
+	}
+}
+
+func TestRateLimiterKeepsBusyLimiters(t *testing.T) {
+	config := baseConfig()
+	config.IdleTTL = time.Minute
+	config.MaxKeys = 1
+	l := newRateLimiter(t, config)
+	interceptor := l.UnaryServerInterceptor()
+
+	release := holdUnary(t, interceptor, peerContext("10.0.5.1"), "/a.A/Slow")
+	l.Evict(time.Now().Add(time.Hour))
+	if l.Keys() != 1 {
+		t.Errorf("%d limiters, want the busy one kept", l.Keys())
+	}
+
+	release()
+	l.Evict(time.Now().Add(time.Hour))
+	if l.Keys() != 0 {
+		t.Errorf("%d limiters after the request, want 0", l.Keys())
+	}
+}
+
+func TestRateLimiterLazyJanitor(t *testing.T) {
+	before := runtime.NumGoroutine()
+	var limiters []*server.RateLimiter
+	for i := 0; i < 10; i++ {
+		limiters = append(limiters, newRateLimiter(t, baseConfig()))
+	}
+	if n := runtime.NumGoroutine() - before; n >= 10 {
+		t.Errorf("%d goroutines started by idle limiters", n)
+	}
+
+	// 第一次请求启动 janitor，Close 停止已启动和未启动的 janitor
+	l := limiters[0]
+	if err := callUnary(l.UnaryServerInterceptor(), peerContext("10.0.6.1"), "/a.A/B", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range limiters {
+		l.Close()
+		l.Close()
+	}
+	if err := callUnary(l.UnaryServerInterceptor(), peerContext("10.0.6.2"), "/a.A/B", nil, nil); err != nil {
+		t.Errorf("request after Close: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"io"
 	_log "log"
 	"os"
 
@@ -20,13 +21,13 @@ func Init(logPath string, maxArchives int, rotateSize, level string) *logrus.Log
 
 	os.MkdirAll(logPath, 0777)
 
-	infoWriter, err := logrotate.NewLogger(logrotate.File(logPath+"/info.log"), logrotate.RotatePeriod(logrotate.PeriodDaily), logrotate.MaxArchives(maxArchives), logrotate.RotateSize(rotateSize))
+	infoWriter, err := NewRotateWriter(logPath+"/info.log", maxArchives, rotateSize)
 
 	if err != nil {
 		_log.Println(err.Error())
 	}
 
-	errorWriter, err := logrotate.NewLogger(logrotate.File(logPath+"/error.log"), logrotate.RotatePeriod(logrotate.PeriodDaily), logrotate.MaxArchives(maxArchives), logrotate.RotateSize(rotateSize))
+	errorWriter, err := NewRotateWriter(logPath+"/error.log", maxArchives, rotateSize)
 	if err != nil {
 		_log.Println(err.Error())
 	}
@@ -55,6 +56,11 @@ func Init(logPath string, maxArchives int, rotateSize, level string) *logrus.Log
 	return log
 }
 
+// NewRotateWriter returns a writer to file rotated daily or when it exceeds rotateSize, e.g. "100MB"
+func NewRotateWriter(file string, maxArchives int, rotateSize string) (io.WriteCloser, error) {
+	return logrotate.NewLogger(logrotate.File(file), logrotate.RotatePeriod(logrotate.PeriodDaily), logrotate.MaxArchives(maxArchives), logrotate.RotateSize(rotateSize))
+}
+
 // Logger return the logrus logger
 func Logger() *logrus.Logger {
 	return log
@@ -10,13 +10,13 @@ import (
 
 func TestLoggerInitilization(t *testing.T) {
 
-	logger.Init("./log", 7, 86400, "debug")
+	logger.Init("./log", 7, "100MB", "debug")
 
 	logger.Infof("testing log")
 }
 
 func TestCustomHook(t *testing.T) {
-	logger.Init("./log", 7, 86400, "error")
+	logger.Init("./log", 7, "100MB", "error")
 
 	logger.SetCustomHook(func(entry *logrus.Entry) error {
 		fmt.Printf("level is:%s, msg:%s\n", entry.Level, entry.Message)
@@ -0,0 +1,111 @@
+package tenancy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rigoiot/pkg/auth"
+	uuid "github.com/satori/go.uuid"
+)
+
+var (
+	// ErrNoTenantScope is returned for updates and deletes of tenant owned models
+	// on a DB not scoped by Scoped or ProjectScoped
+	ErrNoTenantScope = errors.New("tenancy: update or delete without tenant scope")
+
+	// AccountColumn is the column holding the owner account of a model
+	AccountColumn = "account_id"
+
+	// ProjectColumn is the column holding the owner project of a model
+	ProjectColumn = "project_id"
+)
+
+const (
+	tenantKey = "tenancy:tenant"
+	skipKey   = "tenancy:skip"
+)
+
+// tenant is the owner stored in the DB settings by Scoped
+type tenant struct {
+	accountID uuid.UUID
+	projectID uuid.UUID
+}
+
+// Scoped returns db restricted to the account of the request in ctx.
+// Models created with it get their account_id set to this account.
+func Scoped(ctx context.Context, db *gorm.DB) (*gorm.DB, error) {
+	id := auth.RequestIdentity(ctx)
+	if err := id.Require(auth.FieldAccountID); err != nil {
+		return nil, err
+	}
+	t := tenant{accountID: id.AccountID}
+	return db.Set(tenantKey, t).Where(AccountColumn+" = ?", t.accountID.String()), nil
+}
+
+// ProjectScoped returns db restricted to the account and project of the request in ctx.
+// Models created with it get their account_id and project_id set.
+func ProjectScoped(ctx context.Context, db *gorm.DB) (*gorm.DB, error) {
+	id := auth.RequestIdentity(ctx)
+	if err := id.Require(auth.FieldAccountID, auth.FieldProjectID); err != nil {
+		return nil, err
+	}
+	t := tenant{accountID: id.AccountID, projectID: id.ProjectID}
+	return db.Set(tenantKey, t).
+		Where(AccountColumn+" = ?", t.accountID.String()).
+		Where(ProjectColumn+" = ?", t.projectID.String()), nil
+}
+
+// Unscoped returns db allowed to update and delete across tenants, for maintenance jobs
+func Unscoped(db *gorm.DB) *gorm.DB {
+	return db.Set(skipKey, true)
+}
+
+// RegisterCallbacks installs the tenancy callbacks on db:
+//   - create sets the tenant columns of the model from the scope
+//   - update and delete of models with an account_id column fail with ErrNoTenantScope when not scoped
+func RegisterCallbacks(db *gorm.DB) {
+	db.Callback().Create().Before("gorm:create").Register("tenancy:create", createCallback)
+	db.Callback().Update().Before("gorm:update").Register("tenancy:update", requireTenantCallback)
+	db.Callback().Delete().Before("gorm:delete").Register("tenancy:delete", requireTenantCallback)
+}
+
+func createCallback(scope *gorm.Scope) {
+	v, ok := scope.Get(tenantKey)
+	if !ok {
+		return
+	}
+	t := v.(tenant)
+	setTenantColumn(scope, AccountColumn, t.accountID)
+	if t.projectID != uuid.Nil {
+		setTenantColumn(scope, ProjectColumn, t.projectID)
+	}
+}
+
+// setTenantColumn sets column to id, as a string for string fields
+func setTenantColumn(scope *gorm.Scope, column string, id uuid.UUID) {
+	field, ok := scope.FieldByName(column)
+	if !ok {
+		return
+	}
+	var value interface{} = id
+	if field.Field.Kind() == reflect.String {
+		value = id.String()
+	}
+	if err := field.Set(value); err != nil {
+		scope.Err(err)
+	}
+}
+
+func requireTenantCallback(scope *gorm.Scope) {
+	if !scope.HasColumn(AccountColumn) {
+		return
+	}
+	if _, ok := scope.Get(skipKey); ok {
+		return
+	}
+	if _, ok := scope.Get(tenantKey); !ok {
+		scope.Err(ErrNoTenantScope)
+	}
+}
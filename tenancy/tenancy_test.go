@@ -0,0 +1,130 @@
+package tenancy_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/rigoiot/pkg/auth"
+	"github.com/rigoiot/pkg/tenancy"
+	uuid "github.com/satori/go.uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type device struct {
+	ID        uint `gorm:"primary_key"`
+	AccountID string
+	ProjectID string
+	Name      string
+}
+
+var (
+	accountA = uuid.FromStringOrNil("5f3c9b6e-2a41-4c1f-9d55-8a7f0e2b1c34")
+	accountB = uuid.FromStringOrNil("0e8d7c6b-5a49-4382-9170-6f5e4d3c2b1a")
+	projectA = uuid.FromStringOrNil("9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d")
+)
+
+func openDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	tenancy.RegisterCallbacks(db)
+	if err := db.AutoMigrate(&device{}).Error; err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+func tenantContext(accountID, projectID uuid.UUID) context.Context {
+	return auth.NewContext(context.Background(), &auth.Identity{AccountID: accountID, ProjectID: projectID})
+}
+
+func scoped(t *testing.T, ctx context.Context, db *gorm.DB) *gorm.DB {
+	t.Helper()
+
+	scoped, err := tenancy.Scoped(ctx, db)
+	if err != nil {
+		t.Fatalf("Scoped: %v", err)
+	}
+	return scoped
+}
+
+func TestCreateSetsTenantColumns(t *testing.T) {
+	db := openDB(t)
+
+	scopedDB, err := tenancy.ProjectScoped(tenantContext(accountA, projectA), db)
+	if err != nil {
+		t.Fatalf("ProjectScoped: %v", err)
+	}
+	// a caller supplied owner is overridden
+	d := &device{Name: "meter", AccountID: accountB.String()}
+	if err := scopedDB.Create(d).Error; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	var got device
+	if err := db.First(&got, d.ID).Error; err != nil {
+		t.Fatalf("First: %v", err)
+	}
+	if got.AccountID != accountA.String() || got.ProjectID != projectA.String() {
+		t.Errorf("stored owner = %s/%s, want %s/%s", got.AccountID, got.ProjectID, accountA, projectA)
+	}
+}
+
+func TestScopedQueriesOnlySeeTenant(t *testing.T) {
+	db := openDB(t)
+	scoped(t, tenantContext(accountA, uuid.Nil), db).Create(&device{Name: "a"})
+	scoped(t, tenantContext(accountB, uuid.Nil), db).Create(&device{Name: "b"})
+
+	var devices []device
+	if err := scoped(t, tenantContext(accountA, uuid.Nil), db).Find(&devices).Error; err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	if len(devices) != 1 || devices[0].Name != "a" {
+		t.Errorf("devices = %+v, want only a", devices)
+	}
+}
+
+func TestUpdateAndDeleteRequireTenantScope(t *testing.T) {
+	db := openDB(t)
+	a := &device{Name: "a"}
+	scoped(t, tenantContext(accountA, uuid.Nil), db).Create(a)
+	b := &device{Name: "b"}
+	scoped(t, tenantContext(accountB, uuid.Nil), db).Create(b)
+
+	if err := db.Model(a).Update("name", "x").Error; err != tenancy.ErrNoTenantScope {
+		t.Errorf("unscoped Update error = %v, want ErrNoTenantScope", err)
+	}
+	if err := db.Delete(a).Error; err != tenancy.ErrNoTenantScope {
+		t.Errorf("unscoped Delete error = %v, want ErrNoTenantScope", err)
+	}
+
+	// account A cannot touch the device of account B
+	scopedA := scoped(t, tenantContext(accountA, uuid.Nil), db)
+	if n := scopedA.Model(b).Update("name", "x").RowsAffected; n != 0 {
+		t.Errorf("cross tenant Update affected %d rows", n)
+	}
+	if n := scopedA.Delete(b).RowsAffected; n != 0 {
+		t.Errorf("cross tenant Delete affected %d rows", n)
+	}
+	if n := scopedA.Model(a).Update("name", "x").RowsAffected; n != 1 {
+		t.Errorf("own Update affected %d rows, want 1", n)
+	}
+
+	if err := tenancy.Unscoped(db).Delete(b).Error; err != nil {
+		t.Errorf("Unscoped Delete: %v", err)
+	}
+}
+
+func TestScopedRequiresAccount(t *testing.T) {
+	_, err := tenancy.Scoped(context.Background(), openDB(t))
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Scoped error = %v, want Unauthenticated", err)
+	}
+}